@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"docker-volume-backup/cmd/util/archiveutil"
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	dirFlag      = "dir"
+	outputFlag   = "output"
+	replaceFlag  = "replace"
+	manifestFlag = "manifest"
+	fullFlag     = "full"
+)
+
+func init() {
+	createArchiveCommand.Flags().String(dirFlag, "", "directory to archive")
+	createArchiveCommand.Flags().String(outputFlag, "", "file to write the archive to, - for stdout")
+	createArchiveCommand.Flags().String(manifestFlag, "", "manifest of the backup to store in the archive")
+	createArchiveCommand.Flags().String(snapshotFlag, "", "snapshot file of the previous incremental archive, only changed files are archived and the file is updated")
+	createArchiveCommand.Flags().Bool(fullFlag, false, "archive every file and start a new snapshot file")
+	extractArchiveCommand.Flags().StringArray(archiveFlag, nil, "archive to extract, repeated for the archives of an incremental chain in order")
+	extractArchiveCommand.Flags().String(dirFlag, "", "directory to extract into")
+	extractArchiveCommand.Flags().Bool(replaceFlag, false, "remove the contents of the directory before extracting")
+	if err := createArchiveCommand.MarkFlagRequired(dirFlag); err != nil {
+		panic(err)
+	}
+	if err := extractArchiveCommand.MarkFlagRequired(archiveFlag); err != nil {
+		panic(err)
+	}
+	if err := extractArchiveCommand.MarkFlagRequired(dirFlag); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(createArchiveCommand)
+	rootCmd.AddCommand(extractArchiveCommand)
+}
+
+// createArchiveCommand archives a directory. It runs inside the helper containers which mount
+// the volumes, see dockerutil.RunHelper.
+var createArchiveCommand = &cobra.Command{
+	Use:    dockerutil.CreateArchiveCommand,
+	Short:  "archive a directory, used by helper containers.",
+	Hidden: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, err := cmd.Flags().GetString(dirFlag)
+		if err != nil {
+			panic(err)
+		}
+		output, err := cmd.Flags().GetString(outputFlag)
+		if err != nil {
+			panic(err)
+		}
+		manifest, err := cmd.Flags().GetString(manifestFlag)
+		if err != nil {
+			panic(err)
+		}
+		snapshotFile, err := cmd.Flags().GetString(snapshotFlag)
+		if err != nil {
+			panic(err)
+		}
+		full, err := cmd.Flags().GetBool(fullFlag)
+		if err != nil {
+			panic(err)
+		}
+		var manifestBytes []byte
+		if manifest != "" {
+			manifestBytes = []byte(manifest)
+		}
+		if err := cmdCreateArchive(dir, output, manifestBytes, snapshotFile, full); err != nil {
+			panic(err)
+		}
+	},
+}
+
+func cmdCreateArchive(dir, output string, manifest []byte, snapshotFile string, full bool) error {
+	create := func(w io.Writer) error {
+		return archiveutil.Create(dir, w, manifest)
+	}
+	var next archiveutil.Snapshot
+	if snapshotFile != "" {
+		previous, err := readSnapshot(snapshotFile, full)
+		if err != nil {
+			return err
+		}
+		create = func(w io.Writer) error {
+			var err error
+			next, err = archiveutil.CreateIncremental(dir, w, manifest, previous)
+			return err
+		}
+	}
+
+	if output == "-" || output == "" {
+		if err := create(os.Stdout); err != nil {
+			return err
+		}
+	} else if err := writeArchive(output, create); err != nil {
+		return err
+	}
+	// the snapshot is only updated once the archive exists, so that a failed backup is included in the next one.
+	if snapshotFile != "" {
+		return writeSnapshot(snapshotFile, next)
+	}
+	return nil
+}
+
+// writeArchive writes the archive created by create to output.
+func writeArchive(output string, create func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+		return err
+	}
+	// the archive is written to a temporary file first, so that a failed backup does not leave a
+	// partial archive which looks like a backup.
+	tmp := output + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := create(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, output)
+}
+
+// readSnapshot returns the snapshot of the previous incremental archive, or nil if full is set or
+// there is none, in which case every file is archived.
+func readSnapshot(snapshotFile string, full bool) (archiveutil.Snapshot, error) {
+	if full {
+		return nil, nil
+	}
+	data, err := os.ReadFile(snapshotFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot archiveutil.Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed reading snapshot file %s: %s", snapshotFile, err)
+	}
+	return snapshot, nil
+}
+
+func writeSnapshot(snapshotFile string, snapshot archiveutil.Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp := snapshotFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, snapshotFile)
+}
+
+// extractArchiveCommand extracts an archive into a directory. It runs inside the helper containers
+// which mount the volumes, see dockerutil.RunHelper.
+var extractArchiveCommand = &cobra.Command{
+	Use:    dockerutil.ExtractArchiveCommand,
+	Short:  "extract an archive into a directory, used by helper containers.",
+	Hidden: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		archives, err := cmd.Flags().GetStringArray(archiveFlag)
+		if err != nil {
+			panic(err)
+		}
+		dir, err := cmd.Flags().GetString(dirFlag)
+		if err != nil {
+			panic(err)
+		}
+		replace, err := cmd.Flags().GetBool(replaceFlag)
+		if err != nil {
+			panic(err)
+		}
+		if err := cmdExtractArchive(archives, dir, replace); err != nil {
+			panic(err)
+		}
+	},
+}
+
+// cmdExtractArchive extracts the archives into dir in order. Every archive is checked before removing
+// the current contents, so that a corrupt archive fails early.
+func cmdExtractArchive(archives []string, dir string, replace bool) error {
+	var files []*os.File
+	for _, archive := range archives {
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := archiveutil.Verify(f); err != nil {
+			return fmt.Errorf("archive %s is corrupt: %s", archive, err)
+		}
+		files = append(files, f)
+	}
+
+	if replace {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, f := range files {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		n, err := archiveutil.Extract(f, dir, nil)
+		if err != nil {
+			return err
+		}
+		log.Printf("extracted %d entries of %s into %s", n, archives[i], dir)
+	}
+
+	// files of earlier archives of a chain may have been deleted since, so only the last one is checked.
+	if len(files) == 0 {
+		return nil
+	}
+	last := files[len(files)-1]
+	if _, err := last.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := archiveutil.CheckDir(last, dir, nil); err != nil {
+		return fmt.Errorf("archive %s was not extracted completely: %s", archives[len(archives)-1], err)
+	}
+	return nil
+}
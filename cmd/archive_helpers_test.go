@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveChain(t *testing.T) {
+	src := t.TempDir()
+	backups := t.TempDir()
+	snapshotFile := filepath.Join(backups, "data.snapshot.json")
+	full := filepath.Join(backups, "data-1-full.tar.gz")
+	incr := filepath.Join(backups, "data-2-incr.tar.gz")
+
+	require.NoError(t, os.WriteFile(filepath.Join(src, "kept.txt"), []byte("kept"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "deleted.txt"), []byte("deleted"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(src, "sub"), 0o755))
+	require.NoError(t, cmdCreateArchive(src, full, nil, snapshotFile, false))
+	require.FileExists(t, snapshotFile)
+
+	require.NoError(t, os.Remove(filepath.Join(src, "deleted.txt")))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "sub", ".added"), []byte("added"), 0o644))
+	require.NoError(t, cmdCreateArchive(src, incr, nil, snapshotFile, false))
+
+	dst := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dst, ".old"), []byte("old"), 0o644))
+	require.NoError(t, cmdExtractArchive([]string{full, incr}, dst, true))
+
+	data, err := os.ReadFile(filepath.Join(dst, "kept.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "kept", string(data))
+	data, err = os.ReadFile(filepath.Join(dst, "sub", ".added"))
+	require.NoError(t, err)
+	require.Equal(t, "added", string(data))
+	require.NoFileExists(t, filepath.Join(dst, "deleted.txt"), "files deleted between archives should be removed")
+	require.NoFileExists(t, filepath.Join(dst, ".old"), "the previous contents should be replaced")
+
+	t.Run("corrupt archive keeps the directory", func(t *testing.T) {
+		corrupt := filepath.Join(backups, "data-3-incr.tar.gz")
+		require.NoError(t, os.WriteFile(corrupt, []byte("not an archive"), 0o644))
+		require.Error(t, cmdExtractArchive([]string{full, incr, corrupt}, dst, true))
+		require.FileExists(t, filepath.Join(dst, "kept.txt"))
+	})
+}
@@ -0,0 +1,439 @@
+package azblobbackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/storage"
+)
+
+const (
+	apiVersion = "2020-10-02"
+
+	// blockSize allows archives of up to ~400GB, the maximum number of blocks is 50,000.
+	blockSize = 8 * 1024 * 1024
+
+	// azuriteAccount and azuriteKey are the well known credentials of the Azurite emulator.
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+type Config struct {
+	// Endpoint is the blob service endpoint, e.g. https://account.blob.core.windows.net
+	// or http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+	Endpoint    string
+	AccountName string
+	// AccountKey is the base64 encoded shared key, it is not needed when SASToken is set.
+	AccountKey string
+	SASToken   string
+	Container  string
+	// AccessTier is the tier of uploaded blobs, e.g. Hot, Cool or Archive.
+	AccessTier string
+}
+
+// FromEnv reads the config from AZURE_STORAGE_* environment variables. If a connection string is
+// specified, it is used for any values which are not set individually.
+func FromEnv() (Config, error) {
+	var cfg Config
+	if connectionString, ok := os.LookupEnv("AZURE_STORAGE_CONNECTION_STRING"); ok {
+		var err error
+		cfg, err = ParseConnectionString(connectionString)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	setFromEnv(&cfg.AccountName, "AZURE_STORAGE_ACCOUNT")
+	setFromEnv(&cfg.AccountKey, "AZURE_STORAGE_KEY")
+	setFromEnv(&cfg.SASToken, "AZURE_STORAGE_SAS_TOKEN")
+	setFromEnv(&cfg.Endpoint, "AZURE_STORAGE_ENDPOINT")
+	setFromEnv(&cfg.Container, "AZURE_STORAGE_CONTAINER")
+	setFromEnv(&cfg.AccessTier, "AZURE_STORAGE_ACCESS_TIER")
+	if cfg.Endpoint == "" && cfg.AccountName != "" {
+		cfg.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", cfg.AccountName)
+	}
+	if cfg.Container == "" {
+		return Config{}, fmt.Errorf("AZURE_STORAGE_CONTAINER must be set")
+	}
+	return cfg, nil
+}
+
+func setFromEnv(v *string, key string) {
+	if value, ok := os.LookupEnv(key); ok {
+		*v = value
+	}
+}
+
+// ParseConnectionString reads the account, key, SAS token and blob endpoint from a connection string.
+func ParseConnectionString(connectionString string) (Config, error) {
+	values := map[string]string{}
+	for _, part := range strings.Split(connectionString, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			values[strings.ToLower(k)] = v
+		}
+	}
+
+	if strings.EqualFold(values["usedevelopmentstorage"], "true") {
+		return Config{
+			Endpoint:    "http://127.0.0.1:10000/" + azuriteAccount,
+			AccountName: azuriteAccount,
+			AccountKey:  azuriteKey,
+		}, nil
+	}
+
+	cfg := Config{
+		AccountName: values["accountname"],
+		AccountKey:  values["accountkey"],
+		SASToken:    values["sharedaccesssignature"],
+		Endpoint:    values["blobendpoint"],
+	}
+	if cfg.Endpoint == "" && cfg.AccountName != "" {
+		protocol := values["defaultendpointsprotocol"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		suffix := values["endpointsuffix"]
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		cfg.Endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, cfg.AccountName, suffix)
+	}
+	if cfg.Endpoint == "" {
+		return Config{}, fmt.Errorf("connection string does not contain an account name or blob endpoint")
+	}
+	return cfg, nil
+}
+
+// Backend stores archives as block blobs in an Azure Blob Storage container.
+type Backend struct {
+	config Config
+	client *http.Client
+}
+
+func NewBackend(cfg Config) *Backend {
+	return &Backend{
+		config: cfg,
+		client: http.DefaultClient,
+	}
+}
+
+func (b *Backend) url(blob string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(b.config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + b.config.Container
+	if blob != "" {
+		u.Path += "/" + blob
+	}
+	if b.config.SASToken != "" {
+		sas, err := url.ParseQuery(strings.TrimPrefix(b.config.SASToken, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAS token: %s", err)
+		}
+		for k, v := range sas {
+			query[k] = v
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u, nil
+}
+
+func (b *Backend) do(ctx context.Context, method, blob string, query url.Values, body []byte, header http.Header, expected ...int) (*http.Response, error) {
+	u, err := b.url(blob, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-version", apiVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+
+	if b.config.SASToken == "" && b.config.AccountKey != "" {
+		signature, err := sign(b.config.AccountName, b.config.AccountKey, req)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", b.config.AccountName, signature))
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s returned %s: %s", method, blob, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// sign returns the Shared Key signature of the request.
+// https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func sign(accountName, accountKey string, req *http.Request) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid account key: %s", err)
+	}
+
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for k := range req.Header {
+		if lower := strings.ToLower(k); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonicalHeaders strings.Builder
+	for _, h := range msHeaders {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(req.Header.Get(h)))
+	}
+
+	canonicalResource := "/" + accountName + req.URL.EscapedPath()
+	query := map[string][]string{}
+	for k, v := range req.URL.Query() {
+		query[strings.ToLower(k)] = append(query[strings.ToLower(k)], v...)
+	}
+	var params []string
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		values := query[p]
+		sort.Strings(values)
+		canonicalResource += fmt.Sprintf("\n%s:%s", p, strings.Join(values, ","))
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead.
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalHeaders.String() + canonicalResource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// ensureContainer creates the container, it is not an error if it already exists. SAS tokens
+// which are scoped to the container are not allowed to create it, so with a SAS token a 403 is
+// taken to mean that the container exists, uploads fail later if it does not.
+func (b *Backend) ensureContainer(ctx context.Context) error {
+	expected := []int{http.StatusCreated, http.StatusConflict}
+	if b.config.SASToken != "" {
+		expected = append(expected, http.StatusForbidden)
+	}
+	resp, err := b.do(ctx, http.MethodPut, "", url.Values{"restype": {"container"}}, nil, nil, expected...)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *Backend) Upload(ctx context.Context, key string, r io.Reader, m manifest.Manifest) error {
+	if err := b.ensureContainer(ctx); err != nil {
+		return fmt.Errorf("failed creating container: %s", err)
+	}
+
+	// the archive is uploaded as a series of blocks, which are committed once they have all been uploaded.
+	var blockIDs []string
+	buf := make([]byte, blockSize)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			// block ids must all be the same length.
+			blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%06d", i)))
+			query := url.Values{"comp": {"block"}, "blockid": {blockID}}
+			resp, err := b.do(ctx, http.MethodPut, key, query, buf[:n], nil, http.StatusCreated)
+			if err != nil {
+				return fmt.Errorf("failed uploading block %d: %s", i, err)
+			}
+			_ = resp.Body.Close()
+			blockIDs = append(blockIDs, blockID)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var blockList bytes.Buffer
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range blockIDs {
+		fmt.Fprintf(&blockList, "<Latest>%s</Latest>", id)
+	}
+	blockList.WriteString("</BlockList>")
+
+	header := http.Header{"Content-Type": {"application/xml"}}
+	for k, v := range m.Metadata() {
+		header.Set("x-ms-meta-"+metadataName(k), v)
+	}
+	if b.config.AccessTier != "" {
+		header.Set("x-ms-access-tier", b.config.AccessTier)
+	}
+	resp, err := b.do(ctx, http.MethodPut, key, url.Values{"comp": {"blocklist"}}, blockList.Bytes(), header, http.StatusCreated)
+	if err != nil {
+		return fmt.Errorf("failed committing blocks: %s", err)
+	}
+	return resp.Body.Close()
+}
+
+type enumerationResults struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+		// Metadata has an element for each metadata name.
+		Metadata struct {
+			Entries []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"Metadata"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (b *Backend) List(ctx context.Context, prefix string) ([]storage.Object, error) {
+	var objects []storage.Object
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "include": {"metadata"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := b.do(ctx, http.MethodGet, "", query, nil, nil, http.StatusOK, http.StatusNotFound)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			_ = resp.Body.Close()
+			return nil, nil
+		}
+
+		var results enumerationResults
+		err = xml.NewDecoder(resp.Body).Decode(&results)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing blob list: %s", err)
+		}
+
+		for _, blob := range results.Blobs {
+			modified, _ := http.ParseTime(blob.Properties.LastModified)
+			if obj, ok := storage.NewObject(blob.Name, blob.Properties.ContentLength, modified); ok {
+				obj.Metadata = map[string]string{}
+				for _, e := range blob.Metadata.Entries {
+					obj.Metadata[metadataKey(e.XMLName.Local)] = e.Value
+				}
+				objects = append(objects, obj)
+			}
+		}
+		if results.NextMarker == "" {
+			return objects, nil
+		}
+		marker = results.NextMarker
+	}
+}
+
+func (b *Backend) Download(ctx context.Context, key string, w io.Writer) error {
+	resp, err := b.do(ctx, http.MethodGet, key, url.Values{}, nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, key, url.Values{}, nil, nil, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// metadataName returns the metadata name a manifest metadata key is stored as. Names must be valid C#
+// identifiers, so underscores are doubled and dashes are stored as "_d", which metadataKey reverses.
+func metadataName(key string) string {
+	var sb strings.Builder
+	for _, r := range key {
+		switch r {
+		case '_':
+			sb.WriteString("__")
+		case '-':
+			sb.WriteString("_d")
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// metadataKey returns the manifest metadata key of a name returned by metadataName. Names are case
+// insensitive and may be returned in a different case, the keys of the manifest are lower case.
+func metadataKey(name string) string {
+	name = strings.ToLower(name)
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '_' && i+1 < len(name) {
+			switch name[i+1] {
+			case '_':
+				sb.WriteByte('_')
+				i++
+				continue
+			case 'd':
+				sb.WriteByte('-')
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(name[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,216 @@
+package azblobbackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/util/dateutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer returns an in memory blob service which supports the operations used by the backend.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	blocks := map[string][]byte{}
+	blobs := map[string][]byte{}
+	tiers := map[string]string{}
+	metadatas := map[string]string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		query := r.URL.Query()
+		// requests with a SAS token are scoped to the container, which they cannot create.
+		sas := query.Get("sig") != ""
+		if !sas {
+			require.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+azuriteAccount+":"))
+		}
+
+		// paths are /account/container[/blob]
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+		blob := ""
+		if len(parts) == 3 {
+			blob = parts[2]
+		}
+		body, _ := io.ReadAll(r.Body)
+
+		switch {
+		case r.Method == http.MethodPut && query.Get("restype") == "container" && sas:
+			w.WriteHeader(http.StatusForbidden)
+		case r.Method == http.MethodPut && query.Get("restype") == "container":
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut && query.Get("comp") == "block":
+			blocks[blob+"/"+query.Get("blockid")] = body
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+			var list struct {
+				Latest []string `xml:"Latest"`
+			}
+			require.NoError(t, xml.Unmarshal(body, &list))
+			var contents []byte
+			for _, id := range list.Latest {
+				contents = append(contents, blocks[blob+"/"+id]...)
+			}
+			blobs[blob] = contents
+			tiers[blob] = r.Header.Get("x-ms-access-tier")
+			// the names are returned in the case they were sent in, which is canonicalized by go.
+			var metadata strings.Builder
+			for k := range r.Header {
+				if name := strings.TrimPrefix(k, "X-Ms-Meta-"); name != k {
+					fmt.Fprintf(&metadata, "<%[1]s>%[2]s</%[1]s>", name, r.Header.Get(k))
+				}
+			}
+			metadatas[blob] = metadata.String()
+			require.Equal(t, "config", r.Header.Get("x-ms-meta-volume_dname"), "manifest should be stored as metadata")
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodGet && query.Get("comp") == "list":
+			require.Equal(t, "metadata", query.Get("include"))
+			var buf bytes.Buffer
+			buf.WriteString("<EnumerationResults><Blobs>")
+			for name, contents := range blobs {
+				if strings.HasPrefix(name, query.Get("prefix")) {
+					fmt.Fprintf(&buf, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length><AccessTier>%s</AccessTier></Properties><Metadata>%s</Metadata></Blob>",
+						name, time.Now().UTC().Format(http.TimeFormat), len(contents), tiers[name], metadatas[name])
+				}
+			}
+			buf.WriteString("</Blobs><NextMarker /></EnumerationResults>")
+			_, _ = w.Write(buf.Bytes())
+		case r.Method == http.MethodGet:
+			contents, ok := blobs[blob]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(contents)
+		case r.Method == http.MethodDelete:
+			delete(blobs, blob)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBackend(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t)
+	b := NewBackend(Config{
+		Endpoint:    server.URL + "/" + azuriteAccount,
+		AccountName: azuriteAccount,
+		AccountKey:  azuriteKey,
+		Container:   "backups",
+		AccessTier:  "Cool",
+	})
+
+	key := "config-" + dateutil.GetDayMonthYear() + ".tar.gz"
+	contents := bytes.Repeat([]byte("a"), blockSize+10)
+	require.NoError(t, b.Upload(ctx, key, bytes.NewReader(contents), manifest.Manifest{VolumeName: "config"}))
+
+	t.Run("list", func(t *testing.T) {
+		objects, err := b.List(ctx, "config")
+		require.NoError(t, err)
+		require.Len(t, objects, 1)
+		require.Equal(t, key, objects[0].Key)
+		require.Equal(t, "config", objects[0].VolumeName)
+		require.Equal(t, int64(len(contents)), objects[0].Size)
+		require.Equal(t, "config", objects[0].Metadata["volume-name"])
+	})
+
+	t.Run("download", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, b.Download(ctx, key, &buf))
+		require.Equal(t, contents, buf.Bytes(), "blocks should be committed in order")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, b.Delete(ctx, key))
+		objects, err := b.List(ctx, "config")
+		require.NoError(t, err)
+		require.Empty(t, objects)
+	})
+
+	t.Run("container scoped sas token", func(t *testing.T) {
+		b := NewBackend(Config{
+			Endpoint:  server.URL + "/" + azuriteAccount,
+			Container: "backups",
+			SASToken:  "sv=2020-10-02&sr=c&sp=racwdl&sig=abc%3D",
+		})
+		require.NoError(t, b.Upload(ctx, key, bytes.NewReader(contents), manifest.Manifest{VolumeName: "config"}))
+	})
+}
+
+func TestSign(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:10000/devstoreaccount1/backups?restype=container&comp=list&prefix=config", nil)
+	require.NoError(t, err)
+	req.Header.Set("x-ms-version", apiVersion)
+	req.Header.Set("x-ms-date", "Sat, 15 Oct 2022 03:00:00 GMT")
+
+	signature, err := sign(azuriteAccount, azuriteKey, req)
+	require.NoError(t, err)
+
+	expected := "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+		"x-ms-date:Sat, 15 Oct 2022 03:00:00 GMT\n" +
+		"x-ms-version:" + apiVersion + "\n" +
+		"/devstoreaccount1/devstoreaccount1/backups\ncomp:list\nprefix:config\nrestype:container"
+	key, err := base64.StdEncoding.DecodeString(azuriteKey)
+	require.NoError(t, err)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(expected))
+	require.Equal(t, base64.StdEncoding.EncodeToString(mac.Sum(nil)), signature)
+}
+
+func TestParseConnectionString(t *testing.T) {
+	t.Run("account key", func(t *testing.T) {
+		cfg, err := ParseConnectionString("DefaultEndpointsProtocol=https;AccountName=myaccount;AccountKey=a2V5;EndpointSuffix=core.windows.net")
+		require.NoError(t, err)
+		require.Equal(t, "https://myaccount.blob.core.windows.net", cfg.Endpoint)
+		require.Equal(t, "myaccount", cfg.AccountName)
+		require.Equal(t, "a2V5", cfg.AccountKey)
+	})
+
+	t.Run("sas token", func(t *testing.T) {
+		cfg, err := ParseConnectionString("BlobEndpoint=https://myaccount.blob.core.windows.net/;SharedAccessSignature=sv=2020-10-02&sig=abc%3D")
+		require.NoError(t, err)
+		require.Equal(t, "https://myaccount.blob.core.windows.net/", cfg.Endpoint)
+		require.Equal(t, "sv=2020-10-02&sig=abc%3D", cfg.SASToken)
+	})
+
+	t.Run("development storage", func(t *testing.T) {
+		cfg, err := ParseConnectionString("UseDevelopmentStorage=true")
+		require.NoError(t, err)
+		require.Equal(t, "http://127.0.0.1:10000/devstoreaccount1", cfg.Endpoint)
+		require.Equal(t, azuriteKey, cfg.AccountKey)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseConnectionString("AccountKey=a2V5")
+		require.Error(t, err)
+	})
+}
+
+func TestMetadataName(t *testing.T) {
+	for _, key := range []string{"volume-name", "run-id", "snake_case", "a__-_d-b", "_", "-"} {
+		name := metadataName(key)
+		require.Regexp(t, `^[a-z_][a-z0-9_]*$`, name)
+		require.Equal(t, key, metadataKey(name))
+		require.Equal(t, key, metadataKey(strings.ToUpper(name)), "names are case insensitive")
+	}
+	require.NotEqual(t, metadataName("volume-name"), metadataName("volume_name"))
+}
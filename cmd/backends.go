@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"docker-volume-backup/cmd/azblobbackup"
+	"docker-volume-backup/cmd/gcsbackup"
+	"docker-volume-backup/cmd/rclonebackup"
+	"docker-volume-backup/cmd/sftpbackup"
+	"docker-volume-backup/cmd/storage"
+	"docker-volume-backup/cmd/volumebackup"
+	"docker-volume-backup/cmd/webdavbackup"
+
+	"github.com/docker/docker/client"
+)
+
+// errUnknownBackend is returned for modes which do not store archives in a storage backend.
+var errUnknownBackend = errors.New("unknown storage backend")
+
+// newStorageBackend returns the storage backend for the given mode, configured from
+// environment variables.
+func newStorageBackend(mode string) (storage.Backend, error) {
+	switch mode {
+	case "sftp":
+		return sftpbackup.NewBackend(sftpbackup.FromEnv()), nil
+	case "webdav":
+		return webdavbackup.NewBackend(webdavbackup.FromEnv()), nil
+	case "azblob":
+		cfg, err := azblobbackup.FromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return azblobbackup.NewBackend(cfg), nil
+	case "gcs":
+		return gcsbackup.NewBackend(gcsbackup.FromEnv()), nil
+	case "rclone":
+		cli, err := client.NewClientWithOpts(client.FromEnv)
+		if err != nil {
+			return nil, err
+		}
+		return rclonebackup.NewBackend(rclonebackup.FromEnv(), cli), nil
+	case "docker-volume":
+		cli, err := client.NewClientWithOpts(client.FromEnv)
+		if err != nil {
+			return nil, err
+		}
+		return volumebackup.NewBackend(volumebackup.FromEnv(), cli), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownBackend, mode)
+	}
+}
+
+// downloadFromBackend downloads an archive to a temporary file and returns its path. If key is
+// empty, the newest archive of the volume is downloaded. The caller must remove the file.
+func downloadFromBackend(ctx context.Context, backend storage.Backend, volumeName, key string) (string, error) {
+	if key == "" {
+		obj, err := storage.FindMostRecent(ctx, backend, volumeName)
+		if err != nil {
+			return "", err
+		}
+		key = obj.Key
+	}
+
+	f, err := os.CreateTemp("", "*.tar.gz")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := backend.Download(ctx, key, f); err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("failed downloading %s: %s", key, err)
+	}
+	return f.Name(), nil
+}
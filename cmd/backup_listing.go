@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+	outputCSV   = "csv"
+	outputTable = "table"
+
+	sortTime   = "time"
+	sortVolume = "volume"
+	sortSize   = "size"
+)
+
+// backupListing is a single archive listed by list-backups. Project and Containers are only read
+// from the manifest of the archive when filtering by them.
+type backupListing struct {
+	VolumeName   string    `json:"volumeName" yaml:"volumeName"`
+	Key          string    `json:"key" yaml:"key"`
+	Size         int64     `json:"size" yaml:"size"`
+	LastModified time.Time `json:"lastModified" yaml:"lastModified"`
+	Project      string    `json:"project,omitempty" yaml:"project,omitempty"`
+	Containers   []string  `json:"containers,omitempty" yaml:"containers,omitempty"`
+}
+
+// hostPathListing is the json output of list-backups for --host-path, which keeps the fields of
+// backedUpVolume so that existing scripts keep working.
+type hostPathListing struct {
+	backedUpVolume
+	Size       int64    `json:"size"`
+	Project    string   `json:"project,omitempty"`
+	Containers []string `json:"containers,omitempty"`
+}
+
+// hostPathListings converts archives listed from a host path, whose keys are absolute file paths.
+func hostPathListings(listings []backupListing) []hostPathListing {
+	result := []hostPathListing{}
+	for _, b := range listings {
+		result = append(result, hostPathListing{
+			backedUpVolume: backedUpVolume{
+				VolumeName:       b.VolumeName,
+				AbsoluteFilePath: b.Key,
+				FileName:         filepath.Base(b.Key),
+				LastModTime:      b.LastModified,
+			},
+			Size:       b.Size,
+			Project:    b.Project,
+			Containers: b.Containers,
+		})
+	}
+	return result
+}
+
+// listFilter selects which archives are listed, the zero value lists every archive.
+type listFilter struct {
+	// contains is a string the volume name must contain.
+	contains string
+	// glob is a path.Match pattern the volume name must match.
+	glob      string
+	container string
+	project   string
+	// since and until bound the modification time of the archive, inclusive.
+	since   time.Time
+	until   time.Time
+	minSize int64
+}
+
+// needsManifest returns true if the filter can only be checked with the manifest of the archive.
+func (f listFilter) needsManifest() bool {
+	return f.container != "" || f.project != ""
+}
+
+// matches returns true if the archive is listed, Project and Containers must be set if needsManifest.
+func (f listFilter) matches(b backupListing) (bool, error) {
+	if f.contains != "" && !strings.Contains(b.VolumeName, f.contains) {
+		return false, nil
+	}
+	if f.glob != "" {
+		ok, err := path.Match(f.glob, b.VolumeName)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	if !f.since.IsZero() && b.LastModified.Before(f.since) {
+		return false, nil
+	}
+	if !f.until.IsZero() && b.LastModified.After(f.until) {
+		return false, nil
+	}
+	if b.Size < f.minSize {
+		return false, nil
+	}
+	if f.project != "" && b.Project != f.project {
+		return false, nil
+	}
+	if f.container != "" && !containsString(b.Containers, f.container) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// listArchives returns the archives in the source which match the filter, newest first. With
+// newestOnly, only the newest matching archive of each volume is returned.
+func listArchives(ctx context.Context, source backupSource, f listFilter, newestOnly bool) ([]backupListing, error) {
+	objects, err := source.listObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := []backupListing{}
+	seenVolumes := map[string]struct{}{}
+	for _, obj := range objects {
+		b := backupListing{VolumeName: obj.VolumeName, Key: obj.Key, Size: obj.Size, LastModified: obj.LastModified}
+		if _, seenAlready := seenVolumes[b.VolumeName]; seenAlready && newestOnly {
+			continue
+		}
+		if f.needsManifest() {
+			m, err := source.readManifest(ctx, obj.Key)
+			if err != nil {
+				log.Printf("skipping %s: %s", obj.Key, err)
+				continue
+			}
+			if m != nil {
+				b.Project, b.Containers = m.Project, m.Containers
+			}
+		}
+		ok, err := f.matches(b)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		seenVolumes[b.VolumeName] = struct{}{}
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+// sortListings sorts the archives by time (newest first), volume name or size (largest first).
+// Archives which are equal by the field keep their order.
+func sortListings(listings []backupListing, by string, reverse bool) error {
+	var less func(a, b backupListing) bool
+	switch by {
+	case sortTime:
+		less = func(a, b backupListing) bool { return a.LastModified.After(b.LastModified) }
+	case sortVolume:
+		less = func(a, b backupListing) bool { return a.VolumeName < b.VolumeName }
+	case sortSize:
+		less = func(a, b backupListing) bool { return a.Size > b.Size }
+	default:
+		return fmt.Errorf("invalid sort %q, expected %s, %s or %s", by, sortTime, sortVolume, sortSize)
+	}
+	sort.SliceStable(listings, func(i, j int) bool {
+		if reverse {
+			return less(listings[j], listings[i])
+		}
+		return less(listings[i], listings[j])
+	})
+	return nil
+}
+
+// writeListings writes the archives to w in the given output format.
+func writeListings(w io.Writer, listings []backupListing, format string, now time.Time) error {
+	switch format {
+	case outputJSON:
+		bytes, err := json.Marshal(listings)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(bytes))
+		return err
+	case outputYAML:
+		return yaml.NewEncoder(w).Encode(listings)
+	case outputCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"volumeName", "key", "size", "lastModified", "project", "containers"}); err != nil {
+			return err
+		}
+		for _, b := range listings {
+			if err := cw.Write([]string{
+				b.VolumeName,
+				b.Key,
+				strconv.FormatInt(b.Size, 10),
+				b.LastModified.Format(time.RFC3339),
+				b.Project,
+				strings.Join(b.Containers, ","),
+			}); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(tw, "VOLUME\tSIZE\tAGE\tCREATED\tKEY")
+		for _, b := range listings {
+			fmt.Fprintf(tw, "%s\t%s\t%s ago\t%s\t%s\n",
+				b.VolumeName,
+				units.BytesSize(float64(b.Size)),
+				units.HumanDuration(now.Sub(b.LastModified)),
+				b.LastModified.Local().Format("2006-01-02 15:04"),
+				b.Key,
+			)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("invalid output %q, expected %s, %s, %s or %s", format, outputJSON, outputYAML, outputCSV, outputTable)
+	}
+}
+
+// cmdListArchives outputs the archives in the source.
+func cmdListArchives(source backupSource, f listFilter, newestOnly bool, sortBy string, reverse bool, format string) error {
+	listings, err := listArchives(context.TODO(), source, f, newestOnly)
+	if err != nil {
+		return err
+	}
+	if err := sortListings(listings, sortBy, reverse); err != nil {
+		return err
+	}
+	if source.hostPath != "" && format == outputJSON {
+		bytes, err := json.Marshal(hostPathListings(listings))
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+	return writeListings(os.Stdout, listings, format, time.Now())
+}
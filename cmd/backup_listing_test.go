@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/util/archiveutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListArchives(t *testing.T) {
+	dir := t.TempDir()
+	data := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(data, "file"), bytes.Repeat([]byte("x"), 1000), 0o644))
+	day := time.Date(2022, 10, 15, 3, 0, 0, 0, time.UTC)
+	writeBackup := func(volumeName, project string, days int) {
+		mtime := day.AddDate(0, 0, days)
+		name := filepath.Join(dir, fmt.Sprintf("%s-%d-10-2022.tar.gz", volumeName, mtime.Day()))
+		manifestBytes, err := json.Marshal(manifest.Manifest{VolumeName: volumeName, Project: project, Containers: []string{project + "-" + volumeName}})
+		require.NoError(t, err)
+		f, err := os.Create(name)
+		require.NoError(t, err)
+		require.NoError(t, archiveutil.Create(data, f, manifestBytes))
+		require.NoError(t, f.Close())
+		require.NoError(t, os.Chtimes(name, mtime, mtime))
+	}
+	writeBackup("app_db", "app", 0)
+	writeBackup("app_db", "app", -1)
+	writeBackup("other_db", "other", -2)
+	source := backupSource{hostPath: dir}
+
+	volumeNames := func(listings []backupListing) []string {
+		var names []string
+		for _, b := range listings {
+			names = append(names, b.VolumeName)
+		}
+		return names
+	}
+
+	t.Run("everything newest first", func(t *testing.T) {
+		listings, err := listArchives(context.Background(), source, listFilter{}, false)
+		require.NoError(t, err)
+		require.Equal(t, []string{"app_db", "app_db", "other_db"}, volumeNames(listings))
+		require.Empty(t, listings[0].Project, "manifests are only read when filtering by them")
+		require.NotZero(t, listings[0].Size)
+	})
+
+	t.Run("glob and newest only", func(t *testing.T) {
+		listings, err := listArchives(context.Background(), source, listFilter{glob: "*_db"}, true)
+		require.NoError(t, err)
+		require.Equal(t, []string{"app_db", "other_db"}, volumeNames(listings))
+	})
+
+	t.Run("project and container", func(t *testing.T) {
+		listings, err := listArchives(context.Background(), source, listFilter{project: "other"}, false)
+		require.NoError(t, err)
+		require.Equal(t, []string{"other_db"}, volumeNames(listings))
+		require.Equal(t, "other", listings[0].Project)
+
+		listings, err = listArchives(context.Background(), source, listFilter{container: "app-app_db"}, false)
+		require.NoError(t, err)
+		require.Len(t, listings, 2)
+	})
+
+	t.Run("time range", func(t *testing.T) {
+		listings, err := listArchives(context.Background(), source, listFilter{since: day.AddDate(0, 0, -2), until: day.AddDate(0, 0, -1)}, false)
+		require.NoError(t, err)
+		require.Equal(t, []string{"app_db", "other_db"}, volumeNames(listings))
+		require.Equal(t, day.AddDate(0, 0, -1), listings[0].LastModified.UTC())
+	})
+
+	t.Run("minimum size", func(t *testing.T) {
+		listings, err := listArchives(context.Background(), source, listFilter{minSize: 1 << 30}, false)
+		require.NoError(t, err)
+		require.Empty(t, listings)
+	})
+}
+
+func TestSortListings(t *testing.T) {
+	day := time.Date(2022, 10, 15, 3, 0, 0, 0, time.UTC)
+	listings := func() []backupListing {
+		return []backupListing{
+			{VolumeName: "b", Size: 10, LastModified: day},
+			{VolumeName: "c", Size: 30, LastModified: day.AddDate(0, 0, -1)},
+			{VolumeName: "a", Size: 20, LastModified: day.AddDate(0, 0, -2)},
+		}
+	}
+	order := func(by string, reverse bool) string {
+		l := listings()
+		require.NoError(t, sortListings(l, by, reverse))
+		return l[0].VolumeName + l[1].VolumeName + l[2].VolumeName
+	}
+	require.Equal(t, "bca", order(sortTime, false))
+	require.Equal(t, "acb", order(sortTime, true))
+	require.Equal(t, "abc", order(sortVolume, false))
+	require.Equal(t, "cab", order(sortSize, false))
+	require.Error(t, sortListings(listings(), "name", false))
+}
+
+func TestWriteListings(t *testing.T) {
+	now := time.Date(2022, 10, 15, 3, 0, 0, 0, time.UTC)
+	listings := []backupListing{
+		{VolumeName: "data", Key: "data-13-10-2022.tar.gz", Size: 3 * 1024 * 1024, LastModified: now.AddDate(0, 0, -2), Project: "app", Containers: []string{"web", "worker"}},
+	}
+	write := func(format string) string {
+		var buf bytes.Buffer
+		require.NoError(t, writeListings(&buf, listings, format, now))
+		return buf.String()
+	}
+
+	require.Equal(t, `[{"volumeName":"data","key":"data-13-10-2022.tar.gz","size":3145728,"lastModified":"2022-10-13T03:00:00Z","project":"app","containers":["web","worker"]}]`+"\n", write(outputJSON))
+	require.Equal(t, "volumeName,key,size,lastModified,project,containers\ndata,data-13-10-2022.tar.gz,3145728,2022-10-13T03:00:00Z,app,\"web,worker\"\n", write(outputCSV))
+	require.Contains(t, write(outputYAML), "volumeName: data\n")
+	table := write(outputTable)
+	require.Contains(t, table, "VOLUME")
+	require.Contains(t, table, "3MiB")
+	require.Contains(t, table, "2 days ago")
+	require.Error(t, writeListings(&bytes.Buffer{}, listings, "xml", now))
+}
+
+func TestHostPathListings(t *testing.T) {
+	lastModified := time.Date(2022, 10, 13, 3, 0, 0, 0, time.UTC)
+	listings := []backupListing{
+		{VolumeName: "data", Key: "/backups/data-13-10-2022.tar.gz", Size: 1024, LastModified: lastModified},
+	}
+	bytes, err := json.Marshal(hostPathListings(listings))
+	require.NoError(t, err)
+	require.Equal(t, `[{"volumeName":"data","absoluteFilePath":"/backups/data-13-10-2022.tar.gz","fileName":"data-13-10-2022.tar.gz","lastModTime":"2022-10-13T03:00:00Z","size":1024}]`, string(bytes))
+}
@@ -8,15 +8,21 @@ import (
 	"time"
 
 	"docker-volume-backup/cmd/label"
+	"docker-volume-backup/cmd/manifest"
 	"docker-volume-backup/cmd/util/collectionutil"
+	"docker-volume-backup/cmd/util/dockerutil"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 )
 
-func PerformBackups(backupModes ...BackupMode) error {
-	ctx := context.TODO()
+// PerformBackups backs up the labeled containers and volumes. With stopContainers, the running
+// containers which mount a labeled volume that is not attached to a labeled container are stopped
+// while it is backed up.
+func PerformBackups(stopContainers bool, backupModes ...BackupMode) error {
+	// every backup of this run shares its id, so that the volumes of a project can be restored to the same run.
+	ctx := manifest.WithRunID(context.TODO(), manifest.NewRunID(time.Now()))
 
 	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
@@ -33,6 +39,14 @@ func PerformBackups(backupModes ...BackupMode) error {
 
 	log.Printf("found %d containers to backup", len(containers))
 
+	// list all volumes which have backups enabled directly on the volume itself.
+	volumes, err := cli.VolumeList(ctx, label.BackupEnabledFilters())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("found %d volumes with backups enabled", len(volumes.Volumes))
+
 	_, err = cli.ImagePull(ctx, "busybox:latest", types.ImagePullOptions{})
 	if err != nil {
 		return err
@@ -40,6 +54,7 @@ func PerformBackups(backupModes ...BackupMode) error {
 	log.Printf("successfully pulled busybox image\n")
 	time.Sleep(time.Second * 5) // TODO: remove this, wait until the image exists instead.
 
+	var backedUpVolumes []string
 	for _, c := range containers {
 		log.Printf("Stopping container: %s (%s)\n", c.Image, c.ID)
 		err := cli.ContainerStop(ctx, c.ID, nil)
@@ -47,9 +62,11 @@ func PerformBackups(backupModes ...BackupMode) error {
 			return fmt.Errorf("failed sto stop container: %s", err)
 		}
 
-		if err := backupContainerMount(ctx, cli, c, backupModes); err != nil {
+		backedUp, err := backupContainerMount(ctx, cli, c, backupModes)
+		if err != nil {
 			return fmt.Errorf("failed processing container: %s", err)
 		}
+		backedUpVolumes = append(backedUpVolumes, backedUp...)
 
 		log.Printf("Starting container: %s (%s)\n", c.Image, c.ID)
 		err = cli.ContainerStart(ctx, c.ID, types.ContainerStartOptions{})
@@ -57,28 +74,87 @@ func PerformBackups(backupModes ...BackupMode) error {
 			return fmt.Errorf("failed to start container: %s", err)
 		}
 	}
+
+	// labeled volumes which were not backed up as part of a labeled container are backed up
+	// without stopping any containers, unless stopContainers is set.
+	for _, m := range getDetachedVolumesToBackup(volumes.Volumes, backedUpVolumes) {
+		log.Printf("backing up volume: %s", m.Name)
+		if !stopContainers {
+			if err := backupMount(ctx, cli, m, backupModes); err != nil {
+				return fmt.Errorf("failed processing volume: %s", err)
+			}
+			continue
+		}
+		if err := backupVolumeStopped(ctx, cli, m, backupModes); err != nil {
+			return fmt.Errorf("failed processing volume: %s", err)
+		}
+	}
 	return nil
 }
 
-// backupContainerMount backs up the given mounts for the specified container.
-func backupContainerMount(ctx context.Context, cli *client.Client, c types.Container, backupModes []BackupMode) error {
+// backupVolumeStopped backs up a labeled volume, stopping the running containers which mount it
+// while it is backed up and starting them again afterwards, even if the backup fails.
+func backupVolumeStopped(ctx context.Context, cli *client.Client, m types.MountPoint, backupModes []BackupMode) error {
+	stopped, err := dockerutil.StopContainersUsingVolume(ctx, cli, m.Name)
+	defer func() {
+		if err := dockerutil.StartContainers(ctx, cli, stopped); err != nil {
+			log.Println(err)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	return backupMount(ctx, cli, m, backupModes)
+}
+
+// backupContainerMount backs up the given mounts for the specified container and
+// returns the names of the volumes which were backed up.
+func backupContainerMount(ctx context.Context, cli *client.Client, c types.Container, backupModes []BackupMode) ([]string, error) {
 	volumesToBackup := getVolumeNamesToBackup(c)
 
+	var backedUp []string
 	for _, m := range c.Mounts {
 		if !collectionutil.Contains(volumesToBackup, m.Name) {
 			continue
 		}
 
 		log.Printf("backing up volume: %s (%s)", m.Name, c.ID)
-		for _, bm := range backupModes {
-			if err := bm.CrateBackup(ctx, cli, m); err != nil {
-				return fmt.Errorf("failed creating backup: %s", err)
-			}
+		if err := backupMount(ctx, cli, m, backupModes); err != nil {
+			return nil, err
+		}
+		backedUp = append(backedUp, m.Name)
+	}
+	return backedUp, nil
+}
+
+// backupMount backs up a single mount with each of the given backup modes.
+func backupMount(ctx context.Context, cli *client.Client, m types.MountPoint, backupModes []BackupMode) error {
+	for _, bm := range backupModes {
+		if err := bm.CrateBackup(ctx, cli, m); err != nil {
+			return fmt.Errorf("failed creating backup: %s", err)
 		}
 	}
 	return nil
 }
 
+// getDetachedVolumesToBackup returns mount points for each of the labeled volumes
+// which have not already been backed up as part of a container.
+func getDetachedVolumesToBackup(volumes []*types.Volume, alreadyBackedUp []string) []types.MountPoint {
+	var mounts []types.MountPoint
+	for _, v := range volumes {
+		if collectionutil.Contains(alreadyBackedUp, v.Name) {
+			continue
+		}
+		mounts = append(mounts, types.MountPoint{
+			Type:   mount.TypeVolume,
+			Name:   v.Name,
+			Source: v.Mountpoint,
+			Driver: v.Driver,
+		})
+	}
+	return mounts
+}
+
 // getVolumeNamesToBackup extracts a list of volumes to be backed up from
 // the container labels.
 func getVolumeNamesToBackup(c types.Container) []string {
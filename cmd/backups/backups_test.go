@@ -0,0 +1,30 @@
+package backups
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDetachedVolumesToBackup(t *testing.T) {
+	volumes := []*types.Volume{
+		{Name: "volume-1", Driver: "local"},
+		{Name: "volume-2", Driver: "local"},
+	}
+
+	t.Run("no volumes backed up by containers", func(t *testing.T) {
+		mounts := getDetachedVolumesToBackup(volumes, nil)
+		require.Len(t, mounts, 2, "all labeled volumes should be backed up")
+		require.Equal(t, "volume-1", mounts[0].Name)
+		require.Equal(t, mount.TypeVolume, mounts[0].Type)
+		require.Equal(t, "local", mounts[0].Driver)
+	})
+
+	t.Run("volume already backed up by container", func(t *testing.T) {
+		mounts := getDetachedVolumesToBackup(volumes, []string{"volume-1"})
+		require.Len(t, mounts, 1, "volumes should not be backed up twice")
+		require.Equal(t, "volume-2", mounts[0].Name)
+	})
+}
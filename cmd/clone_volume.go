@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"docker-volume-backup/cmd/util/dockerutil"
+	"docker-volume-backup/cmd/util/randutil"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cloneVolumeCommand.Flags().String(fromFlag, "", "name of the volume to clone")
+	cloneVolumeCommand.Flags().String(toFlag, "", "name of the volume to copy into, it is created if it does not exist")
+	cloneVolumeCommand.Flags().Bool(stopContainersFlag, false, "stop the containers using the source volume during the copy and start them again afterwards")
+	cloneVolumeCommand.Flags().Bool(overwriteFlag, false, "replace the contents of the target volume if it is not empty")
+	if err := cloneVolumeCommand.MarkFlagRequired(fromFlag); err != nil {
+		panic(err)
+	}
+	if err := cloneVolumeCommand.MarkFlagRequired(toFlag); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(cloneVolumeCommand)
+}
+
+type cloneVolumeArgs struct {
+	from           string
+	to             string
+	stopContainers bool
+	overwrite      bool
+}
+
+type cloneOutput struct {
+	ClonedFrom string    `json:"clonedFrom"`
+	VolumeName string    `json:"volumeName"`
+	CloneTime  time.Time `json:"cloneTime"`
+}
+
+// cloneVolumeCommand copies a volume into another volume on the same host.
+var cloneVolumeCommand = &cobra.Command{
+	Use:   "clone-volume",
+	Short: "copy a volume into another volume.",
+	Long: `Copies the contents of a volume into another volume on the same host.
+
+The target volume is created if it does not exist. If it exists and is not empty, the
+command fails unless --overwrite is set, in which case its contents are replaced.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		from, err := cmd.Flags().GetString(fromFlag)
+		if err != nil {
+			panic(err)
+		}
+		to, err := cmd.Flags().GetString(toFlag)
+		if err != nil {
+			panic(err)
+		}
+		stopContainers, err := cmd.Flags().GetBool(stopContainersFlag)
+		if err != nil {
+			panic(err)
+		}
+		overwrite, err := cmd.Flags().GetBool(overwriteFlag)
+		if err != nil {
+			panic(err)
+		}
+		if err := cmdCloneVolume(cloneVolumeArgs{
+			from:           from,
+			to:             to,
+			stopContainers: stopContainers,
+			overwrite:      overwrite,
+		}); err != nil {
+			panic(err)
+		}
+	},
+}
+
+func cmdCloneVolume(args cloneVolumeArgs) error {
+	if args.from == args.to {
+		return fmt.Errorf("cannot clone volume %s into itself", args.from)
+	}
+
+	ctx := context.TODO()
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+	if _, err := cli.VolumeInspect(ctx, args.from); err != nil {
+		return err
+	}
+	if err := dockerutil.PullImage(ctx, cli, "busybox:latest"); err != nil {
+		return err
+	}
+	if _, err := cli.VolumeCreate(ctx, volume.VolumeCreateBody{Name: args.to}); err != nil {
+		return err
+	}
+
+	if !args.overwrite {
+		empty, err := dockerutil.VolumeIsEmpty(ctx, cli, args.to)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("volume %s is not empty, use --%s to replace its contents", args.to, overwriteFlag)
+		}
+	}
+
+	if args.stopContainers {
+		stopped, err := dockerutil.StopContainersUsingVolume(ctx, cli, args.from)
+		defer func() {
+			if err := dockerutil.StartContainers(ctx, cli, stopped); err != nil {
+				log.Println(err)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := copyVolumeContents(ctx, cli, args.from, args.to); err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(cloneOutput{
+		ClonedFrom: args.from,
+		VolumeName: args.to,
+		CloneTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+// copyVolumeContents replaces the contents of the volume to with the contents of the volume from,
+// preserving ownership, permissions and times. The busybox image must already exist.
+func copyVolumeContents(ctx context.Context, cli *client.Client, from, to string) error {
+	mounts := []mount.Mount{
+		{
+			Type:     mount.TypeVolume,
+			Source:   from,
+			Target:   "/from",
+			ReadOnly: true,
+		},
+		{
+			Type:   mount.TypeVolume,
+			Source: to,
+			Target: "/to",
+		},
+	}
+	// remove existing contents, including hidden files.
+	cmd := []string{"/bin/sh", "-c", "rm -rf /to/..?* /to/.[!.]* /to/* && cp -a /from/. /to/"}
+	containerName := fmt.Sprintf("backup-%s-%s", from, randutil.StringRunes(5))
+	return dockerutil.RunImageCommandWithMounts(ctx, "busybox:latest", containerName, cli, mounts, cmd)
+}
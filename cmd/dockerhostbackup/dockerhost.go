@@ -0,0 +1,58 @@
+package dockerhostbackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+type Config struct {
+	// Host is the standby docker daemon, e.g. tcp://standby:2376 or ssh://user@standby
+	Host string
+	// CertPath is the directory containing ca.pem, cert.pem and key.pem for tcp hosts using tls.
+	CertPath string
+}
+
+func FromEnv() Config {
+	host, _ := os.LookupEnv("REMOTE_DOCKER_HOST")
+	certPath, _ := os.LookupEnv("REMOTE_DOCKER_CERT_PATH")
+	return Config{
+		Host:     host,
+		CertPath: certPath,
+	}
+}
+
+// Mode copies each volume to a volume with the same name on another docker host, replacing its
+// contents, which gives a warm standby copy of the volume.
+type Mode struct {
+	config Config
+}
+
+func NewMode(cfg Config) *Mode {
+	return &Mode{
+		config: cfg,
+	}
+}
+
+func (m *Mode) CrateBackup(ctx context.Context, cli *client.Client, mountPoint types.MountPoint) error {
+	log.Printf("performing docker-host backup to %s", m.config.Host)
+	if m.config.Host == "" {
+		return fmt.Errorf("REMOTE_DOCKER_HOST is not set")
+	}
+	remote, err := dockerutil.NewRemoteClient(m.config.Host, m.config.CertPath)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	if err := dockerutil.CopyVolume(ctx, cli, mountPoint.Name, remote.Client, mountPoint.Name); err != nil {
+		return fmt.Errorf("failed copying volume %s to %s: %s", mountPoint.Name, m.config.Host, err)
+	}
+	return nil
+}
@@ -2,9 +2,11 @@ package filebackup
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 
+	"docker-volume-backup/cmd/manifest"
 	"docker-volume-backup/cmd/util/dateutil"
 	"docker-volume-backup/cmd/util/dockerutil"
 
@@ -26,6 +28,13 @@ func NewMode(hostPath string) *Mode {
 func (f *Mode) CrateBackup(ctx context.Context, cli *client.Client, mountPoint types.MountPoint) error {
 	log.Println("performing filesystem backup")
 	nameOfBackedupArchive := fmt.Sprintf("%s-%s.tar.gz", mountPoint.Name, dateutil.GetDayMonthYear())
-	cmd := []string{"tar", "-czvf", fmt.Sprintf("/backups/%s", nameOfBackedupArchive), "/data"}
-	return dockerutil.RunCommandInMountedContainer(ctx, f.hostPathForBackups, cli, mountPoint, cmd)
+	backupManifest, err := manifest.New(ctx, cli, mountPoint.Name)
+	if err != nil {
+		return err
+	}
+	manifestBytes, err := json.Marshal(backupManifest)
+	if err != nil {
+		return err
+	}
+	return dockerutil.ArchiveVolumeToHostPath(ctx, cli, mountPoint.Name, manifestBytes, f.hostPathForBackups, nameOfBackedupArchive)
 }
@@ -0,0 +1,252 @@
+package gcsbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/storage"
+)
+
+const (
+	defaultEndpoint    = "https://storage.googleapis.com"
+	defaultChunkSizeMB = 16
+
+	// uploadGranularity is the size which every chunk of a resumable upload, except
+	// for the last, must be a multiple of.
+	uploadGranularity = 256 * 1024
+)
+
+type Config struct {
+	Bucket string
+	// CredentialsFile is the path to a service account JSON key. If empty, credentials are
+	// fetched from the metadata server, which supports workload identity.
+	CredentialsFile string
+	// Endpoint is the storage API endpoint, e.g. http://localhost:4443 for fake-gcs-server.
+	// Requests to a custom endpoint are not authenticated unless CredentialsFile is set.
+	Endpoint string
+	// ChunkSize is the size of each chunk of a resumable upload in bytes.
+	ChunkSize int
+}
+
+func FromEnv() Config {
+	bucket, _ := os.LookupEnv("GCS_BUCKET")
+	credentialsFile, _ := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS")
+	endpoint, ok := os.LookupEnv("GCS_ENDPOINT")
+	if !ok {
+		endpoint = defaultEndpoint
+	}
+	chunkSizeMB := defaultChunkSizeMB
+	if v, ok := os.LookupEnv("GCS_CHUNK_SIZE_MB"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			chunkSizeMB = n
+		}
+	}
+	return Config{
+		Bucket:          bucket,
+		CredentialsFile: credentialsFile,
+		Endpoint:        endpoint,
+		ChunkSize:       chunkSizeMB * 1024 * 1024,
+	}
+}
+
+// Backend stores archives as objects in a Google Cloud Storage bucket, using the JSON API.
+type Backend struct {
+	config Config
+	client *http.Client
+	tokens tokenSource
+}
+
+func NewBackend(cfg Config) *Backend {
+	var tokens tokenSource
+	switch {
+	case cfg.CredentialsFile != "":
+		tokens = &serviceAccountTokenSource{credentialsFile: cfg.CredentialsFile}
+	case strings.TrimSuffix(cfg.Endpoint, "/") != defaultEndpoint:
+		tokens = noTokenSource{}
+	default:
+		tokens = &metadataTokenSource{}
+	}
+	// chunks must be a multiple of the upload granularity.
+	if cfg.ChunkSize < uploadGranularity {
+		cfg.ChunkSize = uploadGranularity
+	}
+	cfg.ChunkSize -= cfg.ChunkSize % uploadGranularity
+	return &Backend{
+		config: cfg,
+		client: http.DefaultClient,
+		tokens: tokens,
+	}
+}
+
+func (b *Backend) do(ctx context.Context, method, target string, body io.Reader, header http.Header, expected ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	token, err := b.tokens.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting access token: %s", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s returned %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (b *Backend) objectURL(key string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", strings.TrimSuffix(b.config.Endpoint, "/"), url.PathEscape(b.config.Bucket), url.PathEscape(key))
+}
+
+// Upload uploads the archive with a resumable upload, sending one chunk at a time so that
+// archives of any size can be streamed without knowing their size up front.
+func (b *Backend) Upload(ctx context.Context, key string, r io.Reader, m manifest.Manifest) error {
+	metadata, err := json.Marshal(map[string]interface{}{
+		"name":        key,
+		"contentType": "application/gzip",
+		"metadata":    m.Metadata(),
+	})
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"uploadType": {"resumable"}, "name": {key}}
+	initURL := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", strings.TrimSuffix(b.config.Endpoint, "/"), url.PathEscape(b.config.Bucket), query.Encode())
+	header := http.Header{"Content-Type": {"application/json; charset=UTF-8"}}
+	resp, err := b.do(ctx, http.MethodPost, initURL, bytes.NewReader(metadata), header, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return fmt.Errorf("failed starting resumable upload: %s", err)
+	}
+	_ = resp.Body.Close()
+	sessionURL := resp.Header.Get("Location")
+	if sessionURL == "" {
+		return fmt.Errorf("resumable upload response did not contain a session url")
+	}
+
+	buf := make([]byte, b.config.ChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+
+		// the total size is only known once the last chunk has been read.
+		contentRange := fmt.Sprintf("bytes %d-%d/*", offset, offset+int64(n)-1)
+		if last {
+			contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, offset+int64(n))
+			if n == 0 {
+				contentRange = fmt.Sprintf("bytes */%d", offset)
+			}
+		}
+
+		header := http.Header{"Content-Range": {contentRange}}
+		// 308 is returned for every chunk until the upload is complete.
+		resp, err := b.do(ctx, http.MethodPut, sessionURL, bytes.NewReader(buf[:n]), header, http.StatusOK, http.StatusCreated, http.StatusPermanentRedirect)
+		if err != nil {
+			return fmt.Errorf("failed uploading chunk at offset %d: %s", offset, err)
+		}
+		_ = resp.Body.Close()
+		offset += int64(n)
+
+		if last {
+			if resp.StatusCode == http.StatusPermanentRedirect {
+				return fmt.Errorf("upload was not completed after the last chunk")
+			}
+			return nil
+		}
+	}
+}
+
+type objectList struct {
+	Items []struct {
+		Name     string            `json:"name"`
+		Size     string            `json:"size"`
+		Updated  time.Time         `json:"updated"`
+		Metadata map[string]string `json:"metadata"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+func (b *Backend) List(ctx context.Context, prefix string) ([]storage.Object, error) {
+	var objects []storage.Object
+	pageToken := ""
+	for {
+		query := url.Values{}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		listURL := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", strings.TrimSuffix(b.config.Endpoint, "/"), url.PathEscape(b.config.Bucket), query.Encode())
+		resp, err := b.do(ctx, http.MethodGet, listURL, nil, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var list objectList
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing object list: %s", err)
+		}
+
+		for _, item := range list.Items {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			if obj, ok := storage.NewObject(item.Name, size, item.Updated); ok {
+				obj.Metadata = item.Metadata
+				if obj.Metadata == nil {
+					obj.Metadata = map[string]string{}
+				}
+				objects = append(objects, obj)
+			}
+		}
+		if list.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+func (b *Backend) Download(ctx context.Context, key string, w io.Writer) error {
+	resp, err := b.do(ctx, http.MethodGet, b.objectURL(key)+"?alt=media", nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.objectURL(key), nil, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,205 @@
+package gcsbackup
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/util/dateutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer returns an in memory storage service which supports the operations used by the backend.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	uploads := map[string][]byte{}
+	objects := map[string][]byte{}
+	metadatas := map[string]map[string]string{}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/backups/o":
+			require.Equal(t, "resumable", r.URL.Query().Get("uploadType"))
+			var metadata struct {
+				Name     string            `json:"name"`
+				Metadata map[string]string `json:"metadata"`
+			}
+			require.NoError(t, json.Unmarshal(body, &metadata))
+			require.Equal(t, "config", metadata.Metadata["volume-name"], "manifest should be stored as metadata")
+			uploads[metadata.Name] = nil
+			metadatas[metadata.Name] = metadata.Metadata
+			w.Header().Set("Location", server.URL+"/upload/session/"+metadata.Name)
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/upload/session/"):
+			name := strings.TrimPrefix(r.URL.Path, "/upload/session/")
+			// an empty final chunk only finalises the upload.
+			if strings.HasPrefix(r.Header.Get("Content-Range"), "bytes */") {
+				require.Equal(t, fmt.Sprintf("bytes */%d", len(uploads[name])), r.Header.Get("Content-Range"))
+				objects[name] = uploads[name]
+				delete(uploads, name)
+				return
+			}
+			var start, end int
+			var total string
+			_, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &total)
+			require.NoError(t, err)
+			require.Equal(t, len(uploads[name]), start, "chunks should be uploaded in order")
+			require.Equal(t, end-start+1, len(body))
+			uploads[name] = append(uploads[name], body...)
+			if total == "*" {
+				require.Zero(t, len(body)%uploadGranularity, "chunks should be a multiple of 256KiB")
+				w.WriteHeader(http.StatusPermanentRedirect)
+				return
+			}
+			objects[name] = uploads[name]
+			delete(uploads, name)
+		case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/backups/o":
+			var list objectList
+			for name, contents := range objects {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+					list.Items = append(list.Items, struct {
+						Name     string            `json:"name"`
+						Size     string            `json:"size"`
+						Updated  time.Time         `json:"updated"`
+						Metadata map[string]string `json:"metadata"`
+					}{name, fmt.Sprint(len(contents)), time.Now(), metadatas[name]})
+				}
+			}
+			require.NoError(t, json.NewEncoder(w).Encode(list))
+		case strings.HasPrefix(r.URL.Path, "/storage/v1/b/backups/o/"):
+			name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/backups/o/")
+			contents, ok := objects[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodDelete {
+				delete(objects, name)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			require.Equal(t, "media", r.URL.Query().Get("alt"))
+			_, _ = w.Write(contents)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBackend(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t)
+	b := NewBackend(Config{
+		Bucket:    "backups",
+		Endpoint:  server.URL,
+		ChunkSize: uploadGranularity,
+	})
+
+	key := "config-" + dateutil.GetDayMonthYear() + ".tar.gz"
+	contents := bytes.Repeat([]byte("a"), 2*uploadGranularity+10)
+	require.NoError(t, b.Upload(ctx, key, bytes.NewReader(contents), manifest.Manifest{VolumeName: "config"}))
+
+	t.Run("list", func(t *testing.T) {
+		objects, err := b.List(ctx, "config")
+		require.NoError(t, err)
+		require.Len(t, objects, 1)
+		require.Equal(t, key, objects[0].Key)
+		require.Equal(t, "config", objects[0].VolumeName)
+		require.Equal(t, int64(len(contents)), objects[0].Size)
+		require.Equal(t, "config", objects[0].Metadata["volume-name"])
+	})
+
+	t.Run("download", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, b.Download(ctx, key, &buf))
+		require.Equal(t, contents, buf.Bytes())
+	})
+
+	t.Run("upload multiple of chunk size", func(t *testing.T) {
+		other := "other-" + dateutil.GetDayMonthYear() + ".tar.gz"
+		contents := bytes.Repeat([]byte("b"), 2*uploadGranularity)
+		require.NoError(t, b.Upload(ctx, other, bytes.NewReader(contents), manifest.Manifest{VolumeName: "config"}))
+		var buf bytes.Buffer
+		require.NoError(t, b.Download(ctx, other, &buf))
+		require.Equal(t, contents, buf.Bytes())
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, b.Delete(ctx, key))
+		objects, err := b.List(ctx, "config")
+		require.NoError(t, err)
+		require.Empty(t, objects)
+	})
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		require.Len(t, parts, 3)
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(t, err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		require.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+
+		claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+		require.Contains(t, string(claims), `"iss":"backup@project.iam.gserviceaccount.com"`)
+
+		_, _ = w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	credentials, err := json.Marshal(serviceAccountKey{
+		Type:        "service_account",
+		ClientEmail: "backup@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    server.URL,
+	})
+	require.NoError(t, err)
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.json")
+	require.NoError(t, os.WriteFile(credentialsFile, credentials, 0600))
+
+	source := &serviceAccountTokenSource{credentialsFile: credentialsFile}
+	for i := 0; i < 2; i++ {
+		token, err := source.Token(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "token", token)
+	}
+	require.Equal(t, 1, requests, "token should be cached")
+}
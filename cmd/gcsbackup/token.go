@@ -0,0 +1,196 @@
+package gcsbackup
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scope            = "https://www.googleapis.com/auth/devstorage.read_write"
+	defaultTokenURI  = "https://oauth2.googleapis.com/token"
+	metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// tokens are refreshed this long before they expire.
+	expiryDelta = time.Minute
+)
+
+type tokenSource interface {
+	// Token returns an OAuth2 access token, or an empty string if requests are not authenticated.
+	Token(ctx context.Context) (string, error)
+}
+
+// noTokenSource is used for emulators such as fake-gcs-server, which do not require authentication.
+type noTokenSource struct{}
+
+func (noTokenSource) Token(context.Context) (string, error) {
+	return "", nil
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// cachedToken caches an access token until shortly before it expires.
+type cachedToken struct {
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (c *cachedToken) get(fetch func() (tokenResponse, error)) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Add(expiryDelta).Before(c.expiry) {
+		return c.token, nil
+	}
+	resp, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	if resp.AccessToken == "" {
+		return "", fmt.Errorf("token response did not contain an access token")
+	}
+	c.token = resp.AccessToken
+	c.expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// metadataTokenSource fetches tokens for the default service account from the metadata server,
+// which is available on GCE and GKE, including with workload identity.
+type metadataTokenSource struct {
+	cache cachedToken
+}
+
+func (s *metadataTokenSource) Token(ctx context.Context) (string, error) {
+	return s.cache.get(func() (tokenResponse, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataTokenURL, nil)
+		if err != nil {
+			return tokenResponse{}, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return doTokenRequest(req)
+	})
+}
+
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// serviceAccountTokenSource exchanges a JWT signed with a service account key for an access token.
+type serviceAccountTokenSource struct {
+	credentialsFile string
+	cache           cachedToken
+}
+
+func (s *serviceAccountTokenSource) Token(ctx context.Context) (string, error) {
+	return s.cache.get(func() (tokenResponse, error) {
+		b, err := os.ReadFile(s.credentialsFile)
+		if err != nil {
+			return tokenResponse{}, err
+		}
+		var key serviceAccountKey
+		if err := json.Unmarshal(b, &key); err != nil {
+			return tokenResponse{}, fmt.Errorf("failed parsing credentials file: %s", err)
+		}
+		if key.Type != "service_account" {
+			return tokenResponse{}, fmt.Errorf("unsupported credentials type %q", key.Type)
+		}
+		if key.TokenURI == "" {
+			key.TokenURI = defaultTokenURI
+		}
+
+		assertion, err := signJWT(key, time.Now())
+		if err != nil {
+			return tokenResponse{}, err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return tokenResponse{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return doTokenRequest(req)
+	})
+}
+
+// signJWT returns a JWT assertion for the service account, signed with RS256.
+func signJWT(key serviceAccountKey, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("failed decoding private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("failed parsing private key: %s", err)
+		}
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("private key is not an RSA key")
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": key.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": scope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func doTokenRequest(req *http.Request) (tokenResponse, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return tokenResponse{}, fmt.Errorf("token request returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return tokenResponse{}, fmt.Errorf("failed parsing token response: %s", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,253 @@
+package incrementalbackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// DirName is the directory within the backup host path where incremental
+	// archives are stored, with one sub directory per volume.
+	DirName = "incremental"
+
+	fullSuffix        = "full"
+	incrementalSuffix = "incr"
+)
+
+var archiveRxp = regexp.MustCompile(`^(.*)-(\d+)-(full|incr)\.tar\.gz$`)
+
+// Mode creates a chain of archives for each volume. The first archive in a chain
+// contains the full contents of the volume and each following archive contains only
+// the changes since the previous one.
+type Mode struct {
+	// hostPathForBackups is the path on the host where backups should be stored.
+	hostPathForBackups string
+
+	// fullEveryDays is the number of days after which a new chain is started.
+	fullEveryDays int
+
+	// retainForDays is the number of days that chains should be stored for.
+	retainForDays int
+}
+
+func NewMode(hostPath string, fullEveryDays, retainForDays int) *Mode {
+	return &Mode{
+		hostPathForBackups: hostPath,
+		fullEveryDays:      fullEveryDays,
+		retainForDays:      retainForDays,
+	}
+}
+
+func (m *Mode) CrateBackup(ctx context.Context, cli *client.Client, mountPoint types.MountPoint) error {
+	log.Println("performing incremental backup")
+	if err := dockerutil.PullImage(ctx, cli, "busybox:latest"); err != nil {
+		return err
+	}
+
+	// the archives are read from the mounted backups directory, the same way as the s3 mode.
+	localDir := filepath.Join("/backups", DirName, mountPoint.Name)
+	archives, err := ListArchives(localDir, mountPoint.Name)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	full := needsFullBackup(archives, now, m.fullEveryDays)
+	if _, err := os.Stat(filepath.Join(localDir, snapshotName(mountPoint.Name))); os.IsNotExist(err) {
+		// without the snapshot file there is nothing to compare against.
+		full = true
+	}
+	suffix := incrementalSuffix
+	if full {
+		suffix = fullSuffix
+	}
+
+	backupManifest, err := manifest.New(ctx, cli, mountPoint.Name)
+	if err != nil {
+		return err
+	}
+	manifestBytes, err := json.Marshal(backupManifest)
+	if err != nil {
+		return err
+	}
+	volumeDir := path.Join(DirName, mountPoint.Name)
+	archiveName := path.Join(volumeDir, fmt.Sprintf("%s-%d-%s.tar.gz", mountPoint.Name, now.Unix(), suffix))
+	if err := dockerutil.ArchiveVolumeIncremental(ctx, cli, mountPoint.Name, manifestBytes, m.hostPathForBackups, archiveName, path.Join(volumeDir, snapshotName(mountPoint.Name)), full); err != nil {
+		return fmt.Errorf("failed creating %s archive: %s", suffix, err)
+	}
+
+	archives, err = ListArchives(localDir, mountPoint.Name)
+	if err != nil {
+		return err
+	}
+	for _, a := range ExpiredArchives(archives, now, m.retainForDays) {
+		log.Printf("removing expired archive: %s", a.Path)
+		if err := os.Remove(a.Path); err != nil {
+			return fmt.Errorf("failed removing expired archive: %s", err)
+		}
+	}
+	return nil
+}
+
+// snapshotName is the name of the file which records the state of the files in the newest archive
+// of the volume, so that the next archive only contains the changes.
+func snapshotName(volumeName string) string {
+	return volumeName + ".snapshot.json"
+}
+
+// Archive is a single archive which is part of a chain.
+type Archive struct {
+	// Path is the absolute path to the archive.
+	Path string
+	// VolumeName is the name of the volume the archive was created from.
+	VolumeName string
+	// Time is the time the archive was created.
+	Time time.Time
+	// Full is true if the archive contains the full volume contents and starts a new chain.
+	Full bool
+}
+
+// ListArchives returns all archives of the given volume in dir, oldest first.
+// A missing directory is treated as having no archives.
+func ListArchives(dir, volumeName string) ([]Archive, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var archives []Archive
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		a, ok := parseArchiveName(e.Name())
+		if !ok || a.VolumeName != volumeName {
+			continue
+		}
+		a.Path = filepath.Join(dir, e.Name())
+		archives = append(archives, a)
+	}
+
+	sort.SliceStable(archives, func(i, j int) bool {
+		return archives[i].Time.Before(archives[j].Time)
+	})
+	return archives, nil
+}
+
+func parseArchiveName(fileName string) (Archive, bool) {
+	match := archiveRxp.FindStringSubmatch(fileName)
+	if match == nil {
+		return Archive{}, false
+	}
+	seconds, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return Archive{}, false
+	}
+	return Archive{
+		VolumeName: match[1],
+		Time:       time.Unix(seconds, 0),
+		Full:       match[3] == fullSuffix,
+	}, true
+}
+
+// Chains splits archives, sorted oldest first, into chains which each start with a full archive.
+// Incremental archives without a preceding full archive cannot be restored and are left out.
+func Chains(archives []Archive) [][]Archive {
+	var chains [][]Archive
+	for _, a := range archives {
+		if a.Full {
+			chains = append(chains, []Archive{a})
+			continue
+		}
+		if len(chains) == 0 {
+			continue
+		}
+		chains[len(chains)-1] = append(chains[len(chains)-1], a)
+	}
+	return chains
+}
+
+// ChainUntil returns the archives which must be extracted, in order, to restore the volume to
+// the newest state which is not after the given time.
+func ChainUntil(archives []Archive, until time.Time) ([]Archive, error) {
+	var result []Archive
+	for _, chain := range Chains(archives) {
+		if chain[0].Time.After(until) {
+			break
+		}
+		result = nil
+		for _, a := range chain {
+			if a.Time.After(until) {
+				break
+			}
+			result = append(result, a)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no full backup found before %s", until.Format(time.RFC3339))
+	}
+	return result, nil
+}
+
+// ExpiredArchives returns the archives which can be deleted. A chain is only deleted once every
+// archive in it is older than retainForDays, and the newest chain is never deleted since
+// following incremental archives depend on it.
+func ExpiredArchives(archives []Archive, now time.Time, retainForDays int) []Archive {
+	if retainForDays <= 0 {
+		return nil
+	}
+	cutoff := now.AddDate(0, 0, -retainForDays)
+
+	var expired []Archive
+	// incremental archives without a full archive before them can never be restored.
+	for _, a := range archives {
+		if a.Full {
+			break
+		}
+		if a.Time.Before(cutoff) {
+			expired = append(expired, a)
+		}
+	}
+
+	chains := Chains(archives)
+	for i, chain := range chains {
+		if i == len(chains)-1 {
+			break
+		}
+		if chain[len(chain)-1].Time.Before(cutoff) {
+			expired = append(expired, chain...)
+		}
+	}
+	return expired
+}
+
+// needsFullBackup returns true if a new chain should be started.
+func needsFullBackup(archives []Archive, now time.Time, fullEveryDays int) bool {
+	chains := Chains(archives)
+	if len(chains) == 0 {
+		return true
+	}
+	if fullEveryDays <= 0 {
+		return false
+	}
+	latestFull := chains[len(chains)-1][0]
+	return !latestFull.Time.After(now.AddDate(0, 0, -fullEveryDays))
+}
@@ -0,0 +1,126 @@
+package incrementalbackup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testVolumeName = "test-volume"
+
+var baseTime = time.Date(2022, 10, 1, 3, 0, 0, 0, time.UTC)
+
+func day(n int) time.Time {
+	return baseTime.AddDate(0, 0, n)
+}
+
+func newArchive(t time.Time, full bool) Archive {
+	return Archive{VolumeName: testVolumeName, Time: t, Full: full}
+}
+
+// twoChains returns two chains, the first of full + 2 incrementals and the second of full + 1 incremental.
+func twoChains() []Archive {
+	return []Archive{
+		newArchive(day(0), true),
+		newArchive(day(1), false),
+		newArchive(day(2), false),
+		newArchive(day(7), true),
+		newArchive(day(8), false),
+	}
+}
+
+func TestListArchives(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		fmt.Sprintf("%s-%d-incr.tar.gz", testVolumeName, day(1).Unix()),
+		fmt.Sprintf("%s-%d-full.tar.gz", testVolumeName, day(0).Unix()),
+		fmt.Sprintf("other-volume-%d-full.tar.gz", day(0).Unix()),
+		fmt.Sprintf("%s.snapshot.json", testVolumeName),
+		fmt.Sprintf("%s-18-7-2022.tar.gz", testVolumeName),
+	} {
+		_, err := os.Create(filepath.Join(dir, name))
+		require.NoError(t, err)
+	}
+
+	archives, err := ListArchives(dir, testVolumeName)
+	require.NoError(t, err)
+	require.Len(t, archives, 2, "only archives of the volume should be returned")
+	require.True(t, archives[0].Full, "oldest archive should be first")
+	require.Equal(t, day(0).Unix(), archives[0].Time.Unix())
+	require.False(t, archives[1].Full)
+
+	t.Run("missing directory", func(t *testing.T) {
+		archives, err := ListArchives(filepath.Join(dir, "missing"), testVolumeName)
+		require.NoError(t, err)
+		require.Empty(t, archives)
+	})
+}
+
+func TestChains(t *testing.T) {
+	archives := append([]Archive{newArchive(day(-1), false)}, twoChains()...)
+	chains := Chains(archives)
+	require.Len(t, chains, 2)
+	require.Len(t, chains[0], 3)
+	require.Len(t, chains[1], 2)
+	require.True(t, chains[0][0].Full, "chains should start with a full archive")
+}
+
+func TestChainUntil(t *testing.T) {
+	archives := twoChains()
+
+	t.Run("in the middle of a chain", func(t *testing.T) {
+		chain, err := ChainUntil(archives, day(1).Add(time.Hour))
+		require.NoError(t, err)
+		require.Len(t, chain, 2)
+		require.Equal(t, day(0), chain[0].Time)
+		require.Equal(t, day(1), chain[1].Time)
+	})
+
+	t.Run("latest", func(t *testing.T) {
+		chain, err := ChainUntil(archives, day(30))
+		require.NoError(t, err)
+		require.Len(t, chain, 2)
+		require.Equal(t, day(7), chain[0].Time, "only the newest chain should be used")
+	})
+
+	t.Run("before first full backup", func(t *testing.T) {
+		_, err := ChainUntil(archives, day(-1))
+		require.Error(t, err)
+	})
+}
+
+func TestExpiredArchives(t *testing.T) {
+	archives := twoChains()
+
+	t.Run("no retention", func(t *testing.T) {
+		require.Empty(t, ExpiredArchives(archives, day(100), 0))
+	})
+
+	t.Run("chain partially within retention", func(t *testing.T) {
+		require.Empty(t, ExpiredArchives(archives, day(3), 2), "the whole chain should be kept")
+	})
+
+	t.Run("old chain expired", func(t *testing.T) {
+		expired := ExpiredArchives(archives, day(10), 5)
+		require.Len(t, expired, 3)
+		for _, a := range expired {
+			require.True(t, a.Time.Before(day(7)))
+		}
+	})
+
+	t.Run("newest chain is never expired", func(t *testing.T) {
+		require.Len(t, ExpiredArchives(archives, day(100), 1), 3)
+	})
+}
+
+func TestNeedsFullBackup(t *testing.T) {
+	archives := twoChains()
+	require.True(t, needsFullBackup(nil, day(0), 7), "first backup must be full")
+	require.False(t, needsFullBackup(archives, day(9), 7))
+	require.True(t, needsFullBackup(archives, day(14), 7))
+	require.False(t, needsFullBackup(archives, day(100), 0), "a new chain is never started when disabled")
+}
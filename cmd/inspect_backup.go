@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/util/archiveutil"
+
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+const (
+	treeFlag = "tree"
+	grepFlag = "grep"
+)
+
+func init() {
+	inspectBackupCommand.Flags().Bool(s3Mode, false, "the backup is the key of an archive in s3")
+	inspectBackupCommand.Flags().String(fromFlag, "", "storage backend the backup is the key of an archive in, e.g. sftp")
+	inspectBackupCommand.Flags().Bool(treeFlag, false, "print the files as a tree")
+	inspectBackupCommand.Flags().String(grepFlag, "", "only list files whose path matches this regular expression")
+	inspectBackupCommand.Flags().String(outputFlag, outputJSON, "output format: json or table, ignored with --tree")
+	inspectBackupCommand.MarkFlagsMutuallyExclusive(s3Mode, fromFlag)
+	rootCmd.AddCommand(inspectBackupCommand)
+}
+
+// inspectBackupCommand prints the manifest and the files of a backup.
+var inspectBackupCommand = &cobra.Command{
+	Use:   "inspect-backup <archive|key>",
+	Short: "print the manifest and the files of a backup",
+	Long: `Print the manifest and the files of a backup, without restoring it.
+
+The archive is read as a stream and nothing is extracted, archives on the host and in
+s3 can be inspected without docker. The backup is an archive on the host, or the key of
+an archive in s3 with --s3 or in a storage backend with --from.
+
+Every file is listed with its path in the volume, size, mode and modification time,
+--grep only lists the files whose path matches a regular expression, and --tree prints
+the files as a tree.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		useS3, err := cmd.Flags().GetBool(s3Mode)
+		if err != nil {
+			panic(err)
+		}
+		from, err := cmd.Flags().GetString(fromFlag)
+		if err != nil {
+			panic(err)
+		}
+		source := backupSource{s3: useS3, from: from}
+		if source == (backupSource{}) {
+			source.archive = args[0]
+		}
+		tree, err := cmd.Flags().GetBool(treeFlag)
+		if err != nil {
+			panic(err)
+		}
+		grep, err := cmd.Flags().GetString(grepFlag)
+		if err != nil {
+			panic(err)
+		}
+		var grepRxp *regexp.Regexp
+		if grep != "" {
+			if grepRxp, err = regexp.Compile(grep); err != nil {
+				panic(fmt.Errorf("invalid --%s: %s", grepFlag, err))
+			}
+		}
+		output, err := cmd.Flags().GetString(outputFlag)
+		if err != nil {
+			panic(err)
+		}
+		if output != outputJSON && output != outputTable {
+			panic(fmt.Errorf("invalid output %q, expected %s or %s", output, outputJSON, outputTable))
+		}
+
+		inspected, err := inspectBackup(context.TODO(), source, args[0], grepRxp)
+		if err != nil {
+			panic(err)
+		}
+		switch {
+		case tree:
+			err = writeInspectTree(os.Stdout, inspected)
+		case output == outputTable:
+			err = writeInspectTable(os.Stdout, inspected)
+		default:
+			err = writeInspectJSON(os.Stdout, inspected)
+		}
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+// inspectEntry is a file in a backup.
+type inspectEntry struct {
+	// Path is relative to the root of the volume.
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	ModTime  time.Time `json:"modTime"`
+	Linkname string    `json:"linkname,omitempty"`
+
+	isDir bool
+}
+
+type inspectOutput struct {
+	Backup string `json:"backup"`
+	// Manifest is nil for archives without one, e.g. created by tar.
+	Manifest *manifest.Manifest `json:"manifest"`
+	Entries  []inspectEntry     `json:"entries"`
+}
+
+// inspectBackup reads the manifest and the files of the backup at the path or key, only listing the
+// files whose path matches grep if it is not nil.
+func inspectBackup(ctx context.Context, source backupSource, pathOrKey string, grep *regexp.Regexp) (inspectOutput, error) {
+	r, err := source.open(ctx, pathOrKey)
+	if err != nil {
+		return inspectOutput{}, err
+	}
+	defer r.Close()
+
+	result := inspectOutput{Backup: pathOrKey, Entries: []inspectEntry{}}
+	manifestBytes, err := archiveutil.Walk(r, func(rel string, hdr *tar.Header) error {
+		// the root of the volume is not a file of it.
+		if rel == "" || (grep != nil && !grep.MatchString(rel)) {
+			return nil
+		}
+		info := hdr.FileInfo()
+		result.Entries = append(result.Entries, inspectEntry{
+			Path:     rel,
+			Size:     hdr.Size,
+			Mode:     info.Mode().String(),
+			ModTime:  hdr.ModTime,
+			Linkname: hdr.Linkname,
+			isDir:    info.IsDir(),
+		})
+		return nil
+	})
+	if err != nil {
+		return inspectOutput{}, fmt.Errorf("failed reading %s: %s", pathOrKey, err)
+	}
+	if manifestBytes != nil {
+		var m manifest.Manifest
+		if err := json.Unmarshal(manifestBytes, &m); err != nil {
+			return inspectOutput{}, fmt.Errorf("failed parsing manifest of %s: %s", pathOrKey, err)
+		}
+		result.Manifest = &m
+	}
+	return result, nil
+}
+
+func writeInspectJSON(w io.Writer, inspected inspectOutput) error {
+	bytes, err := json.Marshal(inspected)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(bytes))
+	return err
+}
+
+// writeManifestSummary writes the manifest as a single line, for the text outputs.
+func writeManifestSummary(w io.Writer, m *manifest.Manifest) error {
+	if m == nil {
+		_, err := fmt.Fprintln(w, "manifest: none")
+		return err
+	}
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "manifest: %s\n", bytes)
+	return err
+}
+
+func writeInspectTable(w io.Writer, inspected inspectOutput) error {
+	if err := writeManifestSummary(w, inspected.Manifest); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "MODE\tSIZE\tMODIFIED\tPATH")
+	for _, e := range inspected.Entries {
+		name := e.Path
+		if e.Linkname != "" {
+			name += " -> " + e.Linkname
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Mode, units.BytesSize(float64(e.Size)), e.ModTime.Local().Format("2006-01-02 15:04"), name)
+	}
+	return tw.Flush()
+}
+
+// treeNode is a file in the tree printed by writeInspectTree.
+type treeNode struct {
+	entry    *inspectEntry
+	children map[string]*treeNode
+}
+
+// writeInspectTree writes the files as a tree. The directories of listed files are always shown,
+// so that files matched by --grep are shown where they are.
+func writeInspectTree(w io.Writer, inspected inspectOutput) error {
+	if err := writeManifestSummary(w, inspected.Manifest); err != nil {
+		return err
+	}
+	root := &treeNode{children: map[string]*treeNode{}}
+	for i := range inspected.Entries {
+		node := root
+		for _, name := range strings.Split(inspected.Entries[i].Path, "/") {
+			child, ok := node.children[name]
+			if !ok {
+				child = &treeNode{children: map[string]*treeNode{}}
+				node.children[name] = child
+			}
+			node = child
+		}
+		node.entry = &inspected.Entries[i]
+	}
+	if _, err := fmt.Fprintln(w, "."); err != nil {
+		return err
+	}
+	return writeTreeChildren(w, root, "")
+}
+
+func writeTreeChildren(w io.Writer, node *treeNode, indent string) error {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		child := node.children[name]
+		branch, childIndent := "├── ", indent+"│   "
+		if i == len(names)-1 {
+			branch, childIndent = "└── ", indent+"    "
+		}
+		if _, err := fmt.Fprintf(w, "%s%s%s\n", indent, branch, treeLabel(name, child)); err != nil {
+			return err
+		}
+		if err := writeTreeChildren(w, child, childIndent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeLabel describes a file in the tree, directories which are only shown as parents of listed
+// files have no entry.
+func treeLabel(name string, node *treeNode) string {
+	switch {
+	case node.entry == nil || node.entry.isDir:
+		return name + "/"
+	case node.entry.Linkname != "":
+		return name + " -> " + node.entry.Linkname
+	default:
+		return fmt.Sprintf("%s (%s)", name, units.BytesSize(float64(node.entry.Size)))
+	}
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"docker-volume-backup/cmd/util/archiveutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectBackup(t *testing.T) {
+	data := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(data, "config", "old"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(data, "config", "app.yml"), []byte("port: 80"), 0o640))
+	require.NoError(t, os.WriteFile(filepath.Join(data, "config", "old", "app.yml"), []byte("port: 8080"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(data, "db.sqlite"), []byte("db"), 0o644))
+	require.NoError(t, os.Symlink("config/app.yml", filepath.Join(data, "current")))
+
+	archive := filepath.Join(t.TempDir(), "data-15-10-2022.tar.gz")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	require.NoError(t, archiveutil.Create(data, f, []byte(`{"volumeName":"data","createdAt":"2022-10-15T03:00:00Z","project":"app"}`)))
+	require.NoError(t, f.Close())
+	source := backupSource{archive: archive}
+
+	t.Run("every file", func(t *testing.T) {
+		inspected, err := inspectBackup(context.Background(), source, archive, nil)
+		require.NoError(t, err)
+		require.NotNil(t, inspected.Manifest)
+		require.Equal(t, "app", inspected.Manifest.Project)
+		var paths []string
+		for _, e := range inspected.Entries {
+			paths = append(paths, e.Path)
+		}
+		require.ElementsMatch(t, []string{"config", "config/app.yml", "config/old", "config/old/app.yml", "current", "db.sqlite"}, paths)
+		for _, e := range inspected.Entries {
+			if e.Path == "config/app.yml" {
+				require.Equal(t, int64(8), e.Size)
+				require.Equal(t, "-rw-r-----", e.Mode)
+			}
+		}
+	})
+
+	t.Run("grep and tree", func(t *testing.T) {
+		inspected, err := inspectBackup(context.Background(), source, archive, regexp.MustCompile(`app\.yml$`))
+		require.NoError(t, err)
+		require.Len(t, inspected.Entries, 2)
+
+		var buf bytes.Buffer
+		require.NoError(t, writeInspectTree(&buf, inspected))
+		require.Equal(t, `manifest: {"volumeName":"data","createdAt":"2022-10-15T03:00:00Z","project":"app"}
+.
+└── config/
+    ├── app.yml (8B)
+    └── old/
+        └── app.yml (10B)
+`, buf.String())
+	})
+
+	t.Run("corrupt archive", func(t *testing.T) {
+		corrupt := filepath.Join(t.TempDir(), "corrupt.tar.gz")
+		require.NoError(t, os.WriteFile(corrupt, []byte("not an archive"), 0o644))
+		_, err := inspectBackup(context.Background(), backupSource{archive: corrupt}, corrupt, nil)
+		require.Error(t, err)
+	})
+}
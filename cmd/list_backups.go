@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -11,6 +12,11 @@ import (
 	"strings"
 	"time"
 
+	"docker-volume-backup/cmd/incrementalbackup"
+	"docker-volume-backup/cmd/resticbackup"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
 )
 
@@ -21,23 +27,61 @@ func init() {
 	listBackupsCommand.Flags().String("host-path", "", "backup host path")
 	listBackupsCommand.Flags().String("volume-name-filter", "", "string volume name must contain")
 	listBackupsCommand.Flags().Bool("newest-only", false, "return only 1 backup per volume")
-	if err := listBackupsCommand.MarkFlagRequired("host-path"); err != nil {
-		panic(err)
-	}
+	listBackupsCommand.Flags().Bool(resticMode, false, "list snapshots in the restic repository")
+	listBackupsCommand.Flags().String(fromFlag, "", "storage backend to list backups from, e.g. sftp")
+	listBackupsCommand.Flags().Bool(s3Mode, false, "list backups in s3")
+	listBackupsCommand.Flags().String(volumeGlobFlag, "", "glob volume names must match, e.g. app_*")
+	listBackupsCommand.Flags().String(containerFlag, "", "only list backups of volumes mounted by this container")
+	listBackupsCommand.Flags().String(projectFlag, "", "only list backups of volumes of this compose project")
+	listBackupsCommand.Flags().String(sinceFlag, "", "only list backups from this time on, e.g. 2022-10-15T03:00Z")
+	listBackupsCommand.Flags().String(untilFlag, "", "only list backups up to this time, e.g. 2022-10-15T03:00Z")
+	listBackupsCommand.Flags().String(minSizeFlag, "", "only list backups of at least this size, e.g. 100MB")
+	listBackupsCommand.Flags().String(sortFlag, sortTime, "sort backups by time (newest first), volume or size (largest first)")
+	listBackupsCommand.Flags().Bool(reverseFlag, false, "reverse the order of the backups")
+	listBackupsCommand.Flags().String(outputFlag, outputJSON, "output format: json, yaml, csv or table")
+	listBackupsCommand.MarkFlagsMutuallyExclusive("host-path", s3Mode, fromFlag)
+	listBackupsCommand.MarkFlagsMutuallyExclusive(resticMode, s3Mode, fromFlag)
 	rootCmd.AddCommand(listBackupsCommand)
 }
 
+const (
+	volumeGlobFlag = "volume-glob"
+	containerFlag  = "container"
+	sinceFlag      = "since"
+	minSizeFlag    = "min-size"
+	sortFlag       = "sort"
+	reverseFlag    = "reverse"
+)
+
+// archiveListFlags only apply to archives, not to restic snapshots.
+var archiveListFlags = []string{volumeGlobFlag, containerFlag, projectFlag, sinceFlag, untilFlag, minSizeFlag, sortFlag, reverseFlag, outputFlag}
+
 // restoreOrCreateVolume creates a docker volume and pre-populates it with
 // data from a specified archive.
 var listBackupsCommand = &cobra.Command{
 	Use:   "list-backups",
 	Short: "list existing backups",
-	Long:  "List backups that exist in the specified host directory",
+	Long: `List backups that exist in the specified host directory.
+
+With --s3 or --from, the backups in s3 or a storage backend (e.g. sftp) are listed instead.
+
+Backups can be filtered by volume name, the container or compose project of the volume,
+time and size, sorted, and printed as json, yaml, csv or a table. Filtering by container
+or project reads the manifest at the start of each archive. The json output of --host-path
+keeps the volumeName, absoluteFilePath, fileName and lastModTime fields of earlier versions.
+
+With --restic, the snapshots in the restic repository configured with the RESTIC_*
+environment variables are listed as json instead. host-path is only required for local
+repositories.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		hostDir, err := cmd.Flags().GetString("host-path")
 		if err != nil {
 			panic(err)
 		}
+		useRestic, err := cmd.Flags().GetBool(resticMode)
+		if err != nil {
+			panic(err)
+		}
 		volumeNameFilter, err := cmd.Flags().GetString("volume-name-filter")
 		if err != nil {
 			panic(err)
@@ -47,12 +91,98 @@ var listBackupsCommand = &cobra.Command{
 			panic(err)
 		}
 
-		if err := cmdListBackups(hostDir, volumeNameFilter, newestOnly); err != nil {
+		if useRestic {
+			for _, name := range archiveListFlags {
+				if cmd.Flags().Changed(name) {
+					panic(fmt.Errorf("--%s only applies to archives, not to --%s", name, resticMode))
+				}
+			}
+			if err := cmdListResticBackups(hostDir, volumeNameFilter, newestOnly); err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		from, err := cmd.Flags().GetString(fromFlag)
+		if err != nil {
+			panic(err)
+		}
+		useS3, err := cmd.Flags().GetBool(s3Mode)
+		if err != nil {
+			panic(err)
+		}
+		source := backupSource{hostPath: hostDir, s3: useS3, from: from}
+		if source == (backupSource{}) {
+			panic("required flag \"host-path\" not set")
+		}
+		f, err := getListFilter(cmd)
+		if err != nil {
+			panic(err)
+		}
+		f.contains = volumeNameFilter
+		sortBy, err := cmd.Flags().GetString(sortFlag)
+		if err != nil {
+			panic(err)
+		}
+		reverse, err := cmd.Flags().GetBool(reverseFlag)
+		if err != nil {
+			panic(err)
+		}
+		output, err := cmd.Flags().GetString(outputFlag)
+		if err != nil {
+			panic(err)
+		}
+		if err := cmdListArchives(source, f, newestOnly, sortBy, reverse, output); err != nil {
 			panic(err)
 		}
 	},
 }
 
+func getListFilter(cmd *cobra.Command) (listFilter, error) {
+	var f listFilter
+	var err error
+	if f.glob, err = cmd.Flags().GetString(volumeGlobFlag); err != nil {
+		return f, err
+	}
+	if _, err := path.Match(f.glob, ""); err != nil {
+		return f, fmt.Errorf("invalid --%s %q: %s", volumeGlobFlag, f.glob, err)
+	}
+	if f.container, err = cmd.Flags().GetString(containerFlag); err != nil {
+		return f, err
+	}
+	if f.project, err = cmd.Flags().GetString(projectFlag); err != nil {
+		return f, err
+	}
+	since, err := cmd.Flags().GetString(sinceFlag)
+	if err != nil {
+		return f, err
+	}
+	if since != "" {
+		if f.since, err = parseTime(since); err != nil {
+			return f, err
+		}
+	}
+	until, err := cmd.Flags().GetString(untilFlag)
+	if err != nil {
+		return f, err
+	}
+	if until != "" {
+		if f.until, err = parseTime(until); err != nil {
+			return f, err
+		}
+	}
+	minSize, err := cmd.Flags().GetString(minSizeFlag)
+	if err != nil {
+		return f, err
+	}
+	if minSize != "" {
+		if f.minSize, err = units.RAMInBytes(minSize); err != nil {
+			return f, fmt.Errorf("invalid --%s %q: %s", minSizeFlag, minSize, err)
+		}
+	}
+	return f, nil
+}
+
 // backedUpVolume holds information about a volume backup.
 type backedUpVolume struct {
 	VolumeName       string    `json:"volumeName"`
@@ -65,6 +195,10 @@ func getAllVolumeBackups(hostDir string, volumeNameFilter string, newestOnly boo
 	var result []backedUpVolume
 	err := filepath.Walk(hostDir, func(filePath string, info os.FileInfo, err error) error {
 		if info.IsDir() {
+			// incremental archives can only be restored as part of their chain.
+			if filePath != hostDir && info.Name() == incrementalbackup.DirName {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		fileName := path.Base(filePath)
@@ -115,29 +249,30 @@ func getAllVolumeBackups(hostDir string, volumeNameFilter string, newestOnly boo
 	return result, nil
 }
 
-// cmdListBackups outputs a list of backups in the given directory.
-// e.g.
-/*
-[
-  {
-    "volumeName": "docker-volume-backup_config",
-    "absoluteFilePath": "/var/folders/k1/z859m4qx7ld12gdjfv_79tv80000gn/T/tmp.9a5CNbHp/docker-volume-backup_config-18-7-2022.tar.gz",
-    "fileName": "docker-volume-backup_config-18-7-2022.tar.gz",
-    "lastModTime": "2022-07-18T19:00:07.553274229+01:00"
-  },
-  {
-    "volumeName": "docker-volume-backup_metadata",
-    "absoluteFilePath": "/var/folders/k1/z859m4qx7ld12gdjfv_79tv80000gn/T/tmp.9a5CNbHp/docker-volume-backup_metadata-18-7-2022.tar.gz",
-    "fileName": "docker-volume-backup_metadata-18-7-2022.tar.gz",
-    "lastModTime": "2022-07-18T19:00:08.607626133+01:00"
-  }
-]
-*/
-func cmdListBackups(hostDir string, filter string, newestOnly bool) error {
-	result, err := getAllVolumeBackups(hostDir, filter, newestOnly)
+// cmdListResticBackups outputs the snapshots of each volume in the restic repository, newest first.
+func cmdListResticBackups(hostDir string, filter string, newestOnly bool) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
 		return err
 	}
+	snapshots, err := resticbackup.ListSnapshots(context.TODO(), cli, hostDir, "")
+	if err != nil {
+		return err
+	}
+
+	result := []resticbackup.Snapshot{}
+	seenVolumes := map[string]struct{}{}
+	for _, s := range snapshots {
+		if filter != "" && !strings.Contains(s.VolumeName, filter) {
+			continue
+		}
+		if _, seenAlready := seenVolumes[s.VolumeName]; seenAlready && newestOnly {
+			continue
+		}
+		seenVolumes[s.VolumeName] = struct{}{}
+		result = append(result, s)
+	}
+
 	bytes, err := json.Marshal(result)
 	if err != nil {
 		return err
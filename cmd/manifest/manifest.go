@@ -0,0 +1,123 @@
+package manifest
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/client"
+)
+
+// Manifest describes a single backup of a volume.
+type Manifest struct {
+	VolumeName string    `json:"volumeName"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// Containers are the names of the containers which mount the volume.
+	Containers []string `json:"containers,omitempty"`
+	// Hostname is the host the backup was created on.
+	Hostname string `json:"hostname,omitempty"`
+	// Volume is the configuration the volume was created with.
+	Volume *VolumeConfig `json:"volume,omitempty"`
+	// Project is the compose project the volume belongs to.
+	Project string `json:"project,omitempty"`
+	// RunID identifies the run of backups this backup was created in, every volume backed up
+	// in the same run has the same id.
+	RunID string `json:"runId,omitempty"`
+}
+
+// VolumeConfig is the configuration of a volume, which is needed to recreate it.
+type VolumeConfig struct {
+	Driver     string            `json:"driver"`
+	DriverOpts map[string]string `json:"driverOpts,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// runIDKey is the context key of the run id.
+type runIDKey struct{}
+
+// WithRunID returns a context in which every manifest is part of the run with the given id.
+func WithRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+// runIDLayout is the format of run ids, the time the run started.
+const runIDLayout = "20060102T150405Z"
+
+// NewRunID returns the id of a run of backups started at t.
+func NewRunID(t time.Time) string {
+	return t.UTC().Format(runIDLayout)
+}
+
+// RunTime returns the time the run with the given id started.
+func RunTime(runID string) (time.Time, error) {
+	return time.Parse(runIDLayout, runID)
+}
+
+// New creates the manifest for a new backup of the volume. The run id is taken from ctx, see WithRunID.
+func New(ctx context.Context, cli *client.Client, volumeName string) (Manifest, error) {
+	containers, err := dockerutil.ContainersUsingVolume(ctx, cli, volumeName)
+	if err != nil {
+		return Manifest{}, err
+	}
+	vol, err := cli.VolumeInspect(ctx, volumeName)
+	if err != nil {
+		return Manifest{}, err
+	}
+	// compose labels the volumes it creates, external volumes take the project of their containers.
+	project := vol.Labels[dockerutil.ComposeProjectLabel]
+	if project == "" {
+		if project, err = dockerutil.ComposeProjectOfVolume(ctx, cli, volumeName); err != nil {
+			return Manifest{}, err
+		}
+	}
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	hostname, _ := os.Hostname()
+	return Manifest{
+		VolumeName: volumeName,
+		CreatedAt:  time.Now().UTC(),
+		Containers: containers,
+		Hostname:   hostname,
+		Volume: &VolumeConfig{
+			Driver:     vol.Driver,
+			DriverOpts: vol.Options,
+			Labels:     vol.Labels,
+		},
+		Project: project,
+		RunID:   runID,
+	}, nil
+}
+
+const (
+	// ProjectMetadataKey is the metadata key of the compose project.
+	ProjectMetadataKey = "project"
+	// RunIDMetadataKey is the metadata key of the run id.
+	RunIDMetadataKey = "run-id"
+)
+
+// Metadata returns the manifest as flat key value pairs, for backends which support
+// storing metadata alongside each object.
+func (m Manifest) Metadata() map[string]string {
+	metadata := map[string]string{
+		"volume-name": m.VolumeName,
+		"created-at":  m.CreatedAt.Format(time.RFC3339),
+	}
+	if len(m.Containers) > 0 {
+		metadata["containers"] = strings.Join(m.Containers, ",")
+	}
+	if m.Hostname != "" {
+		metadata["hostname"] = m.Hostname
+	}
+	if m.Volume != nil {
+		metadata["volume-driver"] = m.Volume.Driver
+	}
+	if m.Project != "" {
+		metadata[ProjectMetadataKey] = m.Project
+	}
+	if m.RunID != "" {
+		metadata[RunIDMetadataKey] = m.RunID
+	}
+	return metadata
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/spf13/cobra"
+)
+
+const (
+	toFlag             = "to"
+	certPathFlag       = "cert-path"
+	stopContainersFlag = "stop-containers"
+	overwriteFlag      = "overwrite"
+)
+
+func init() {
+	migrateVolumeCommand.Flags().String(volumeFlag, "", "name of the volume to migrate")
+	migrateVolumeCommand.Flags().String(toFlag, "", "destination docker host, e.g. ssh://user@host or tcp://host:2376")
+	migrateVolumeCommand.Flags().String(certPathFlag, "", "directory containing ca.pem, cert.pem and key.pem for a tcp destination using tls")
+	migrateVolumeCommand.Flags().Bool(stopContainersFlag, false, "stop the containers using the volume during the migration and start them again afterwards")
+	migrateVolumeCommand.Flags().Bool(overwriteFlag, false, "replace the contents of the volume if it already exists on the destination")
+	if err := migrateVolumeCommand.MarkFlagRequired(volumeFlag); err != nil {
+		panic(err)
+	}
+	if err := migrateVolumeCommand.MarkFlagRequired(toFlag); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(migrateVolumeCommand)
+}
+
+type migrateVolumeArgs struct {
+	volumeName     string
+	to             string
+	certPath       string
+	stopContainers bool
+	overwrite      bool
+}
+
+type migrateOutput struct {
+	VolumeName    string    `json:"volumeName"`
+	MigratedTo    string    `json:"migratedTo"`
+	MigrationTime time.Time `json:"migrationTime"`
+}
+
+// migrateVolumeCommand copies a volume to another docker host.
+var migrateVolumeCommand = &cobra.Command{
+	Use:   "migrate-volume",
+	Short: "copy a volume to another docker host.",
+	Long: `Copies a volume to another docker host.
+
+The volume is created on the destination with the same driver, driver options and labels,
+and its contents are streamed directly between the two docker daemons without being written
+to disk. The source volume is left as it is.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		volumeName, err := cmd.Flags().GetString(volumeFlag)
+		if err != nil {
+			panic(err)
+		}
+		to, err := cmd.Flags().GetString(toFlag)
+		if err != nil {
+			panic(err)
+		}
+		certPath, err := cmd.Flags().GetString(certPathFlag)
+		if err != nil {
+			panic(err)
+		}
+		stopContainers, err := cmd.Flags().GetBool(stopContainersFlag)
+		if err != nil {
+			panic(err)
+		}
+		overwrite, err := cmd.Flags().GetBool(overwriteFlag)
+		if err != nil {
+			panic(err)
+		}
+		if err := cmdMigrateVolume(migrateVolumeArgs{
+			volumeName:     volumeName,
+			to:             to,
+			certPath:       certPath,
+			stopContainers: stopContainers,
+			overwrite:      overwrite,
+		}); err != nil {
+			panic(err)
+		}
+	},
+}
+
+func cmdMigrateVolume(args migrateVolumeArgs) error {
+	ctx := context.TODO()
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+	remote, err := dockerutil.NewRemoteClient(args.to, args.certPath)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	source, err := cli.VolumeInspect(ctx, args.volumeName)
+	if err != nil {
+		return err
+	}
+	if _, err := remote.VolumeInspect(ctx, args.volumeName); err == nil && !args.overwrite {
+		return fmt.Errorf("volume %s already exists on %s, use --%s to replace its contents", args.volumeName, args.to, overwriteFlag)
+	} else if err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+
+	if _, err := remote.VolumeCreate(ctx, volume.VolumeCreateBody{
+		Name:       source.Name,
+		Driver:     source.Driver,
+		DriverOpts: source.Options,
+		Labels:     source.Labels,
+	}); err != nil {
+		return fmt.Errorf("failed creating volume on %s: %s", args.to, err)
+	}
+
+	if !args.overwrite {
+		// volumes using network storage may already contain data, e.g. if both hosts mount the same share.
+		if err := dockerutil.PullImage(ctx, remote.Client, "busybox:latest"); err != nil {
+			return err
+		}
+		empty, err := dockerutil.VolumeIsEmpty(ctx, remote.Client, args.volumeName)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("volume %s on %s is not empty, use --%s to replace its contents", args.volumeName, args.to, overwriteFlag)
+		}
+	}
+
+	if args.stopContainers {
+		stopped, err := dockerutil.StopContainersUsingVolume(ctx, cli, args.volumeName)
+		defer func() {
+			if err := dockerutil.StartContainers(ctx, cli, stopped); err != nil {
+				log.Println(err)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := dockerutil.CopyVolume(ctx, cli, args.volumeName, remote.Client, args.volumeName); err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(migrateOutput{
+		VolumeName:    args.volumeName,
+		MigratedTo:    args.to,
+		MigrationTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
@@ -0,0 +1,277 @@
+package ocibackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/storage"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	imagespec "github.com/opencontainers/image-spec/specs-go"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ConfigMediaType is the media type of the config blob, which contains the backup manifest.
+	ConfigMediaType = "application/vnd.docker-volume-backup.manifest.v1+json"
+	// VolumeAnnotation is the manifest annotation containing the name of the backed up volume.
+	VolumeAnnotation = "io.github.docker-volume-backup.volume"
+
+	tagTimeFormat = "20060102150405"
+)
+
+type Config struct {
+	// Repository is where artifacts are pushed, e.g. registry.example.com/backups
+	Repository string
+	Username   string
+	Password   string
+	// Insecure uses plain http, which is always used for localhost.
+	Insecure bool
+}
+
+func FromEnv() Config {
+	repository, _ := os.LookupEnv("OCI_REPOSITORY")
+	username, _ := os.LookupEnv("OCI_USERNAME")
+	password, _ := os.LookupEnv("OCI_PASSWORD")
+	insecure, _ := os.LookupEnv("OCI_INSECURE")
+	return Config{
+		Repository: repository,
+		Username:   username,
+		Password:   password,
+		Insecure:   insecure == "true",
+	}
+}
+
+// Reference is a reference to an artifact, e.g. registry.example.com/backups:config-20221018030000
+type Reference struct {
+	Registry   string
+	Repository string
+	// Tag or Digest may be empty.
+	Tag    string
+	Digest string
+}
+
+// ParseReference parses a reference of the form registry/repository[:tag|@digest]. The registry
+// is required, there is no default registry.
+func ParseReference(ref string) (Reference, error) {
+	registry, rest, ok := strings.Cut(ref, "/")
+	if !ok || rest == "" {
+		return Reference{}, fmt.Errorf("invalid reference %q, expected registry/repository[:tag]", ref)
+	}
+	r := Reference{Registry: registry}
+	if repo, d, ok := strings.Cut(rest, "@"); ok {
+		r.Repository, r.Digest = repo, d
+		return r, nil
+	}
+	// a colon after the last slash separates the tag.
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		r.Repository, r.Tag = rest[:i], rest[i+1:]
+		return r, nil
+	}
+	r.Repository = rest
+	return r, nil
+}
+
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Digest != "" {
+		return s + "@" + r.Digest
+	}
+	if r.Tag != "" {
+		return s + ":" + r.Tag
+	}
+	return s
+}
+
+// Tag returns the tag of a backup of the volume created at t.
+func Tag(volumeName string, t time.Time) string {
+	return fmt.Sprintf("%s-%s", volumeName, t.UTC().Format(tagTimeFormat))
+}
+
+// ParseTag returns the volume name and time of a tag created by Tag.
+func ParseTag(tag string) (string, time.Time, bool) {
+	i := strings.LastIndex(tag, "-")
+	if i <= 0 {
+		return "", time.Time{}, false
+	}
+	t, err := time.Parse(tagTimeFormat, tag[i+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return tag[:i], t, true
+}
+
+// Mode pushes each backup as an OCI artifact, with the archive as the only layer and the
+// backup manifest as the config.
+type Mode struct {
+	config        Config
+	retainForDays int
+}
+
+func NewMode(cfg Config, retainForDays int) *Mode {
+	return &Mode{
+		config:        cfg,
+		retainForDays: retainForDays,
+	}
+}
+
+func (m *Mode) CrateBackup(ctx context.Context, cli *client.Client, mountPoint types.MountPoint) error {
+	log.Println("performing oci backup")
+	ref, err := ParseReference(m.config.Repository)
+	if err != nil {
+		return err
+	}
+	backupManifest, err := manifest.New(ctx, cli, mountPoint.Name)
+	if err != nil {
+		return err
+	}
+	ref.Tag = Tag(mountPoint.Name, backupManifest.CreatedAt)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(storage.WriteArchive(ctx, cli, backupManifest, pw))
+	}()
+	if err := Push(ctx, m.config, ref, backupManifest, pr); err != nil {
+		_ = pr.CloseWithError(err)
+		return err
+	}
+	log.Printf("pushed %s", ref)
+
+	return m.removeExpired(ctx, ref, mountPoint.Name)
+}
+
+// removeExpired deletes the tags of the volume which are older than the retention period,
+// always keeping the newest.
+func (m *Mode) removeExpired(ctx context.Context, ref Reference, volumeName string) error {
+	if m.retainForDays <= 0 {
+		return nil
+	}
+	tags, err := ListTags(ctx, m.config, ref, volumeName)
+	if err != nil || len(tags) == 0 {
+		return err
+	}
+	reg := newRegistry(m.config, ref)
+	if err := reg.authorize(ctx); err != nil {
+		return err
+	}
+	cutoff := time.Now().AddDate(0, 0, -m.retainForDays)
+	for _, tag := range tags[1:] {
+		if _, t, _ := ParseTag(tag); t.Before(cutoff) {
+			log.Printf("removing expired backup: %s", tag)
+			if err := reg.deleteTag(ctx, tag); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Push pushes the archive read from r as an artifact with the given reference.
+func Push(ctx context.Context, cfg Config, ref Reference, m manifest.Manifest, r io.Reader) error {
+	reg := newRegistry(cfg, ref)
+	if err := reg.authorize(ctx); err != nil {
+		return err
+	}
+
+	configJSON, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	config, err := reg.pushBlob(ctx, ConfigMediaType, bytes.NewReader(configJSON))
+	if err != nil {
+		return err
+	}
+	layer, err := reg.pushBlob(ctx, specs.MediaTypeImageLayerGzip, r)
+	if err != nil {
+		return err
+	}
+	layer.Annotations = map[string]string{
+		specs.AnnotationTitle: fmt.Sprintf("%s.tar.gz", ref.Tag),
+	}
+
+	return reg.pushManifest(ctx, ref.Tag, specs.Manifest{
+		Versioned: imagespec.Versioned{SchemaVersion: 2},
+		MediaType: specs.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []specs.Descriptor{layer},
+		Annotations: map[string]string{
+			specs.AnnotationCreated: m.CreatedAt.Format(time.RFC3339),
+			VolumeAnnotation:        m.VolumeName,
+		},
+	})
+}
+
+// ListTags returns the tags of backups of the volume in the repository, newest first.
+func ListTags(ctx context.Context, cfg Config, ref Reference, volumeName string) ([]string, error) {
+	reg := newRegistry(cfg, ref)
+	if err := reg.authorize(ctx); err != nil {
+		return nil, err
+	}
+	tags, err := reg.tags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, tag := range tags {
+		if v, _, ok := ParseTag(tag); ok && v == volumeName {
+			result = append(result, tag)
+		}
+	}
+	// the time format sorts lexically.
+	sort.Sort(sort.Reverse(sort.StringSlice(result)))
+	return result, nil
+}
+
+// Pull writes the archive of the artifact to w, and returns the manifest of the backup. If
+// the reference has neither a tag nor a digest, the newest backup of the volume is pulled.
+func Pull(ctx context.Context, cfg Config, ref Reference, volumeName string, w io.Writer) (manifest.Manifest, error) {
+	reg := newRegistry(cfg, ref)
+	if err := reg.authorize(ctx); err != nil {
+		return manifest.Manifest{}, err
+	}
+
+	reference := ref.Digest
+	if reference == "" {
+		reference = ref.Tag
+	}
+	if reference == "" {
+		tags, err := ListTags(ctx, cfg, ref, volumeName)
+		if err != nil {
+			return manifest.Manifest{}, err
+		}
+		if len(tags) == 0 {
+			return manifest.Manifest{}, fmt.Errorf("no backups found for volume %s in %s", volumeName, ref)
+		}
+		reference = tags[0]
+	}
+	log.Printf("pulling %s", reference)
+
+	m, _, err := reg.fetchManifest(ctx, reference)
+	if err != nil {
+		return manifest.Manifest{}, err
+	}
+	if m.Config.MediaType != ConfigMediaType || len(m.Layers) != 1 {
+		return manifest.Manifest{}, fmt.Errorf("%s is not a volume backup", reference)
+	}
+
+	var config bytes.Buffer
+	if err := reg.fetchBlob(ctx, m.Config, &config); err != nil {
+		return manifest.Manifest{}, err
+	}
+	var backupManifest manifest.Manifest
+	if err := json.Unmarshal(config.Bytes(), &backupManifest); err != nil {
+		return manifest.Manifest{}, fmt.Errorf("failed parsing backup manifest: %s", err)
+	}
+	return backupManifest, reg.fetchBlob(ctx, m.Layers[0], w)
+}
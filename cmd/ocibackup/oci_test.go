@@ -0,0 +1,216 @@
+package ocibackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRegistry returns an in memory registry which requires a bearer token, and supports
+// the parts of the distribution API used by the client.
+func newTestRegistry(t *testing.T) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	uploads := map[string][]byte{}
+	blobs := map[digest.Digest][]byte{}
+	manifests := map[string][]byte{}
+	tags := map[string]digest.Digest{}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := r.URL.Path
+		body, _ := io.ReadAll(r.Body)
+
+		if path == "/token" {
+			require.Equal(t, "repository:backups/volumes:pull,push,delete", r.URL.Query().Get("scope"))
+			_, _ = w.Write([]byte(`{"token":"secret"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case path == "/v2/":
+		case r.Method == http.MethodPost && strings.HasSuffix(path, "/blobs/uploads/"):
+			id := fmt.Sprint(len(uploads) + 1)
+			uploads[id] = nil
+			w.Header().Set("Location", path+id+"?state=abc")
+			w.WriteHeader(http.StatusAccepted)
+		case strings.Contains(path, "/blobs/uploads/"):
+			id := path[strings.LastIndex(path, "/")+1:]
+			require.Equal(t, "abc", r.URL.Query().Get("state"))
+			uploads[id] = append(uploads[id], body...)
+			if r.Method == http.MethodPatch {
+				w.Header().Set("Location", path+"?state=abc")
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			d := digest.Digest(r.URL.Query().Get("digest"))
+			require.Equal(t, d, digest.FromBytes(uploads[id]))
+			blobs[d] = uploads[id]
+			w.WriteHeader(http.StatusCreated)
+		case strings.Contains(path, "/blobs/"):
+			_, _ = w.Write(blobs[digest.Digest(path[strings.LastIndex(path, "/")+1:])])
+		case strings.Contains(path, "/manifests/"):
+			reference := path[strings.LastIndex(path, "/")+1:]
+			switch r.Method {
+			case http.MethodPut:
+				require.Equal(t, specs.MediaTypeImageManifest, r.Header.Get("Content-Type"))
+				d := digest.FromBytes(body)
+				manifests[d.String()] = body
+				tags[reference] = d
+				w.WriteHeader(http.StatusCreated)
+			case http.MethodDelete:
+				delete(manifests, reference)
+				for tag, d := range tags {
+					if d.String() == reference {
+						delete(tags, tag)
+					}
+				}
+				w.WriteHeader(http.StatusAccepted)
+			default:
+				if d, ok := tags[reference]; ok {
+					reference = d.String()
+				}
+				m, ok := manifests[reference]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				_, _ = w.Write(m)
+			}
+		case strings.HasSuffix(path, "/tags/list"):
+			// tags are returned two at a time, to make the client follow the Link header.
+			var list struct {
+				Tags []string `json:"tags"`
+			}
+			for tag := range tags {
+				if tag > r.URL.Query().Get("last") {
+					list.Tags = append(list.Tags, tag)
+				}
+			}
+			sort.Strings(list.Tags)
+			if len(list.Tags) > 2 {
+				list.Tags = list.Tags[:2]
+				w.Header().Set("Link", fmt.Sprintf(`<%s?last=%s&n=2>; rel="next"`, path, list.Tags[1]))
+			}
+			require.NoError(t, json.NewEncoder(w).Encode(list))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPushPull(t *testing.T) {
+	ctx := context.Background()
+	server := newTestRegistry(t)
+	repository := strings.TrimPrefix(server.URL, "http://") + "/backups/volumes"
+	cfg := Config{Repository: repository}
+
+	ref, err := ParseReference(repository)
+	require.NoError(t, err)
+
+	older := time.Date(2022, 9, 1, 3, 0, 0, 0, time.UTC)
+	newer := time.Date(2022, 10, 1, 3, 0, 0, 0, time.UTC)
+	for _, created := range []time.Time{older, newer} {
+		ref.Tag = Tag("config", created)
+		m := manifest.Manifest{VolumeName: "config", CreatedAt: created, Containers: []string{"app"}}
+		require.NoError(t, Push(ctx, cfg, ref, m, strings.NewReader("archive "+created.String())))
+	}
+	ref.Tag = Tag("config-other", newer)
+	require.NoError(t, Push(ctx, cfg, ref, manifest.Manifest{VolumeName: "config-other", CreatedAt: newer}, strings.NewReader("other")))
+
+	t.Run("list tags", func(t *testing.T) {
+		tags, err := ListTags(ctx, cfg, ref, "config")
+		require.NoError(t, err)
+		require.Equal(t, []string{"config-20221001030000", "config-20220901030000"}, tags)
+	})
+
+	t.Run("pull newest", func(t *testing.T) {
+		ref := ref
+		ref.Tag = ""
+		var buf bytes.Buffer
+		m, err := Pull(ctx, cfg, ref, "config", &buf)
+		require.NoError(t, err)
+		require.Equal(t, "archive "+newer.String(), buf.String())
+		require.Equal(t, []string{"app"}, m.Containers)
+	})
+
+	t.Run("pull tag", func(t *testing.T) {
+		ref := ref
+		ref.Tag = Tag("config", older)
+		var buf bytes.Buffer
+		_, err := Pull(ctx, cfg, ref, "config", &buf)
+		require.NoError(t, err)
+		require.Equal(t, "archive "+older.String(), buf.String())
+	})
+
+	t.Run("remove expired", func(t *testing.T) {
+		mode := NewMode(cfg, 7)
+		require.NoError(t, mode.removeExpired(ctx, ref, "config"))
+		tags, err := ListTags(ctx, cfg, ref, "config")
+		require.NoError(t, err)
+		require.Equal(t, []string{"config-20221001030000"}, tags, "the newest backup should never be removed")
+	})
+}
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected Reference
+	}{
+		{"localhost:5000/backups", Reference{Registry: "localhost:5000", Repository: "backups"}},
+		{"localhost:5000/team/backups:config-20221018030000", Reference{Registry: "localhost:5000", Repository: "team/backups", Tag: "config-20221018030000"}},
+		{"registry.example.com/backups@sha256:abc", Reference{Registry: "registry.example.com", Repository: "backups", Digest: "sha256:abc"}},
+	}
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			ref, err := ParseReference(test.ref)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, ref)
+			require.Equal(t, test.ref, ref.String())
+		})
+	}
+
+	_, err := ParseReference("backups")
+	require.Error(t, err)
+}
+
+func TestNextLink(t *testing.T) {
+	require.Equal(t, "/v2/backups/tags/list?last=b&n=100", nextLink([]string{`</v2/backups/tags/list?last=b&n=100>; rel="next"`}))
+	require.Equal(t, "https://example.com/next", nextLink([]string{`<https://example.com/prev>; rel="prev", <https://example.com/next>; rel=next`}))
+	require.Empty(t, nextLink(nil))
+}
+
+func TestParseTag(t *testing.T) {
+	created := time.Date(2022, 10, 18, 3, 0, 0, 0, time.UTC)
+	volumeName, parsed, ok := ParseTag(Tag("my-volume", created))
+	require.True(t, ok)
+	require.Equal(t, "my-volume", volumeName)
+	require.Equal(t, created, parsed)
+
+	_, _, ok = ParseTag("latest")
+	require.False(t, ok)
+}
@@ -0,0 +1,349 @@
+package ocibackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// registry is a minimal client for the OCI distribution API, scoped to a single repository.
+type registry struct {
+	baseURL    string
+	repository string
+	username   string
+	password   string
+	client     *http.Client
+	// authorization is the value of the Authorization header, set by authorize.
+	authorization string
+}
+
+func newRegistry(cfg Config, ref Reference) *registry {
+	scheme := "https"
+	if cfg.Insecure || isLocalhost(ref.Registry) {
+		scheme = "http"
+	}
+	return &registry{
+		baseURL:    fmt.Sprintf("%s://%s", scheme, ref.Registry),
+		repository: ref.Repository,
+		username:   cfg.Username,
+		password:   cfg.Password,
+		client:     http.DefaultClient,
+	}
+}
+
+func isLocalhost(host string) bool {
+	hostname := strings.Split(host, ":")[0]
+	return hostname == "localhost" || hostname == "127.0.0.1"
+}
+
+func (r *registry) url(format string, args ...interface{}) string {
+	return r.baseURL + "/v2/" + r.repository + fmt.Sprintf(format, args...)
+}
+
+func (r *registry) do(ctx context.Context, method, target string, body io.Reader, header http.Header, expected ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if r.authorization != "" {
+		req.Header.Set("Authorization", r.authorization)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("%s %s returned %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// authorize checks whether the registry requires authentication and, if it does, obtains
+// credentials for pulling from and pushing to the repository. Authorizing up front means
+// requests with streamed bodies never need to be retried.
+func (r *registry) authorize(ctx context.Context) error {
+	resp, err := r.do(ctx, http.MethodGet, r.baseURL+"/v2/", nil, nil, http.StatusOK, http.StatusUnauthorized)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch strings.ToLower(scheme) {
+	case "basic":
+		req, _ := http.NewRequest(http.MethodGet, r.baseURL, nil)
+		req.SetBasicAuth(r.username, r.password)
+		r.authorization = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+		return r.fetchToken(ctx, params)
+	default:
+		return fmt.Errorf("unsupported authentication scheme %q", scheme)
+	}
+}
+
+// fetchToken requests a bearer token from the realm of the challenge.
+func (r *registry) fetchToken(ctx context.Context, params map[string]string) error {
+	query := url.Values{"scope": {fmt.Sprintf("repository:%s:pull,push,delete", r.repository)}}
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request returned %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed parsing token response: %s", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	r.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.example.com/token",service="registry.example.com"
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(header, " ")
+	params := map[string]string{}
+	for _, part := range strings.Split(rest, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return scheme, params
+}
+
+// resolve resolves a Location header against the registry, registries may return relative locations.
+func (r *registry) resolve(location string) (string, error) {
+	base, err := url.Parse(r.baseURL)
+	if err != nil {
+		return "", err
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(loc).String(), nil
+}
+
+// withDigest adds the digest query parameter to an upload location, which may already have a query.
+func withDigest(location string, d digest.Digest) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("digest", d.String())
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// countingDigester computes the digest and size of everything written to it.
+type countingDigester struct {
+	hash hash.Hash
+	size int64
+}
+
+func (c *countingDigester) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return c.hash.Write(p)
+}
+
+// pushBlob uploads a blob of unknown size by streaming it in a single PATCH, and returns its descriptor.
+func (r *registry) pushBlob(ctx context.Context, mediaType string, blob io.Reader) (specs.Descriptor, error) {
+	resp, err := r.do(ctx, http.MethodPost, r.url("/blobs/uploads/"), nil, nil, http.StatusAccepted)
+	if err != nil {
+		return specs.Descriptor{}, fmt.Errorf("failed starting blob upload: %s", err)
+	}
+	_ = resp.Body.Close()
+	location, err := r.resolve(resp.Header.Get("Location"))
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+
+	digester := &countingDigester{hash: sha256.New()}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err = r.do(ctx, http.MethodPatch, location, io.TeeReader(blob, digester), header, http.StatusAccepted, http.StatusNoContent)
+	if err != nil {
+		return specs.Descriptor{}, fmt.Errorf("failed uploading blob: %s", err)
+	}
+	_ = resp.Body.Close()
+	if loc := resp.Header.Get("Location"); loc != "" {
+		if location, err = r.resolve(loc); err != nil {
+			return specs.Descriptor{}, err
+		}
+	}
+
+	d := digest.NewDigestFromBytes(digest.SHA256, digester.hash.Sum(nil))
+	location, err = withDigest(location, d)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	resp, err = r.do(ctx, http.MethodPut, location, nil, nil, http.StatusCreated)
+	if err != nil {
+		return specs.Descriptor{}, fmt.Errorf("failed completing blob upload: %s", err)
+	}
+	_ = resp.Body.Close()
+	return specs.Descriptor{MediaType: mediaType, Digest: d, Size: digester.size}, nil
+}
+
+func (r *registry) pushManifest(ctx context.Context, tag string, m specs.Manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {specs.MediaTypeImageManifest}}
+	resp, err := r.do(ctx, http.MethodPut, r.url("/manifests/%s", tag), bytes.NewReader(b), header, http.StatusCreated)
+	if err != nil {
+		return fmt.Errorf("failed pushing manifest: %s", err)
+	}
+	return resp.Body.Close()
+}
+
+// fetchManifest returns the manifest of the tag or digest, and its digest.
+func (r *registry) fetchManifest(ctx context.Context, reference string) (specs.Manifest, digest.Digest, error) {
+	header := http.Header{"Accept": {specs.MediaTypeImageManifest}}
+	resp, err := r.do(ctx, http.MethodGet, r.url("/manifests/%s", reference), nil, header, http.StatusOK)
+	if err != nil {
+		return specs.Manifest{}, "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return specs.Manifest{}, "", err
+	}
+	var m specs.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return specs.Manifest{}, "", fmt.Errorf("failed parsing manifest: %s", err)
+	}
+	return m, digest.FromBytes(b), nil
+}
+
+func (r *registry) fetchBlob(ctx context.Context, desc specs.Descriptor, w io.Writer) error {
+	resp, err := r.do(ctx, http.MethodGet, r.url("/blobs/%s", desc.Digest), nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	verifier := desc.Digest.Verifier()
+	if _, err := io.Copy(io.MultiWriter(w, verifier), resp.Body); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s failed verification", desc.Digest)
+	}
+	return nil
+}
+
+// tags returns every tag in the repository, following the Link header of each page.
+func (r *registry) tags(ctx context.Context) ([]string, error) {
+	var tags []string
+	for target := r.url("/tags/list"); target != ""; {
+		page, next, err := r.tagsPage(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page...)
+		target = next
+	}
+	return tags, nil
+}
+
+// tagsPage returns a page of tags, and the url of the next page if there is one.
+func (r *registry) tagsPage(ctx context.Context, target string) ([]string, string, error) {
+	resp, err := r.do(ctx, http.MethodGet, target, nil, nil, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	// the repository does not exist until the first push.
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	}
+	var list struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", fmt.Errorf("failed parsing tag list: %s", err)
+	}
+	next := nextLink(resp.Header.Values("Link"))
+	if next == "" {
+		return list.Tags, "", nil
+	}
+	next, err = r.resolve(next)
+	return list.Tags, next, err
+}
+
+// nextLink returns the target of the rel="next" link in Link headers such as
+// </v2/backups/tags/list?last=b&n=100>; rel="next".
+func nextLink(headers []string) string {
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+			if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "rel") && strings.Trim(value, `"`) == "next" {
+					return strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// deleteTag deletes the manifest the tag points to. Registries only support deleting manifests
+// by digest, which also removes any other tags pointing to the same manifest.
+func (r *registry) deleteTag(ctx context.Context, tag string) error {
+	_, d, err := r.fetchManifest(ctx, tag)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(ctx, http.MethodDelete, r.url("/manifests/%s", d), nil, nil, http.StatusAccepted, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("failed deleting manifest, deletes may need to be enabled on the registry: %s", err)
+	}
+	return resp.Body.Close()
+}
@@ -1,14 +1,21 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"time"
 
 	"docker-volume-backup/cmd/backups"
+	"docker-volume-backup/cmd/dockerhostbackup"
 	"docker-volume-backup/cmd/filebackup"
+	"docker-volume-backup/cmd/incrementalbackup"
+	"docker-volume-backup/cmd/ocibackup"
+	"docker-volume-backup/cmd/repobackup"
+	"docker-volume-backup/cmd/resticbackup"
 	"docker-volume-backup/cmd/s3backup"
+	"docker-volume-backup/cmd/storage"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/mount"
@@ -21,6 +28,9 @@ func init() {
 	periodicBackupsCmd.Flags().String("host-path", "", "backup host path")
 	periodicBackupsCmd.Flags().String("modes", "filesystem", "specified backup modes")
 	periodicBackupsCmd.Flags().Int("retention-days", 0, "retention days")
+	periodicBackupsCmd.Flags().Int("full-backup-days", 7, "days between full backups in incremental mode")
+	periodicBackupsCmd.Flags().String("repository", "", "directory or s3://bucket/prefix of the repository in repository mode")
+	periodicBackupsCmd.Flags().Bool(stopContainersFlag, false, "stop the containers using a labeled volume which is not attached to a labeled container while backing it up")
 	rootCmd.AddCommand(periodicBackupsCmd)
 }
 
@@ -35,8 +45,42 @@ Any files in the specified directory older than the specified retention-days wil
 If no volumes are specified under "ie.cianhatton.backup.volumes", all volumes of type
 "volume" will be backed up.
 
+Volumes labeled with "ie.cianhatton.backup.enabled" are backed up without stopping any
+containers, unless stop-containers is set.
+
 This mode is intended to be deployed alongside other containers and left running.
 
+In "incremental" mode, a full archive is created every full-backup-days and each
+following backup only contains the changes since the previous one.
+
+In "repository" mode, volumes are split into chunks which are stored once in a
+deduplicated repository, and each backup is a small snapshot referencing them.
+
+In "restic" mode, volumes are backed up to the restic repository configured with
+the RESTIC_REPOSITORY and RESTIC_PASSWORD environment variables.
+
+In "sftp" mode, archives are uploaded to a remote host over ssh, configured with
+the SFTP_* environment variables.
+
+In "webdav" mode, archives are uploaded to a WebDAV server such as Nextcloud, configured
+with the WEBDAV_* environment variables.
+
+In "azblob" mode, archives are uploaded to Azure Blob Storage, configured with the
+AZURE_STORAGE_* environment variables.
+
+In "gcs" mode, archives are uploaded to Google Cloud Storage, configured with the
+GCS_* environment variables.
+
+In "rclone" mode, archives are uploaded to any rclone remote with rclone in a helper
+container, configured with the RCLONE_* environment variables.
+
+In "docker-volume" mode, archives are written to the docker volume named by BACKUP_VOLUME.
+
+In "docker-host" mode, volumes are copied to a volume with the same name on the docker
+host configured with REMOTE_DOCKER_HOST, keeping a warm standby copy.
+
+In "oci" mode, archives are pushed as OCI artifacts to the container registry
+repository configured with the OCI_* environment variables.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 
@@ -59,11 +103,29 @@ This mode is intended to be deployed alongside other containers and left running
 			panic(err)
 		}
 
+		fullBackupEveryDays, err := cmd.Flags().GetInt("full-backup-days")
+		if err != nil {
+			panic(err)
+		}
+
+		repository, err := cmd.Flags().GetString("repository")
+		if err != nil {
+			panic(err)
+		}
+
+		stopContainers, err := cmd.Flags().GetBool(stopContainersFlag)
+		if err != nil {
+			panic(err)
+		}
+
 		cmdPerformBackups(config{
-			hostPathForBackups: hostPath,
-			cronSchedule:       cron,
-			retainForDays:      retainForDays,
-			modes:              mode,
+			hostPathForBackups:  hostPath,
+			cronSchedule:        cron,
+			retainForDays:       retainForDays,
+			modes:               mode,
+			fullBackupEveryDays: fullBackupEveryDays,
+			repository:          repository,
+			stopContainers:      stopContainers,
 		})
 	},
 }
@@ -77,8 +139,25 @@ func extractBackupModes(cfg config) []backups.BackupMode {
 			backupModes = append(backupModes, filebackup.NewMode(cfg.hostPathForBackups))
 		case "s3":
 			backupModes = append(backupModes, s3backup.NewMode(cfg.hostPathForBackups))
+		case "incremental":
+			backupModes = append(backupModes, incrementalbackup.NewMode(cfg.hostPathForBackups, cfg.fullBackupEveryDays, cfg.retainForDays))
+		case "repository":
+			backupModes = append(backupModes, repobackup.NewMode(cfg.repository, cfg.retainForDays))
+		case "restic":
+			backupModes = append(backupModes, resticbackup.NewMode(cfg.hostPathForBackups, cfg.retainForDays))
+		case "docker-host":
+			backupModes = append(backupModes, dockerhostbackup.NewMode(dockerhostbackup.FromEnv()))
+		case "oci":
+			backupModes = append(backupModes, ocibackup.NewMode(ocibackup.FromEnv(), cfg.retainForDays))
 		default:
-			panic(fmt.Sprintf("unknown backup modes specified: %s", item))
+			backend, err := newStorageBackend(item)
+			if errors.Is(err, errUnknownBackend) {
+				panic(fmt.Sprintf("unknown backup modes specified: %s", item))
+			}
+			if err != nil {
+				panic(err)
+			}
+			backupModes = append(backupModes, storage.NewMode(item, backend, cfg.retainForDays))
 		}
 	}
 	return backupModes
@@ -111,6 +190,15 @@ type config struct {
 	retainForDays int
 
 	modes string
+
+	// fullBackupEveryDays is the number of days between full backups in incremental mode.
+	fullBackupEveryDays int
+
+	// repository is the location of the repository in repository mode.
+	repository string
+
+	// stopContainers stops the containers using a labeled volume while it is backed up.
+	stopContainers bool
 }
 
 // getVolumeNamesToBackup extracts a list of volumes to be backed up from
@@ -137,7 +225,7 @@ func cmdPerformBackups(cfg config) {
 	log.Printf("running backups with cron schedule: %q", cfg.cronSchedule)
 	_, err := s.Cron(cfg.cronSchedule).Do(func() {
 		log.Println("performing backups")
-		if err := backups.PerformBackups(extractBackupModes(cfg)...); err != nil {
+		if err := backups.PerformBackups(cfg.stopContainers, extractBackupModes(cfg)...); err != nil {
 			log.Printf("failed performing backups: %s", err)
 		}
 	})
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"docker-volume-backup/cmd/s3backup"
+	"docker-volume-backup/cmd/storage"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	atFlag       = "at"
+	beforeFlag   = "before"
+	backupIDFlag = "backup-id"
+	previewFlag  = "preview"
+)
+
+// timeLayouts are the accepted formats of --at and --before, e.g. 2022-10-15T03:00Z
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// pointInTime selects which backup of a volume is restored.
+type pointInTime struct {
+	// at selects the newest backup which is not after it, the zero value selects the newest backup.
+	at time.Time
+	// before only selects backups strictly before at.
+	before bool
+	// backupID selects the backup with this file name or key, regardless of time.
+	backupID string
+}
+
+func addPointInTimeFlags(cmd *cobra.Command) {
+	cmd.Flags().String(atFlag, "", "restore the newest backup which is not after this time, e.g. 2022-10-15T03:00Z")
+	cmd.Flags().String(beforeFlag, "", "restore the newest backup from before this time, e.g. 2022-10-15T03:00Z")
+	cmd.Flags().String(backupIDFlag, "", "restore the backup with this file name or key")
+	cmd.Flags().Bool(previewFlag, false, "print the backups which would be restored without restoring them")
+	cmd.MarkFlagsMutuallyExclusive(atFlag, beforeFlag, backupIDFlag)
+}
+
+func getPointInTime(cmd *cobra.Command) (pointInTime, error) {
+	at, err := cmd.Flags().GetString(atFlag)
+	if err != nil {
+		return pointInTime{}, err
+	}
+	before, err := cmd.Flags().GetString(beforeFlag)
+	if err != nil {
+		return pointInTime{}, err
+	}
+	backupID, err := cmd.Flags().GetString(backupIDFlag)
+	if err != nil {
+		return pointInTime{}, err
+	}
+
+	p := pointInTime{backupID: backupID}
+	if before != "" {
+		at = before
+		p.before = true
+	}
+	if at != "" {
+		if p.at, err = parseTime(at); err != nil {
+			return pointInTime{}, err
+		}
+	}
+	return p, nil
+}
+
+// parseTime parses a time in any of the timeLayouts. Times without a zone are in UTC.
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. 2022-10-15T03:00Z", s)
+}
+
+// selects returns true if the backup with the given id and time may be restored.
+func (p pointInTime) selects(id string, t time.Time) bool {
+	if p.backupID != "" {
+		return id == p.backupID
+	}
+	if p.at.IsZero() {
+		return true
+	}
+	if p.before {
+		return t.Before(p.at)
+	}
+	return !t.After(p.at)
+}
+
+// selectBackup returns the index of the first of n backups, sorted newest first, which is selected.
+// It returns -1 if no backup is selected.
+func selectBackup(p pointInTime, n int, backup func(i int) (string, time.Time)) int {
+	for i := 0; i < n; i++ {
+		if p.selects(backup(i)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// noBackupError is returned when no backup of the volume is selected.
+func noBackupError(volumeName string, p pointInTime) error {
+	return noBackupOfError("volume "+volumeName, p)
+}
+
+// noBackupOfError is returned when no backup of subject, e.g. "volume data", is selected.
+func noBackupOfError(subject string, p pointInTime) error {
+	switch {
+	case p.backupID != "":
+		return fmt.Errorf("no backup %s found for %s", p.backupID, subject)
+	case p.before:
+		return fmt.Errorf("no backups found for %s before %s", subject, p.at.Format(time.RFC3339))
+	case !p.at.IsZero():
+		return fmt.Errorf("no backups found for %s at or before %s", subject, p.at.Format(time.RFC3339))
+	default:
+		return fmt.Errorf("no backups found for %s", subject)
+	}
+}
+
+// restorePreview describes a backup which would be restored.
+type restorePreview struct {
+	VolumeName  string    `json:"volumeName"`
+	RestoreFrom string    `json:"restoreFrom"`
+	BackupTime  time.Time `json:"backupTime"`
+}
+
+func printPreview(previews []restorePreview) error {
+	bytes, err := json.Marshal(previews)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+// selectHostPathBackup selects a backup of the volume from the archives in hostPath.
+func selectHostPathBackup(hostPath, volumeName string, p pointInTime) (restorePreview, error) {
+	allBackups, err := getAllVolumeBackups(hostPath, "", false)
+	if err != nil {
+		return restorePreview{}, err
+	}
+	var backups []backedUpVolume
+	for _, b := range allBackups {
+		if b.VolumeName == volumeName {
+			backups = append(backups, b)
+		}
+	}
+	i := selectBackup(p, len(backups), func(i int) (string, time.Time) {
+		return backups[i].FileName, backups[i].LastModTime
+	})
+	if i < 0 {
+		return restorePreview{}, noBackupError(volumeName, p)
+	}
+	return restorePreview{VolumeName: volumeName, RestoreFrom: backups[i].AbsoluteFilePath, BackupTime: backups[i].LastModTime}, nil
+}
+
+// selectS3Backup selects a backup of the volume from s3, RestoreFrom is the key of the backup.
+func selectS3Backup(volumeName string, p pointInTime) (restorePreview, error) {
+	objects, err := s3backup.ListVolumeBackups(volumeName)
+	if err != nil {
+		return restorePreview{}, err
+	}
+	i := selectBackup(p, len(objects), func(i int) (string, time.Time) {
+		return *objects[i].Key, *objects[i].LastModified
+	})
+	if i < 0 {
+		return restorePreview{}, noBackupError(volumeName, p)
+	}
+	return restorePreview{VolumeName: volumeName, RestoreFrom: *objects[i].Key, BackupTime: *objects[i].LastModified}, nil
+}
+
+// selectBackendBackup selects a backup of the volume from a storage backend, RestoreFrom is the key of the backup.
+func selectBackendBackup(ctx context.Context, backend storage.Backend, volumeName string, p pointInTime) (restorePreview, error) {
+	objects, err := storage.ListVolume(ctx, backend, volumeName)
+	if err != nil {
+		return restorePreview{}, err
+	}
+	i := selectBackup(p, len(objects), func(i int) (string, time.Time) {
+		return objects[i].Key, objects[i].LastModified
+	})
+	if i < 0 {
+		return restorePreview{}, noBackupError(volumeName, p)
+	}
+	return restorePreview{VolumeName: volumeName, RestoreFrom: objects[i].Key, BackupTime: objects[i].LastModified}, nil
+}
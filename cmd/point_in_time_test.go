@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTime(t *testing.T) {
+	for _, s := range []string{"2022-10-15T03:00Z", "2022-10-15T03:00:00Z", "2022-10-15T05:00+02:00", "2022-10-15T03:00"} {
+		parsed, err := parseTime(s)
+		require.NoError(t, err, s)
+		require.True(t, parsed.Equal(time.Date(2022, 10, 15, 3, 0, 0, 0, time.UTC)), s)
+	}
+
+	_, err := parseTime("15.10.2022")
+	require.Error(t, err)
+}
+
+func TestSelectHostPathBackup(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2022, 10, 15, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("data-%d-10-2022.tar.gz", 13+i))
+		require.NoError(t, os.WriteFile(name, nil, 0o644))
+		mtime := day.AddDate(0, 0, i-2)
+		require.NoError(t, os.Chtimes(name, mtime, mtime))
+	}
+
+	t.Run("newest by default", func(t *testing.T) {
+		selected, err := selectHostPathBackup(dir, "data", pointInTime{})
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, "data-15-10-2022.tar.gz"), selected.RestoreFrom)
+	})
+
+	t.Run("at includes the given time", func(t *testing.T) {
+		selected, err := selectHostPathBackup(dir, "data", pointInTime{at: day.Add(-24 * time.Hour)})
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, "data-14-10-2022.tar.gz"), selected.RestoreFrom)
+	})
+
+	t.Run("before excludes the given time", func(t *testing.T) {
+		selected, err := selectHostPathBackup(dir, "data", pointInTime{at: day.Add(-24 * time.Hour), before: true})
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, "data-13-10-2022.tar.gz"), selected.RestoreFrom)
+	})
+
+	t.Run("backup id", func(t *testing.T) {
+		selected, err := selectHostPathBackup(dir, "data", pointInTime{backupID: "data-13-10-2022.tar.gz"})
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, "data-13-10-2022.tar.gz"), selected.RestoreFrom)
+	})
+
+	t.Run("nothing before the oldest backup", func(t *testing.T) {
+		_, err := selectHostPathBackup(dir, "data", pointInTime{at: day.AddDate(0, 0, -3)})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,165 @@
+package rclonebackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/storage"
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+)
+
+const (
+	defaultImage = "rclone/rclone:latest"
+
+	// configPath is where the rclone.conf file is mounted in the rclone container.
+	configPath = "/config/rclone/rclone.conf"
+)
+
+type Config struct {
+	// Remote is the rclone remote and path where archives are stored, e.g. s3:bucket/backups
+	Remote string
+	// ConfigHostPath is the path on the host to an rclone.conf file. It may be empty if
+	// remotes are configured with RCLONE_CONFIG_* environment variables instead.
+	ConfigHostPath string
+	Image          string
+}
+
+func FromEnv() Config {
+	remote, _ := os.LookupEnv("RCLONE_REMOTE")
+	configHostPath, _ := os.LookupEnv("RCLONE_CONFIG")
+	image, ok := os.LookupEnv("RCLONE_IMAGE")
+	if !ok {
+		image = defaultImage
+	}
+	return Config{
+		Remote:         remote,
+		ConfigHostPath: configHostPath,
+		Image:          image,
+	}
+}
+
+// Backend stores archives in any rclone remote, by running rclone in a helper container.
+type Backend struct {
+	config Config
+	cli    *client.Client
+}
+
+func NewBackend(cfg Config, cli *client.Client) *Backend {
+	return &Backend{
+		config: cfg,
+		cli:    cli,
+	}
+}
+
+// path returns the rclone path of the key in the remote.
+func (b *Backend) path(key string) string {
+	if key == "" || strings.HasSuffix(b.config.Remote, ":") || strings.HasSuffix(b.config.Remote, "/") {
+		return b.config.Remote + key
+	}
+	return b.config.Remote + "/" + key
+}
+
+// run runs rclone with the given arguments, streaming stdin to rclone and its output to stdout.
+func (b *Backend) run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	if b.config.Remote == "" {
+		return fmt.Errorf("RCLONE_REMOTE is not set")
+	}
+	if err := dockerutil.PullImage(ctx, b.cli, b.config.Image); err != nil {
+		return err
+	}
+
+	var mounts []mount.Mount
+	env := rcloneEnv()
+	if b.config.ConfigHostPath != "" {
+		// the config is writable, as rclone refreshes oauth tokens in place.
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeBind,
+			Source: b.config.ConfigHostPath,
+			Target: configPath,
+		})
+		env = append(env, "RCLONE_CONFIG="+configPath)
+	}
+	return dockerutil.RunContainerAttached(ctx, b.cli, &container.Config{
+		Image: b.config.Image,
+		// the image entrypoint is rclone.
+		Cmd: args,
+		Env: env,
+	}, mounts, stdin, stdout)
+}
+
+// rcloneEnv returns the environment variables which are passed through to rclone, e.g.
+// RCLONE_CONFIG_MYS3_TYPE=s3 to configure a remote without a config file.
+func rcloneEnv() []string {
+	var env []string
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "RCLONE_") && !strings.HasPrefix(e, "RCLONE_CONFIG=") {
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
+func (b *Backend) Upload(ctx context.Context, key string, r io.Reader, m manifest.Manifest) error {
+	// upload to a temporary file, so that a partial upload never replaces an existing archive.
+	tmp := b.path(key + ".tmp")
+	if err := b.run(ctx, []string{"rcat", tmp}, r, io.Discard); err != nil {
+		_ = b.run(ctx, []string{"deletefile", tmp}, nil, io.Discard)
+		return err
+	}
+	return b.run(ctx, []string{"moveto", tmp, b.path(key)}, nil, io.Discard)
+}
+
+// listEntry is an entry of the output of rclone lsjson.
+type listEntry struct {
+	Name    string    `json:"Name"`
+	Size    int64     `json:"Size"`
+	ModTime time.Time `json:"ModTime"`
+	IsDir   bool      `json:"IsDir"`
+}
+
+func (b *Backend) List(ctx context.Context, prefix string) ([]storage.Object, error) {
+	var out strings.Builder
+	if err := b.run(ctx, []string{"lsjson", "--files-only", "--no-mimetype", b.path("")}, nil, &out); err != nil {
+		// the directory does not exist until the first upload.
+		if strings.Contains(err.Error(), "directory not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseList([]byte(out.String()), prefix)
+}
+
+func parseList(out []byte, prefix string) ([]storage.Object, error) {
+	var entries []listEntry
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("failed parsing rclone lsjson output: %s", err)
+	}
+	var objects []storage.Object
+	for _, e := range entries {
+		if e.IsDir || !strings.HasPrefix(e.Name, prefix) {
+			continue
+		}
+		if obj, ok := storage.NewObject(e.Name, e.Size, e.ModTime); ok {
+			objects = append(objects, obj)
+		}
+	}
+	return objects, nil
+}
+
+func (b *Backend) Download(ctx context.Context, key string, w io.Writer) error {
+	return b.run(ctx, []string{"cat", b.path(key)}, nil, w)
+}
+
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	return b.run(ctx, []string{"deletefile", b.path(key)}, nil, io.Discard)
+}
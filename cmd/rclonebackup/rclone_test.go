@@ -0,0 +1,43 @@
+package rclonebackup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseList(t *testing.T) {
+	out := []byte(`[
+{"Path":"config-18-10-2022.tar.gz","Name":"config-18-10-2022.tar.gz","Size":1024,"ModTime":"2022-10-18T03:00:00.000000000Z","IsDir":false},
+{"Path":"config-other-18-10-2022.tar.gz","Name":"config-other-18-10-2022.tar.gz","Size":10,"ModTime":"2022-10-18T03:00:00Z","IsDir":false},
+{"Path":"config-19-10-2022.tar.gz.tmp","Name":"config-19-10-2022.tar.gz.tmp","Size":5,"ModTime":"2022-10-19T03:00:00Z","IsDir":false},
+{"Path":"notes.txt","Name":"notes.txt","Size":5,"ModTime":"2022-10-18T03:00:00Z","IsDir":false}
+]`)
+
+	objects, err := parseList(out, "config")
+	require.NoError(t, err)
+	require.Len(t, objects, 2, "partial uploads and other files should be ignored")
+	require.Equal(t, "config", objects[0].VolumeName)
+	require.Equal(t, int64(1024), objects[0].Size)
+	require.Equal(t, time.Date(2022, 10, 18, 3, 0, 0, 0, time.UTC), objects[0].LastModified)
+	require.Equal(t, "config-other", objects[1].VolumeName)
+
+	_, err = parseList([]byte("not json"), "")
+	require.Error(t, err)
+}
+
+func TestPath(t *testing.T) {
+	tests := []struct {
+		remote   string
+		expected string
+	}{
+		{"s3:bucket/backups", "s3:bucket/backups/config.tar.gz"},
+		{"s3:bucket/backups/", "s3:bucket/backups/config.tar.gz"},
+		{"gdrive:", "gdrive:config.tar.gz"},
+	}
+	for _, test := range tests {
+		b := NewBackend(Config{Remote: test.remote}, nil)
+		require.Equal(t, test.expected, b.path("config.tar.gz"))
+	}
+}
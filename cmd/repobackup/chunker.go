@@ -0,0 +1,76 @@
+package repobackup
+
+import (
+	"bufio"
+	"io"
+)
+
+const (
+	minChunkSize = 256 * 1024
+	maxChunkSize = 4 * 1024 * 1024
+
+	// chunkMask gives an average chunk size of roughly 1MiB. The top bits of the
+	// hash are used since they depend on the most recent 64 bytes.
+	chunkMask = uint64(1<<20-1) << 44
+)
+
+// gearTable maps each byte to a pseudo random value used by the rolling hash.
+// It must never change, otherwise existing chunks would no longer be matched.
+var gearTable = newGearTable()
+
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+	// splitmix64 with a fixed seed.
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// chunker splits a stream into content defined chunks using a gear hash, so that an insertion
+// or deletion only changes the chunks around it rather than every chunk after it.
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   bufio.NewReaderSize(r, maxChunkSize),
+		buf: make([]byte, 0, maxChunkSize),
+	}
+}
+
+// Next returns the next chunk, or io.EOF once the stream has been consumed.
+// The returned slice is only valid until the next call.
+func (c *chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+	for {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(c.buf) == 0 {
+				return nil, io.EOF
+			}
+			return c.buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c.buf = append(c.buf, b)
+		hash = (hash << 1) + gearTable[b]
+
+		if len(c.buf) >= maxChunkSize {
+			return c.buf, nil
+		}
+		if len(c.buf) >= minChunkSize && hash&chunkMask == 0 {
+			return c.buf, nil
+		}
+	}
+}
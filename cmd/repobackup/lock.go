@@ -0,0 +1,103 @@
+package repobackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+)
+
+const locksPrefix = "locks/"
+
+// staleLockAge is how long a lock is honoured for, so that a backup which crashed
+// without removing its lock does not block pruning forever.
+const staleLockAge = 24 * time.Hour
+
+// lock is written while a backup or prune is running. Backups take shared locks, pruning
+// takes an exclusive lock, as it deletes chunks which a running backup may be relying on.
+type lock struct {
+	ID        string    `json:"id"`
+	Exclusive bool      `json:"exclusive"`
+	Time      time.Time `json:"time"`
+}
+
+func lockKey(id string) string {
+	return fmt.Sprintf("%s%s.json", locksPrefix, id)
+}
+
+// locks returns every lock in the repository which is not stale.
+func (r *Repository) locks(now time.Time) ([]lock, error) {
+	keys, err := r.store.List(locksPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var locks []lock
+	for _, key := range keys {
+		if path.Ext(key) != ".json" {
+			continue
+		}
+		data, err := r.store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		var l lock
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, fmt.Errorf("failed reading lock %s: %s", key, err)
+		}
+		if now.Sub(l.Time) < staleLockAge {
+			locks = append(locks, l)
+		}
+	}
+	return locks, nil
+}
+
+// conflicting returns the first lock, other than own, which cannot be held at the same time.
+func (r *Repository) conflicting(own lock) (*lock, error) {
+	locks, err := r.locks(own.Time)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range locks {
+		if l.ID != own.ID && (own.Exclusive || l.Exclusive) {
+			return &l, nil
+		}
+	}
+	return nil, nil
+}
+
+// lock takes a lock on the repository and returns a function which releases it. The store has
+// no atomic create, so the locks are checked again after writing ours to catch a lock taken at
+// the same time.
+func (r *Repository) lock(exclusive bool) (func() error, error) {
+	own := lock{ID: newSnapshotID(), Exclusive: exclusive, Time: time.Now()}
+	if l, err := r.conflicting(own); err != nil || l != nil {
+		return nil, lockedError(l, err)
+	}
+
+	data, err := json.Marshal(own)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.store.Put(lockKey(own.ID), data); err != nil {
+		return nil, fmt.Errorf("failed storing lock: %s", err)
+	}
+	unlock := func() error {
+		return r.store.Delete(lockKey(own.ID))
+	}
+
+	if l, err := r.conflicting(own); err != nil || l != nil {
+		_ = unlock()
+		return nil, lockedError(l, err)
+	}
+	return unlock, nil
+}
+
+func lockedError(l *lock, err error) error {
+	if err != nil {
+		return err
+	}
+	if l.Exclusive {
+		return fmt.Errorf("repository is locked by a prune started at %s", l.Time.Format(time.RFC3339))
+	}
+	return fmt.Errorf("repository is locked by a backup started at %s", l.Time.Format(time.RFC3339))
+}
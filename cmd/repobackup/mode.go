@@ -0,0 +1,67 @@
+package repobackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// DefaultLocation is used when no repository is specified, it is inside the
+// mounted backups directory.
+const DefaultLocation = "/backups/repository"
+
+// Mode stores volumes in a deduplicated repository.
+type Mode struct {
+	// location is either a local directory or s3://bucket/prefix.
+	location string
+
+	// retainForDays is the number of days that snapshots should be stored for.
+	retainForDays int
+}
+
+func NewMode(location string, retainForDays int) *Mode {
+	if location == "" {
+		location = DefaultLocation
+	}
+	return &Mode{
+		location:      location,
+		retainForDays: retainForDays,
+	}
+}
+
+func (m *Mode) CrateBackup(ctx context.Context, cli *client.Client, mountPoint types.MountPoint) error {
+	log.Printf("performing repository backup to %s", m.location)
+	store, err := NewStore(m.location)
+	if err != nil {
+		return err
+	}
+	repo := NewRepository(store)
+
+	rc, err := dockerutil.ReadVolume(ctx, cli, mountPoint.Name)
+	if err != nil {
+		return fmt.Errorf("failed reading volume: %s", err)
+	}
+	defer rc.Close()
+
+	snapshot, newChunks, err := repo.Backup(mountPoint.Name, rc)
+	if err != nil {
+		return err
+	}
+	log.Printf("created snapshot %s of %s with %d chunks, %d new", snapshot.ID, snapshot.VolumeName, len(snapshot.Chunks), newChunks)
+
+	if m.retainForDays <= 0 {
+		return nil
+	}
+	result, err := repo.Prune(time.Now(), m.retainForDays)
+	if err != nil {
+		return fmt.Errorf("failed pruning repository: %s", err)
+	}
+	log.Printf("pruned %d snapshots and %d chunks", len(result.RemovedSnapshots), result.RemovedChunks)
+	return nil
+}
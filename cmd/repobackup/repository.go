@@ -0,0 +1,285 @@
+package repobackup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	chunksPrefix    = "chunks/"
+	snapshotsPrefix = "snapshots/"
+)
+
+// Snapshot is a single backup of a volume. The volume contents are the
+// concatenation of its chunks, which are shared between snapshots.
+type Snapshot struct {
+	ID         string    `json:"id"`
+	VolumeName string    `json:"volumeName"`
+	Time       time.Time `json:"time"`
+	// Size is the size of the uncompressed tar stream.
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks"`
+}
+
+// Repository stores each chunk once, identified by the sha256 of its contents.
+type Repository struct {
+	store Store
+}
+
+func NewRepository(store Store) *Repository {
+	return &Repository{store: store}
+}
+
+func chunkKey(hash string) string {
+	return fmt.Sprintf("%s%s/%s", chunksPrefix, hash[:2], hash)
+}
+
+func snapshotKey(id string) string {
+	return fmt.Sprintf("%s%s.json", snapshotsPrefix, id)
+}
+
+// Backup splits r into chunks, stores any chunks which do not already exist, and
+// saves a new snapshot of the volume.
+func (r *Repository) Backup(volumeName string, reader io.Reader) (Snapshot, int, error) {
+	unlock, err := r.lock(false)
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+	defer unlock()
+
+	snapshot := Snapshot{
+		ID:         newSnapshotID(),
+		VolumeName: volumeName,
+		Time:       time.Now(),
+	}
+
+	newChunks := 0
+	c := newChunker(reader)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Snapshot{}, 0, err
+		}
+
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		snapshot.Chunks = append(snapshot.Chunks, hash)
+		snapshot.Size += int64(len(chunk))
+
+		exists, err := r.store.Has(chunkKey(hash))
+		if err != nil {
+			return Snapshot{}, 0, err
+		}
+		if exists {
+			continue
+		}
+
+		compressed, err := compress(chunk)
+		if err != nil {
+			return Snapshot{}, 0, err
+		}
+		if err := r.store.Put(chunkKey(hash), compressed); err != nil {
+			return Snapshot{}, 0, fmt.Errorf("failed storing chunk %s: %s", hash, err)
+		}
+		newChunks++
+	}
+
+	// the snapshot is only written once all of its chunks exist.
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return Snapshot{}, 0, err
+	}
+	if err := r.store.Put(snapshotKey(snapshot.ID), data); err != nil {
+		return Snapshot{}, 0, fmt.Errorf("failed storing snapshot: %s", err)
+	}
+	return snapshot, newChunks, nil
+}
+
+// Restore writes the contents of the snapshot to w.
+func (r *Repository) Restore(snapshot Snapshot, w io.Writer) error {
+	for _, hash := range snapshot.Chunks {
+		chunk, err := r.readChunk(hash)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify reads every chunk of the snapshot and checks its hash, so that a restore can
+// fail before anything is overwritten.
+func (r *Repository) Verify(snapshot Snapshot) error {
+	for _, hash := range snapshot.Chunks {
+		if _, err := r.readChunk(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) readChunk(hash string) ([]byte, error) {
+	compressed, err := r.store.Get(chunkKey(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading chunk %s: %s", hash, err)
+	}
+	chunk, err := decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed decompressing chunk %s: %s", hash, err)
+	}
+	sum := sha256.Sum256(chunk)
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, fmt.Errorf("chunk %s is corrupt", hash)
+	}
+	return chunk, nil
+}
+
+// Snapshots returns every snapshot in the repository, newest first.
+func (r *Repository) Snapshots() ([]Snapshot, error) {
+	keys, err := r.store.List(snapshotsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	for _, key := range keys {
+		if path.Ext(key) != ".json" {
+			continue
+		}
+		data, err := r.store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		var s Snapshot
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("failed reading snapshot %s: %s", key, err)
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// FindSnapshot returns the snapshot with the given id. If id is empty, the newest
+// snapshot of the volume is returned.
+func (r *Repository) FindSnapshot(volumeName, id string) (Snapshot, error) {
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, s := range snapshots {
+		if id != "" && s.ID == id {
+			return s, nil
+		}
+		if id == "" && s.VolumeName == volumeName {
+			return s, nil
+		}
+	}
+	if id != "" {
+		return Snapshot{}, fmt.Errorf("snapshot %s not found", id)
+	}
+	return Snapshot{}, fmt.Errorf("no snapshots found for volume %s", volumeName)
+}
+
+// PruneResult holds what was removed from the repository when pruning.
+type PruneResult struct {
+	RemovedSnapshots []string `json:"removedSnapshots"`
+	RemovedChunks    int      `json:"removedChunks"`
+}
+
+// Prune removes snapshots older than retainForDays, always keeping the newest snapshot
+// of each volume, and then removes any chunks which are no longer referenced. It fails if a
+// backup is running, as its chunks are not referenced until its snapshot is written.
+func (r *Repository) Prune(now time.Time, retainForDays int) (PruneResult, error) {
+	result := PruneResult{RemovedSnapshots: []string{}}
+	unlock, err := r.lock(true)
+	if err != nil {
+		return result, err
+	}
+	defer unlock()
+
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return result, err
+	}
+
+	cutoff := now.AddDate(0, 0, -retainForDays)
+	seenVolumes := map[string]struct{}{}
+	referenced := map[string]struct{}{}
+	for _, s := range snapshots {
+		_, seen := seenVolumes[s.VolumeName]
+		seenVolumes[s.VolumeName] = struct{}{}
+		if seen && retainForDays > 0 && s.Time.Before(cutoff) {
+			if err := r.store.Delete(snapshotKey(s.ID)); err != nil {
+				return result, err
+			}
+			result.RemovedSnapshots = append(result.RemovedSnapshots, s.ID)
+			continue
+		}
+		for _, hash := range s.Chunks {
+			referenced[hash] = struct{}{}
+		}
+	}
+
+	keys, err := r.store.List(chunksPrefix)
+	if err != nil {
+		return result, err
+	}
+	for _, key := range keys {
+		if _, ok := referenced[path.Base(key)]; ok || strings.HasSuffix(key, "/") {
+			continue
+		}
+		if err := r.store.Delete(key); err != nil {
+			return result, err
+		}
+		result.RemovedChunks++
+	}
+	return result, nil
+}
+
+func newSnapshotID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return io.ReadAll(gr)
+}
@@ -0,0 +1,153 @@
+package repobackup
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func randomData(t *testing.T, seed int64, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	_, err := rand.New(rand.NewSource(seed)).Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+func newTestRepository(t *testing.T) (*Repository, Store) {
+	t.Helper()
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	return NewRepository(store), store
+}
+
+func TestChunker(t *testing.T) {
+	data := randomData(t, 1, 10*1024*1024)
+
+	var chunks [][]byte
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(chunk), maxChunkSize)
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+	require.Greater(t, len(chunks), 1)
+	require.Equal(t, data, bytes.Join(chunks, nil), "chunks should make up the original data")
+
+	t.Run("boundaries are content defined", func(t *testing.T) {
+		// inserting data at the start should not change the chunks after it.
+		shifted := append([]byte("inserted"), data...)
+		c := newChunker(bytes.NewReader(shifted))
+		var shiftedChunks [][]byte
+		for {
+			chunk, err := c.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			shiftedChunks = append(shiftedChunks, append([]byte{}, chunk...))
+		}
+		require.Equal(t, chunks[len(chunks)-1], shiftedChunks[len(shiftedChunks)-1])
+	})
+}
+
+func TestRepository(t *testing.T) {
+	repo, store := newTestRepository(t)
+	data := randomData(t, 2, 5*1024*1024)
+
+	first, newChunks, err := repo.Backup("volume-1", bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, len(first.Chunks), newChunks)
+	require.Equal(t, int64(len(data)), first.Size)
+
+	t.Run("unchanged data is deduplicated", func(t *testing.T) {
+		_, newChunks, err := repo.Backup("volume-1", bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Zero(t, newChunks)
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, repo.Restore(first, &buf))
+		require.Equal(t, data, buf.Bytes())
+	})
+
+	t.Run("find snapshot", func(t *testing.T) {
+		s, err := repo.FindSnapshot("volume-1", first.ID)
+		require.NoError(t, err)
+		require.Equal(t, first.ID, s.ID)
+
+		_, err = repo.FindSnapshot("volume-2", "")
+		require.Error(t, err)
+	})
+
+	t.Run("corrupt chunk", func(t *testing.T) {
+		corrupt, err := compress([]byte("corrupt"))
+		require.NoError(t, err)
+		require.NoError(t, store.Put(chunkKey(first.Chunks[0]), corrupt))
+		require.Error(t, repo.Verify(first))
+		require.Error(t, repo.Restore(first, io.Discard))
+	})
+}
+
+func TestPrune(t *testing.T) {
+	repo, store := newTestRepository(t)
+
+	old, _, err := repo.Backup("volume-1", bytes.NewReader(randomData(t, 3, 1024*1024)))
+	require.NoError(t, err)
+	newest, _, err := repo.Backup("volume-1", bytes.NewReader(randomData(t, 4, 1024*1024)))
+	require.NoError(t, err)
+
+	t.Run("within retention", func(t *testing.T) {
+		result, err := repo.Prune(time.Now(), 7)
+		require.NoError(t, err)
+		require.Empty(t, result.RemovedSnapshots)
+		require.Zero(t, result.RemovedChunks)
+	})
+
+	t.Run("expired snapshots and chunks removed", func(t *testing.T) {
+		result, err := repo.Prune(time.Now().AddDate(0, 0, 30), 7)
+		require.NoError(t, err)
+		require.Equal(t, []string{old.ID}, result.RemovedSnapshots, "newest snapshot of a volume should be kept")
+		require.Equal(t, len(old.Chunks), result.RemovedChunks)
+
+		keys, err := store.List(chunksPrefix)
+		require.NoError(t, err)
+		require.Len(t, keys, len(newest.Chunks))
+	})
+}
+
+func TestLock(t *testing.T) {
+	repo, store := newTestRepository(t)
+
+	unlock, err := repo.lock(false)
+	require.NoError(t, err)
+
+	t.Run("backups can run together", func(t *testing.T) {
+		_, _, err := repo.Backup("volume-1", bytes.NewReader(randomData(t, 5, 1024)))
+		require.NoError(t, err)
+	})
+
+	t.Run("prune fails while a backup is running", func(t *testing.T) {
+		_, err := repo.Prune(time.Now(), 7)
+		require.Error(t, err)
+	})
+
+	require.NoError(t, unlock())
+	_, err = repo.Prune(time.Now(), 7)
+	require.NoError(t, err)
+
+	t.Run("stale locks are ignored", func(t *testing.T) {
+		require.NoError(t, store.Put(lockKey("stale"), []byte(`{"id":"stale","exclusive":true,"time":"2000-01-01T00:00:00Z"}`)))
+		_, _, err := repo.Backup("volume-1", bytes.NewReader(randomData(t, 6, 1024)))
+		require.NoError(t, err)
+	})
+}
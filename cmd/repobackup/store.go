@@ -0,0 +1,190 @@
+package repobackup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"docker-volume-backup/cmd/s3backup"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Store is where the chunks and snapshots of a repository are kept.
+type Store interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Has(key string) (bool, error)
+	// List returns every key which starts with the given prefix.
+	List(prefix string) ([]string, error)
+	Delete(key string) error
+}
+
+// NewStore returns the store for a repository location. Locations starting with s3://bucket/prefix
+// are stored in s3 using the AWS_* environment variables, anything else is a local directory.
+func NewStore(location string) (Store, error) {
+	if strings.HasPrefix(location, "s3://") {
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("no bucket specified in repository location: %s", location)
+		}
+		return &s3Store{
+			svc:    s3.New(s3backup.NewSession()),
+			bucket: bucket,
+			prefix: strings.Trim(prefix, "/"),
+		}, nil
+	}
+	if location == "" {
+		return nil, fmt.Errorf("no repository location specified")
+	}
+	return &localStore{root: location}, nil
+}
+
+// localStore stores each key as a file relative to root.
+type localStore struct {
+	root string
+}
+
+func (l *localStore) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+func (l *localStore) Put(key string, data []byte) error {
+	p := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// write to a temporary file first so that a partially written key is never visible.
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (l *localStore) Get(key string) ([]byte, error) {
+	return os.ReadFile(l.path(key))
+}
+
+func (l *localStore) Has(key string) (bool, error) {
+	_, err := os.Stat(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *localStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (l *localStore) Delete(key string) error {
+	return os.Remove(l.path(key))
+}
+
+// s3Store stores each key as an object under prefix in the bucket.
+type s3Store struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *s3Store) Put(key string, data []byte) error {
+	_, err := s.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (s *s3Store) Get(key string) ([]byte, error) {
+	out, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (s *s3Store) Has(key string) (bool, error) {
+	_, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		var aerr awserr.RequestFailure
+		if errors.As(err, &aerr) && aerr.StatusCode() == 404 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *s3Store) List(prefix string) ([]string, error) {
+	var keys []string
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key(prefix)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			key := *obj.Key
+			if s.prefix != "" {
+				key = strings.TrimPrefix(key, s.prefix+"/")
+			}
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list items in bucket %s: %s", s.bucket, err)
+	}
+	return keys, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	return err
+}
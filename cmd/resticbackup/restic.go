@@ -0,0 +1,210 @@
+package resticbackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+)
+
+const (
+	defaultImage = "restic/restic:latest"
+
+	// hostname is used for every snapshot, so that snapshots are not split up by
+	// the random hostnames of the helper containers.
+	hostname = "docker-volume-backup"
+
+	volumeTagPrefix    = "volume="
+	containerTagPrefix = "container="
+)
+
+// Mode streams each volume into a restic repository. The repository and its credentials are
+// configured with the standard restic environment variables, e.g. RESTIC_REPOSITORY and
+// RESTIC_PASSWORD. Local repositories must be inside the backup host path, which is mounted
+// at /backups, e.g. RESTIC_REPOSITORY=/backups/restic.
+type Mode struct {
+	// hostPathForBackups is the path on the host which is mounted at /backups.
+	hostPathForBackups string
+
+	// retainForDays is the number of days that snapshots should be kept for.
+	retainForDays int
+}
+
+func NewMode(hostPath string, retainForDays int) *Mode {
+	return &Mode{
+		hostPathForBackups: hostPath,
+		retainForDays:      retainForDays,
+	}
+}
+
+func (m *Mode) CrateBackup(ctx context.Context, cli *client.Client, mountPoint types.MountPoint) error {
+	log.Println("performing restic backup")
+	if err := dockerutil.PullImage(ctx, cli, image()); err != nil {
+		return err
+	}
+
+	tags := []string{volumeTag(mountPoint.Name)}
+	containerNames, err := dockerutil.ContainersUsingVolume(ctx, cli, mountPoint.Name)
+	if err != nil {
+		return err
+	}
+	for _, name := range containerNames {
+		tags = append(tags, containerTagPrefix+name)
+	}
+
+	// the repository is initialized on the first backup.
+	script := "restic cat config > /dev/null 2>&1 || restic init"
+	script += fmt.Sprintf(" && restic backup /data --host %s --tag %s", hostname, shellQuote(strings.Join(tags, ",")))
+	if m.retainForDays > 0 {
+		script += fmt.Sprintf(" && restic forget --host %s --tag %s --keep-within %dd --prune", hostname, shellQuote(volumeTag(mountPoint.Name)), m.retainForDays)
+	}
+
+	_, err = run(ctx, cli, []string{"/bin/sh", "-c", script}, m.hostPathForBackups, mountPoint.Name)
+	return err
+}
+
+// Snapshot is a restic snapshot of a volume.
+type Snapshot struct {
+	ID         string    `json:"id"`
+	ShortID    string    `json:"short_id"`
+	Time       time.Time `json:"time"`
+	Paths      []string  `json:"paths"`
+	Hostname   string    `json:"hostname"`
+	Tags       []string  `json:"tags"`
+	VolumeName string    `json:"volumeName"`
+	Containers []string  `json:"containers"`
+}
+
+// ListSnapshots returns the snapshots of all volumes, newest first. If volumeName is not empty,
+// only the snapshots of that volume are returned.
+func ListSnapshots(ctx context.Context, cli *client.Client, hostPathForBackups, volumeName string) ([]Snapshot, error) {
+	if err := dockerutil.PullImage(ctx, cli, image()); err != nil {
+		return nil, err
+	}
+	cmd := []string{"restic", "snapshots", "--json", "--host", hostname}
+	if volumeName != "" {
+		cmd = append(cmd, "--tag", volumeTag(volumeName))
+	}
+	out, err := run(ctx, cli, cmd, hostPathForBackups, "")
+	if err != nil {
+		return nil, err
+	}
+	return parseSnapshots(out)
+}
+
+func parseSnapshots(out []byte) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	if err := json.Unmarshal(out, &snapshots); err != nil {
+		return nil, fmt.Errorf("failed parsing restic snapshots: %s", err)
+	}
+	result := []Snapshot{}
+	for _, s := range snapshots {
+		for _, tag := range s.Tags {
+			if strings.HasPrefix(tag, volumeTagPrefix) {
+				s.VolumeName = strings.TrimPrefix(tag, volumeTagPrefix)
+			}
+			if strings.HasPrefix(tag, containerTagPrefix) {
+				s.Containers = append(s.Containers, strings.TrimPrefix(tag, containerTagPrefix))
+			}
+		}
+		// snapshots which were not created by docker-volume-backup are ignored.
+		if s.VolumeName == "" {
+			continue
+		}
+		result = append(result, s)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.After(result[j].Time)
+	})
+	return result, nil
+}
+
+// Restore replaces the contents of the volume with the given snapshot. If snapshotID is empty,
+// the newest snapshot of the volume is restored.
+func Restore(ctx context.Context, cli *client.Client, hostPathForBackups, volumeName, snapshotID string) error {
+	if err := dockerutil.PullImage(ctx, cli, image()); err != nil {
+		return err
+	}
+	if snapshotID == "" {
+		snapshotID = "latest"
+	}
+	script := restoreScript(snapshotID, volumeName)
+	_, err := run(ctx, cli, []string{"/bin/sh", "-c", script}, hostPathForBackups, volumeName)
+	return err
+}
+
+// restoreScript restores the snapshot into the staging directory of the volume, and only once that
+// succeeded replaces the current contents of the volume with it. Snapshots contain the /data
+// directory, so the files end up in the data directory of the staging directory.
+func restoreScript(snapshotID, volumeName string) string {
+	return fmt.Sprintf(`rm -rf %[1]s
+if ! restic restore %[2]s --host %[3]s --tag %[4]s --target %[1]s; then
+	rm -rf %[1]s
+	exit 1
+fi
+`, dockerutil.StagingDir, shellQuote(snapshotID), hostname, shellQuote(volumeTag(volumeName))) + dockerutil.ReplaceWithStagedScript
+}
+
+// run runs the command in a restic container with the backups directory mounted at /backups, and
+// the given volume mounted at /data if it is not empty.
+func run(ctx context.Context, cli *client.Client, cmd []string, hostPathForBackups, volumeName string) ([]byte, error) {
+	var mounts []mount.Mount
+	if hostPathForBackups != "" {
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeBind,
+			Source: hostPathForBackups,
+			Target: "/backups",
+		})
+	}
+	if volumeName != "" {
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: volumeName,
+			Target: "/data",
+		})
+	}
+	return dockerutil.RunContainer(ctx, cli, &container.Config{
+		Image: image(),
+		// the image entrypoint is restic itself, which is replaced to allow running scripts.
+		Entrypoint: cmd,
+		Env:        resticEnv(),
+	}, mounts)
+}
+
+// resticEnv returns the environment variables which are passed through to restic.
+func resticEnv() []string {
+	var env []string
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "RESTIC_") || strings.HasPrefix(e, "AWS_") || strings.HasPrefix(e, "RCLONE_") {
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
+// image returns the restic image, which can be overridden with RESTIC_IMAGE.
+func image() string {
+	if img, ok := os.LookupEnv("RESTIC_IMAGE"); ok {
+		return img
+	}
+	return defaultImage
+}
+
+func volumeTag(volumeName string) string {
+	return volumeTagPrefix + volumeName
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
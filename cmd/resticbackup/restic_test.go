@@ -0,0 +1,49 @@
+package resticbackup
+
+import (
+	"strings"
+	"testing"
+
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+const snapshotsJSON = `[
+  {"time":"2022-10-14T03:00:00Z","paths":["/data"],"hostname":"docker-volume-backup","tags":["volume=config","container=audiobookshelf"],"id":"aaaa","short_id":"aa"},
+  {"time":"2022-10-15T03:00:00Z","paths":["/data"],"hostname":"docker-volume-backup","tags":["volume=config","container=audiobookshelf"],"id":"bbbb","short_id":"bb"},
+  {"time":"2022-10-15T04:00:00Z","paths":["/home"],"hostname":"laptop","id":"cccc","short_id":"cc"}
+]`
+
+func TestParseSnapshots(t *testing.T) {
+	snapshots, err := parseSnapshots([]byte(snapshotsJSON))
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2, "snapshots without a volume tag should be ignored")
+
+	t.Run("newest first", func(t *testing.T) {
+		require.Equal(t, "bbbb", snapshots[0].ID)
+		require.Equal(t, "aaaa", snapshots[1].ID)
+	})
+
+	t.Run("tags", func(t *testing.T) {
+		require.Equal(t, "config", snapshots[0].VolumeName)
+		require.Equal(t, []string{"audiobookshelf"}, snapshots[0].Containers)
+	})
+
+	t.Run("invalid output", func(t *testing.T) {
+		_, err := parseSnapshots([]byte("Fatal: unable to open config file"))
+		require.Error(t, err)
+	})
+}
+
+func TestShellQuote(t *testing.T) {
+	require.Equal(t, `'volume=it'\''s'`, shellQuote("volume=it's"))
+}
+
+func TestRestoreScript(t *testing.T) {
+	script := restoreScript("latest", "config")
+	restore := strings.Index(script, "restic restore 'latest' --host docker-volume-backup --tag 'volume=config' --target "+dockerutil.StagingDir)
+	wipe := strings.Index(script, "find /data -mindepth 1")
+	require.NotEqual(t, -1, restore)
+	require.Greater(t, wipe, restore, "the volume should only be emptied after the snapshot was restored")
+}
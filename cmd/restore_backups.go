@@ -1,54 +1,149 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"docker-volume-backup/cmd/util/collectionutil"
+	"docker-volume-backup/cmd/util/dockerutil"
 
+	"github.com/docker/docker/client"
 	"github.com/spf13/cobra"
 )
 
 func init() {
 	restoreBackupsCommand.Flags().String("host-path", "", "backup host path")
+	restoreBackupsCommand.Flags().Bool(s3Mode, false, "look in s3 for backups")
+	restoreBackupsCommand.Flags().String(fromFlag, "", "storage backend to restore from, e.g. sftp")
+	restoreBackupsCommand.Flags().Int(parallelFlag, 4, "number of archives downloaded at the same time from s3 or a storage backend")
 	restoreBackupsCommand.Flags().String("volumes", "", "comma separated list of volumes to restore, default to all found volumes")
-	if err := restoreBackupsCommand.MarkFlagRequired("host-path"); err != nil {
-		panic(err)
-	}
+	restoreBackupsCommand.Flags().Bool(noStopFlag, false, "do not stop the containers using volumes while restoring into them")
+	restoreBackupsCommand.Flags().Bool(noSafetySnapshotFlag, false, "do not snapshot the current contents of volumes before restoring, a failed restore can not be rolled back")
+	restoreBackupsCommand.Flags().Bool(dryRunFlag, false, "print the volumes which would be restored, whether they exist and which containers use them, without restoring them")
+	restoreBackupsCommand.Flags().String(ifExistsFlag, ifExistsOverwrite, "what to do with volumes which already exist: skip, fail or overwrite")
+	addPointInTimeFlags(restoreBackupsCommand)
+	addVolumeOverrideFlags(restoreBackupsCommand)
+	restoreBackupsCommand.MarkFlagsMutuallyExclusive(dryRunFlag, previewFlag)
+	restoreBackupsCommand.MarkFlagsMutuallyExclusive("host-path", s3Mode, fromFlag)
 	rootCmd.AddCommand(restoreBackupsCommand)
 }
 
+const (
+	dryRunFlag   = "dry-run"
+	ifExistsFlag = "if-exists"
+	parallelFlag = "parallel"
+
+	// ifExistsOverwrite restores into volumes which already exist.
+	ifExistsOverwrite = "overwrite"
+	// ifExistsSkip only restores volumes which do not exist yet.
+	ifExistsSkip = "skip"
+	// ifExistsFail restores nothing if any of the volumes already exists.
+	ifExistsFail = "fail"
+)
+
 type backupRestoreArgs struct {
-	hostPath string
+	source   backupSource
+	parallel int
 	volumes  []string
+	opts     restoreOptions
+	pit      pointInTime
+	preview  bool
+	dryRun   bool
+	ifExists string
 }
 
 // restoreBackupsCommand restores backups.
 var restoreBackupsCommand = &cobra.Command{
 	Use:   "restore-backups",
 	Short: "restore existing backups",
-	Long: `Restore backups from a directory.
+	Long: `Restore backups from a directory, s3 or a storage backend.
 
-Specify a directory where backups are located (host-path) and a comma separated
-list of volumes (vol1,vol2,vol3) etc. 
+Specify where backups are located (host-path, s3 or from) and a comma separated
+list of volumes (vol1,vol2,vol3) etc. Archives in s3 and storage backends are
+downloaded in parallel while the volumes are restored one after the other.
 
 Docker volumes will be created from all of the backups. If there are multiple backups
-of the same volume, the newest will be chosen.
+of the same volume, the newest will be chosen. Use --at or --before to choose the newest
+backup of each volume which is not after (or strictly before) a point in time instead, and
+--preview to print which backups would be restored without restoring them.
+
+Volumes which already exist are overwritten, use --if-exists=skip to leave them as they
+are or --if-exists=fail to restore nothing if any of them exists. --dry-run prints what
+would happen to each volume without restoring anything.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		hostDir, err := cmd.Flags().GetString("host-path")
 		if err != nil {
 			panic(err)
 		}
+		useS3, err := cmd.Flags().GetBool(s3Mode)
+		if err != nil {
+			panic(err)
+		}
+		from, err := cmd.Flags().GetString(fromFlag)
+		if err != nil {
+			panic(err)
+		}
+		source := backupSource{hostPath: hostDir, s3: useS3, from: from}
+		if source == (backupSource{}) {
+			panic(fmt.Errorf("one of --%s, --%s or --%s is required", hostPathFlag, s3Mode, fromFlag))
+		}
+		parallel, err := cmd.Flags().GetInt(parallelFlag)
+		if err != nil {
+			panic(err)
+		}
+		if parallel < 1 {
+			panic(fmt.Errorf("--%s must be at least 1", parallelFlag))
+		}
 		volumes, err := cmd.Flags().GetString("volumes")
 		if err != nil {
 			panic(err)
 		}
+		noSafetySnapshot, err := cmd.Flags().GetBool(noSafetySnapshotFlag)
+		if err != nil {
+			panic(err)
+		}
+		noStop, err := cmd.Flags().GetBool(noStopFlag)
+		if err != nil {
+			panic(err)
+		}
+		overrides, err := getVolumeOverrides(cmd)
+		if err != nil {
+			panic(err)
+		}
+		pit, err := getPointInTime(cmd)
+		if err != nil {
+			panic(err)
+		}
+		preview, err := cmd.Flags().GetBool(previewFlag)
+		if err != nil {
+			panic(err)
+		}
+		dryRun, err := cmd.Flags().GetBool(dryRunFlag)
+		if err != nil {
+			panic(err)
+		}
+		ifExists, err := cmd.Flags().GetString(ifExistsFlag)
+		if err != nil {
+			panic(err)
+		}
+		if ifExists != ifExistsOverwrite && ifExists != ifExistsSkip && ifExists != ifExistsFail {
+			panic(fmt.Errorf("invalid --%s %q, expected %s, %s or %s", ifExistsFlag, ifExists, ifExistsSkip, ifExistsFail, ifExistsOverwrite))
+		}
 		backupArgs := backupRestoreArgs{
-			hostPath: hostDir,
+			source:   source,
+			parallel: parallel,
 			volumes:  strings.Split(volumes, ","),
+			opts:     restoreOptions{noSafetySnapshot: noSafetySnapshot, noStop: noStop, volume: overrides},
+			pit:      pit,
+			preview:  preview,
+			dryRun:   dryRun,
+			ifExists: ifExists,
 		}
 		if err := cmdRestoreBackup(backupArgs); err != nil {
 			panic(err)
@@ -63,38 +158,74 @@ type restoreOutput struct {
 }
 
 func cmdRestoreBackup(args backupRestoreArgs) error {
-	allBackups, err := getAllVolumeBackups(args.hostPath, "", false)
+	ctx := context.Background()
+	allBackups, err := args.source.listBackups(ctx)
 	if err != nil {
 		return err
 	}
+	selected := selectNewestBackups(allBackups, args.volumes, args.pit, args.source.backupID)
+	if args.preview {
+		return printPreview(selected)
+	}
 
-	volumesBackedUp := map[string]struct{}{}
-	// only backup volumes that have been specified if any.
-	if len(args.volumes) > 0 && args.volumes[0] != "" {
-		var volumesToBackup []backedUpVolume
-		for _, b := range allBackups {
-			if collectionutil.Contains(args.volumes, b.VolumeName) {
-				volumesToBackup = append(volumesToBackup, b)
-			}
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+	plans, err := planRestore(ctx, cli, selected, args.ifExists)
+	if err != nil {
+		return err
+	}
+	if args.dryRun {
+		if err := addVolumeSizes(ctx, cli, plans); err != nil {
+			return err
 		}
-		allBackups = volumesToBackup
+		bytes, err := json.Marshal(plans)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+	// nothing is restored if any volume fails, so that volumes are not left from different backups.
+	var existing []string
+	for _, p := range plans {
+		if p.Action == restoreActionFail {
+			existing = append(existing, p.VolumeName)
+		}
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("volumes already exist: %s, use --%s=%s or --%s=%s to restore anyway", strings.Join(existing, ", "), ifExistsFlag, ifExistsSkip, ifExistsFlag, ifExistsOverwrite)
 	}
 
-	result := []restoreOutput{}
-	for _, b := range allBackups {
-		_, alreadyRestored := volumesBackedUp[b.VolumeName]
-		if alreadyRestored {
+	var toRestore []restorePlan
+	for _, p := range plans {
+		if p.Action == restoreActionSkip {
+			log.Printf("skipping %s, the volume already exists", p.VolumeName)
 			continue
 		}
-		if err := cmdRestoreVolumeFromArchive(b.AbsoluteFilePath, b.VolumeName); err != nil {
+		toRestore = append(toRestore, p)
+	}
+
+	result := []restoreOutput{}
+	keys := make([]string, len(toRestore))
+	for i, p := range toRestore {
+		keys[i] = p.RestoreFrom
+	}
+	err = restoreDownloaded(ctx, keys, args.parallel, args.source.download, func(i int, archivePath string) error {
+		b := toRestore[i]
+		if err := cmdRestoreVolumeFromArchive(archivePath, b.VolumeName, args.opts); err != nil {
 			return err
 		}
-		volumesBackedUp[b.VolumeName] = struct{}{}
 		result = append(result, restoreOutput{
-			RestoredFrom: b.AbsoluteFilePath,
+			RestoredFrom: b.RestoreFrom,
 			VolumeName:   b.VolumeName,
 			RestoreTime:  time.Now(),
 		})
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	bytes, err := json.Marshal(result)
@@ -104,3 +235,159 @@ func cmdRestoreBackup(args backupRestoreArgs) error {
 	fmt.Println(string(bytes))
 	return nil
 }
+
+const (
+	restoreActionCreate    = "create"
+	restoreActionOverwrite = "overwrite"
+	restoreActionSkip      = "skip"
+	restoreActionFail      = "fail"
+)
+
+// restorePlan describes what a restore does with a volume.
+type restorePlan struct {
+	VolumeName  string    `json:"volumeName"`
+	RestoreFrom string    `json:"restoreFrom"`
+	BackupTime  time.Time `json:"backupTime"`
+	Exists      bool      `json:"exists"`
+	// Size is the disk space currently used by the volume in bytes, -1 if its driver does not
+	// report it. It is only set by --dry-run.
+	Size *int64 `json:"size,omitempty"`
+	// Containers are the names of the containers which mount the volume.
+	Containers []string `json:"containers,omitempty"`
+	// Action is one of create, overwrite, skip or fail.
+	Action string `json:"action"`
+}
+
+// planRestore returns what restoring the selected backups does with each volume, given the
+// --if-exists policy.
+func planRestore(ctx context.Context, cli *client.Client, selected []restorePreview, ifExists string) ([]restorePlan, error) {
+	plans := []restorePlan{}
+	for _, b := range selected {
+		plan := restorePlan{
+			VolumeName:  b.VolumeName,
+			RestoreFrom: b.RestoreFrom,
+			BackupTime:  b.BackupTime,
+			Action:      restoreActionCreate,
+		}
+		_, err := cli.VolumeInspect(ctx, b.VolumeName)
+		if err != nil && !client.IsErrNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			plan.Exists = true
+			// each policy is named after its action.
+			plan.Action = ifExists
+			if plan.Containers, err = dockerutil.ContainersUsingVolume(ctx, cli, b.VolumeName); err != nil {
+				return nil, err
+			}
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// addVolumeSizes sets the current size of the volumes which exist.
+func addVolumeSizes(ctx context.Context, cli *client.Client, plans []restorePlan) error {
+	sizes, err := dockerutil.VolumeSizes(ctx, cli)
+	if err != nil {
+		return err
+	}
+	for i := range plans {
+		if size, ok := sizes[plans[i].VolumeName]; ok && plans[i].Exists {
+			plans[i].Size = &size
+		}
+	}
+	return nil
+}
+
+// selectNewestBackups returns the newest selected backup of each volume, or of each of volumes if any
+// are given. backups must be sorted newest first, id returns the id of a backup from its path or key.
+func selectNewestBackups(backups []restorePreview, volumes []string, p pointInTime, id func(pathOrKey string) string) []restorePreview {
+	filterVolumes := len(volumes) > 0 && volumes[0] != ""
+	volumesBackedUp := map[string]struct{}{}
+	selected := []restorePreview{}
+	for _, b := range backups {
+		if filterVolumes && !collectionutil.Contains(volumes, b.VolumeName) {
+			continue
+		}
+		_, alreadySelected := volumesBackedUp[b.VolumeName]
+		// backups are sorted newest first, so the first selected backup of a volume is the one to restore.
+		if alreadySelected || !p.selects(id(b.RestoreFrom), b.BackupTime) {
+			continue
+		}
+		volumesBackedUp[b.VolumeName] = struct{}{}
+		selected = append(selected, b)
+	}
+	return selected
+}
+
+// downloadResult is an archive downloaded by restoreDownloaded.
+type downloadResult struct {
+	path    string
+	cleanup func()
+	err     error
+}
+
+// restoreDownloaded downloads the archives at the given paths or keys, with at most parallel downloads
+// at a time, and calls restore with the index and local path of each archive in order. Archives are
+// downloaded ahead while earlier archives are restored, and removed once restored, so that at most
+// parallel archives are kept on disk.
+func restoreDownloaded(ctx context.Context, keys []string, parallel int, download func(ctx context.Context, pathOrKey string) (string, func(), error), restore func(i int, archivePath string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	// slots limits the archives which are being downloaded or waiting to be restored.
+	slots := make(chan struct{}, parallel)
+	results := make([]chan downloadResult, len(keys))
+	for i := range results {
+		results[i] = make(chan downloadResult, 1)
+	}
+
+	var downloads sync.WaitGroup
+	launched := make(chan struct{})
+	go func() {
+		defer close(launched)
+		for i, key := range keys {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			downloads.Add(1)
+			go func(i int, key string) {
+				defer downloads.Done()
+				path, cleanup, err := download(ctx, key)
+				results[i] <- downloadResult{path: path, cleanup: cleanup, err: err}
+			}(i, key)
+		}
+	}()
+
+	next := 0
+	// when a restore fails, the remaining downloads are cancelled and whatever they downloaded removed.
+	defer func() {
+		cancel()
+		<-launched
+		downloads.Wait()
+		for _, r := range results[next:] {
+			select {
+			case d := <-r:
+				if d.err == nil {
+					d.cleanup()
+				}
+			default:
+			}
+		}
+	}()
+
+	for ; next < len(keys); next++ {
+		d := <-results[next]
+		if d.err != nil {
+			return d.err
+		}
+		err := restore(next, d.path)
+		d.cleanup()
+		<-slots
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectNewestBackups(t *testing.T) {
+	day := time.Date(2022, 10, 15, 3, 0, 0, 0, time.UTC)
+	backups := []restorePreview{
+		{VolumeName: "config", RestoreFrom: "config-15-10-2022.tar.gz", BackupTime: day},
+		{VolumeName: "data", RestoreFrom: "data-15-10-2022.tar.gz", BackupTime: day},
+		{VolumeName: "config", RestoreFrom: "config-14-10-2022.tar.gz", BackupTime: day.AddDate(0, 0, -1)},
+		{VolumeName: "data", RestoreFrom: "data-13-10-2022.tar.gz", BackupTime: day.AddDate(0, 0, -2)},
+	}
+	id := func(key string) string {
+		return key
+	}
+	keys := func(selected []restorePreview) []string {
+		var result []string
+		for _, b := range selected {
+			result = append(result, b.RestoreFrom)
+		}
+		return result
+	}
+
+	require.Equal(t, []string{"config-15-10-2022.tar.gz", "data-15-10-2022.tar.gz"}, keys(selectNewestBackups(backups, []string{""}, pointInTime{}, id)))
+	require.Equal(t, []string{"data-15-10-2022.tar.gz"}, keys(selectNewestBackups(backups, []string{"data"}, pointInTime{}, id)))
+	require.Equal(t, []string{"config-14-10-2022.tar.gz", "data-13-10-2022.tar.gz"}, keys(selectNewestBackups(backups, nil, pointInTime{at: day, before: true}, id)))
+	require.Empty(t, selectNewestBackups(backups, nil, pointInTime{backupID: "missing"}, id))
+}
+
+func TestRestoreDownloaded(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+
+	// fakeDownloads records the downloads which are on disk at the same time.
+	type fakeDownloads struct {
+		mu      sync.Mutex
+		onDisk  map[string]struct{}
+		maxDisk int
+	}
+	newDownload := func(f *fakeDownloads, fail string) func(context.Context, string) (string, func(), error) {
+		return func(ctx context.Context, key string) (string, func(), error) {
+			if key == fail {
+				return "", nil, errors.New("download failed")
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.onDisk[key] = struct{}{}
+			if len(f.onDisk) > f.maxDisk {
+				f.maxDisk = len(f.onDisk)
+			}
+			return "/tmp/" + key, func() {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				delete(f.onDisk, key)
+			}, nil
+		}
+	}
+
+	t.Run("restores in order with bounded downloads", func(t *testing.T) {
+		f := &fakeDownloads{onDisk: map[string]struct{}{}}
+		var restored []string
+		err := restoreDownloaded(context.Background(), keys, 2, newDownload(f, ""), func(i int, archivePath string) error {
+			require.Equal(t, "/tmp/"+keys[i], archivePath)
+			restored = append(restored, keys[i])
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, keys, restored)
+		require.LessOrEqual(t, f.maxDisk, 2)
+		require.Empty(t, f.onDisk)
+	})
+
+	t.Run("failed download", func(t *testing.T) {
+		f := &fakeDownloads{onDisk: map[string]struct{}{}}
+		var restored []string
+		err := restoreDownloaded(context.Background(), keys, 3, newDownload(f, "c"), func(i int, archivePath string) error {
+			restored = append(restored, keys[i])
+			return nil
+		})
+		require.Error(t, err)
+		require.Equal(t, []string{"a", "b"}, restored)
+		require.Empty(t, f.onDisk)
+	})
+
+	t.Run("failed restore", func(t *testing.T) {
+		f := &fakeDownloads{onDisk: map[string]struct{}{}}
+		err := restoreDownloaded(context.Background(), keys, 4, newDownload(f, ""), func(i int, archivePath string) error {
+			return fmt.Errorf("restoring %s failed", keys[i])
+		})
+		require.EqualError(t, err, "restoring a failed")
+		require.Empty(t, f.onDisk)
+	})
+}
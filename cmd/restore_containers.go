@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"context"
+	"log"
+
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/client"
+)
+
+// safeRestore runs restore with the containers using the volume stopped, and with a safety snapshot
+// of the volume to roll back to if restore fails.
+func safeRestore(ctx context.Context, cli *client.Client, volumeName string, opts restoreOptions, restore func() error) error {
+	return withStoppedContainers(ctx, cli, volumeName, opts, func() error {
+		return withSafetySnapshot(ctx, cli, volumeName, opts, restore)
+	})
+}
+
+// withStoppedContainers stops the running containers which mount the volume, so that data is not
+// restored underneath a live application, runs restore, and then starts the containers again in
+// dependency order. The containers are started again even if restore fails.
+func withStoppedContainers(ctx context.Context, cli *client.Client, volumeName string, opts restoreOptions, restore func() error) error {
+	if opts.noStop {
+		return restore()
+	}
+	stopped, err := dockerutil.StopContainersUsingVolume(ctx, cli, volumeName)
+	defer func() {
+		if err := dockerutil.StartContainers(ctx, cli, stopped); err != nil {
+			log.Println(err)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	return restore()
+}
@@ -0,0 +1,378 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/s3backup"
+	"docker-volume-backup/cmd/storage"
+	"docker-volume-backup/cmd/util/archiveutil"
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/client"
+	"github.com/spf13/cobra"
+)
+
+const (
+	pathFlag       = "path"
+	intoVolumeFlag = "into-volume"
+)
+
+func init() {
+	restoreFilesCommand.Flags().String(volumeFlag, "", "name of the volume whose backup contains the files")
+	restoreFilesCommand.Flags().StringSlice(pathFlag, nil, "path of a file or directory in the volume to restore, can be repeated")
+	restoreFilesCommand.Flags().String(toFlag, "", "host directory to restore the files into")
+	restoreFilesCommand.Flags().Bool(intoVolumeFlag, false, "restore the files into the volume, keeping every other file")
+	restoreFilesCommand.Flags().String(archiveFlag, "", "host path to archive")
+	restoreFilesCommand.Flags().String(hostPathFlag, "", "backup host path containing archives")
+	restoreFilesCommand.Flags().Bool(s3Mode, false, "look in s3 for backup")
+	restoreFilesCommand.Flags().String(fromFlag, "", "storage backend to restore from, e.g. sftp")
+	addPointInTimeFlags(restoreFilesCommand)
+	if err := restoreFilesCommand.MarkFlagRequired(volumeFlag); err != nil {
+		panic(err)
+	}
+	if err := restoreFilesCommand.MarkFlagRequired(pathFlag); err != nil {
+		panic(err)
+	}
+	restoreFilesCommand.MarkFlagsMutuallyExclusive(toFlag, intoVolumeFlag)
+	restoreFilesCommand.MarkFlagsMutuallyExclusive(archiveFlag, hostPathFlag, s3Mode, fromFlag)
+	rootCmd.AddCommand(restoreFilesCommand)
+}
+
+type restoreFilesArgs struct {
+	volumeName string
+	paths      []string
+	to         string
+	intoVolume bool
+	source     backupSource
+	pit        pointInTime
+	preview    bool
+}
+
+type restoreFilesOutput struct {
+	RestoredFrom string    `json:"restoredFrom"`
+	VolumeName   string    `json:"volumeName"`
+	Paths        []string  `json:"paths,omitempty"`
+	RestoredTo   string    `json:"restoredTo"`
+	Entries      int       `json:"entries"`
+	RestoreTime  time.Time `json:"restoreTime"`
+}
+
+// restoreFilesCommand restores individual files or directories of a volume.
+var restoreFilesCommand = &cobra.Command{
+	Use:   "restore-files",
+	Short: "restore individual files or directories of a volume.",
+	Long: `Restores individual files or directories from a backup of a volume.
+
+The matching entries are extracted from the archive while it is read, either into a host
+directory (--to) or back into the volume (--into-volume). Unlike restore-volume, every other
+file of the volume is kept.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		volumeName, err := cmd.Flags().GetString(volumeFlag)
+		if err != nil {
+			panic(err)
+		}
+		paths, err := cmd.Flags().GetStringSlice(pathFlag)
+		if err != nil {
+			panic(err)
+		}
+		to, err := cmd.Flags().GetString(toFlag)
+		if err != nil {
+			panic(err)
+		}
+		intoVolume, err := cmd.Flags().GetBool(intoVolumeFlag)
+		if err != nil {
+			panic(err)
+		}
+		source, err := getBackupSource(cmd)
+		if err != nil {
+			panic(err)
+		}
+		pit, err := getPointInTime(cmd)
+		if err != nil {
+			panic(err)
+		}
+		preview, err := cmd.Flags().GetBool(previewFlag)
+		if err != nil {
+			panic(err)
+		}
+		if err := cmdRestoreFiles(restoreFilesArgs{
+			volumeName: volumeName,
+			paths:      paths,
+			to:         to,
+			intoVolume: intoVolume,
+			source:     source,
+			pit:        pit,
+			preview:    preview,
+		}); err != nil {
+			panic(err)
+		}
+	},
+}
+
+func cmdRestoreFiles(args restoreFilesArgs) error {
+	if args.to == "" && !args.intoVolume && !args.preview {
+		return fmt.Errorf("either --%s or --%s is required", toFlag, intoVolumeFlag)
+	}
+
+	ctx := context.TODO()
+	selected, err := args.source.selectBackup(ctx, args.volumeName, args.pit)
+	if err != nil {
+		return err
+	}
+	if args.preview {
+		return printPreview([]restorePreview{selected})
+	}
+
+	r, err := args.source.open(ctx, selected.RestoreFrom)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var n int
+	restoredTo := args.to
+	if args.intoVolume {
+		restoredTo = args.volumeName
+		n, err = mergeFilesIntoVolume(ctx, r, args.paths, args.volumeName)
+	} else {
+		if err := os.MkdirAll(args.to, 0o755); err != nil {
+			return err
+		}
+		n, err = archiveutil.Extract(r, args.to, args.paths)
+	}
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no files matching %v found in %s", args.paths, selected.RestoreFrom)
+	}
+
+	bytes, err := json.Marshal(restoreFilesOutput{
+		RestoredFrom: selected.RestoreFrom,
+		VolumeName:   args.volumeName,
+		Paths:        args.paths,
+		RestoredTo:   restoredTo,
+		Entries:      n,
+		RestoreTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+// mergeFilesIntoVolume copies the entries of the archive matching paths into the volume.
+func mergeFilesIntoVolume(ctx context.Context, r io.Reader, paths []string, volumeName string) (int, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return 0, err
+	}
+	if err := dockerutil.PullImage(ctx, cli, "busybox:latest"); err != nil {
+		return 0, err
+	}
+
+	pr, pw := io.Pipe()
+	type filterResult struct {
+		n   int
+		err error
+	}
+	resultC := make(chan filterResult, 1)
+	go func() {
+		n, err := archiveutil.Filter(r, paths, pw)
+		pw.CloseWithError(err)
+		resultC <- filterResult{n: n, err: err}
+	}()
+	err = dockerutil.MergeIntoVolume(ctx, cli, volumeName, pr)
+	// unblock the filter if the copy failed before reading everything.
+	_ = pr.CloseWithError(err)
+	result := <-resultC
+	if err != nil {
+		return 0, err
+	}
+	return result.n, result.err
+}
+
+// backupSource is where an archive is read from, exactly one of its fields is set.
+type backupSource struct {
+	archive  string
+	hostPath string
+	s3       bool
+	from     string
+}
+
+func getBackupSource(cmd *cobra.Command) (backupSource, error) {
+	var source backupSource
+	var err error
+	if source.archive, err = cmd.Flags().GetString(archiveFlag); err != nil {
+		return source, err
+	}
+	if source.hostPath, err = cmd.Flags().GetString(hostPathFlag); err != nil {
+		return source, err
+	}
+	if source.s3, err = cmd.Flags().GetBool(s3Mode); err != nil {
+		return source, err
+	}
+	if source.from, err = cmd.Flags().GetString(fromFlag); err != nil {
+		return source, err
+	}
+	if source == (backupSource{}) {
+		return source, fmt.Errorf("one of --%s, --%s, --%s or --%s is required", archiveFlag, hostPathFlag, s3Mode, fromFlag)
+	}
+	return source, nil
+}
+
+// selectBackup selects a backup of the volume, RestoreFrom is the path or key to open.
+func (s backupSource) selectBackup(ctx context.Context, volumeName string, p pointInTime) (restorePreview, error) {
+	switch {
+	case s.archive != "":
+		if p != (pointInTime{}) {
+			return restorePreview{}, fmt.Errorf("--%s, --%s and --%s can not be used with --%s", atFlag, beforeFlag, backupIDFlag, archiveFlag)
+		}
+		return restorePreview{VolumeName: volumeName, RestoreFrom: s.archive}, nil
+	case s.hostPath != "":
+		return selectHostPathBackup(s.hostPath, volumeName, p)
+	case s.s3:
+		return selectS3Backup(volumeName, p)
+	default:
+		backend, err := newStorageBackend(s.from)
+		if err != nil {
+			return restorePreview{}, err
+		}
+		return selectBackendBackup(ctx, backend, volumeName, p)
+	}
+}
+
+// open streams the archive at the path or key returned by selectBackup.
+func (s backupSource) open(ctx context.Context, pathOrKey string) (io.ReadCloser, error) {
+	switch {
+	case s.archive != "" || s.hostPath != "":
+		return os.Open(pathOrKey)
+	case s.s3:
+		return s3backup.StreamFromS3(pathOrKey)
+	default:
+		backend, err := newStorageBackend(s.from)
+		if err != nil {
+			return nil, err
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(backend.Download(ctx, pathOrKey, pw))
+		}()
+		return pr, nil
+	}
+}
+
+// listObjects returns every archive in the source, newest first, Key is the path or key to open.
+func (s backupSource) listObjects(ctx context.Context) ([]storage.Object, error) {
+	var objects []storage.Object
+	switch {
+	case s.archive != "":
+		return nil, fmt.Errorf("--%s is a single backup, use --%s, --%s or --%s instead", archiveFlag, hostPathFlag, s3Mode, fromFlag)
+	case s.hostPath != "":
+		allBackups, err := getAllVolumeBackups(s.hostPath, "", false)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range allBackups {
+			info, err := os.Stat(b.AbsoluteFilePath)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, storage.Object{Key: b.AbsoluteFilePath, VolumeName: b.VolumeName, Size: info.Size(), LastModified: b.LastModTime})
+		}
+	case s.s3:
+		s3Objects, err := s3backup.ListBackups("")
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range s3Objects {
+			if o, ok := storage.NewObject(*obj.Key, *obj.Size, *obj.LastModified); ok {
+				objects = append(objects, o)
+			}
+		}
+	default:
+		backend, err := newStorageBackend(s.from)
+		if err != nil {
+			return nil, err
+		}
+		if objects, err = backend.List(ctx, ""); err != nil {
+			return nil, err
+		}
+	}
+	storage.SortNewestFirst(objects)
+	return objects, nil
+}
+
+// listBackups is listObjects, with RestoreFrom the path or key to open.
+func (s backupSource) listBackups(ctx context.Context) ([]restorePreview, error) {
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var backups []restorePreview
+	for _, obj := range objects {
+		backups = append(backups, previewOf(obj))
+	}
+	return backups, nil
+}
+
+// previewOf returns the backup of an object returned by listObjects.
+func previewOf(obj storage.Object) restorePreview {
+	return restorePreview{VolumeName: obj.VolumeName, RestoreFrom: obj.Key, BackupTime: obj.LastModified}
+}
+
+// backupID returns the id --backup-id selects a backup by, from the path or key returned by listBackups.
+// Archives in a host path are selected by their file name, other archives by their key.
+func (s backupSource) backupID(pathOrKey string) string {
+	if s.hostPath != "" {
+		return filepath.Base(pathOrKey)
+	}
+	return pathOrKey
+}
+
+// download returns the path of a local copy of the archive at the path or key returned by
+// selectBackup. Remote archives are downloaded to a temporary file, which is removed by cleanup.
+func (s backupSource) download(ctx context.Context, pathOrKey string) (string, func(), error) {
+	if s.archive != "" || s.hostPath != "" {
+		return pathOrKey, func() {}, nil
+	}
+	r, err := s.open(ctx, pathOrKey)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+
+	f, err := os.CreateTemp("", "*.tar.gz")
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	cleanup := func() {
+		_ = os.Remove(f.Name())
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed downloading %s: %s", pathOrKey, err)
+	}
+	return f.Name(), cleanup, nil
+}
+
+// readManifest returns the manifest stored in the archive at the path or key returned by selectBackup,
+// or nil for archives without one. Only the start of the archive is read.
+func (s backupSource) readManifest(ctx context.Context, pathOrKey string) (*manifest.Manifest, error) {
+	r, err := s.open(ctx, pathOrKey)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return parseArchiveManifest(r, pathOrKey)
+}
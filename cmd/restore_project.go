@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/storage"
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/client"
+	"github.com/spf13/cobra"
+)
+
+const projectFlag = "project"
+
+func init() {
+	restoreProjectCommand.Flags().String(projectFlag, "", "compose project whose volumes are restored")
+	restoreProjectCommand.Flags().String(hostPathFlag, "", "backup host path containing archives")
+	restoreProjectCommand.Flags().Bool(s3Mode, false, "look in s3 for backups")
+	restoreProjectCommand.Flags().String(fromFlag, "", "storage backend to restore from, e.g. sftp")
+	restoreProjectCommand.Flags().Bool(noStopFlag, false, "do not stop the containers of the project while restoring its volumes")
+	restoreProjectCommand.Flags().Bool(noSafetySnapshotFlag, false, "do not snapshot the current contents of volumes before restoring, a failed restore can not be rolled back")
+	addPointInTimeFlags(restoreProjectCommand)
+	restoreProjectCommand.Flags().Lookup(backupIDFlag).Usage = "restore the run of backups with this id, e.g. 20221015T030000Z"
+	addVolumeOverrideFlags(restoreProjectCommand)
+	if err := restoreProjectCommand.MarkFlagRequired(projectFlag); err != nil {
+		panic(err)
+	}
+	restoreProjectCommand.MarkFlagsMutuallyExclusive(hostPathFlag, s3Mode, fromFlag)
+	rootCmd.AddCommand(restoreProjectCommand)
+}
+
+type restoreProjectArgs struct {
+	project string
+	source  backupSource
+	opts    restoreOptions
+	pit     pointInTime
+	preview bool
+}
+
+// restoreProjectCommand restores every volume of a compose project from the same run of backups.
+var restoreProjectCommand = &cobra.Command{
+	Use:   "restore-project",
+	Short: "restore the volumes of a compose project",
+	Long: `Restore every volume of a compose project from the same run of backups.
+
+Backups record the compose project of each volume and the run of periodic-backups they
+were created in. The newest run which backed up the project is restored, use --at or
+--before to choose the newest run which started not after (or strictly before) a point
+in time instead, or --backup-id to choose a run by its id.
+
+The running containers of the project, and any other running containers which mount its
+volumes, are stopped before the restore and started again afterwards in dependency order.
+Every volume is copied into a safety snapshot before the first one is restored, and if
+restoring any volume fails, every volume is rolled back.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		project, err := cmd.Flags().GetString(projectFlag)
+		if err != nil {
+			panic(err)
+		}
+		hostPath, err := cmd.Flags().GetString(hostPathFlag)
+		if err != nil {
+			panic(err)
+		}
+		useS3, err := cmd.Flags().GetBool(s3Mode)
+		if err != nil {
+			panic(err)
+		}
+		from, err := cmd.Flags().GetString(fromFlag)
+		if err != nil {
+			panic(err)
+		}
+		source := backupSource{hostPath: hostPath, s3: useS3, from: from}
+		if source == (backupSource{}) {
+			panic(fmt.Errorf("one of --%s, --%s or --%s is required", hostPathFlag, s3Mode, fromFlag))
+		}
+		noSafetySnapshot, err := cmd.Flags().GetBool(noSafetySnapshotFlag)
+		if err != nil {
+			panic(err)
+		}
+		noStop, err := cmd.Flags().GetBool(noStopFlag)
+		if err != nil {
+			panic(err)
+		}
+		overrides, err := getVolumeOverrides(cmd)
+		if err != nil {
+			panic(err)
+		}
+		pit, err := getPointInTime(cmd)
+		if err != nil {
+			panic(err)
+		}
+		preview, err := cmd.Flags().GetBool(previewFlag)
+		if err != nil {
+			panic(err)
+		}
+		if err := cmdRestoreProject(restoreProjectArgs{
+			project: project,
+			source:  source,
+			opts:    restoreOptions{noSafetySnapshot: noSafetySnapshot, noStop: noStop, volume: overrides},
+			pit:     pit,
+			preview: preview,
+		}); err != nil {
+			panic(err)
+		}
+	},
+}
+
+// projectRun is the backups of the volumes of a compose project created in the same run of backups.
+type projectRun struct {
+	Project string           `json:"project"`
+	RunID   string           `json:"runId"`
+	RunTime time.Time        `json:"runTime"`
+	Backups []restorePreview `json:"backups"`
+}
+
+type restoreProjectOutput struct {
+	Project string          `json:"project"`
+	RunID   string          `json:"runId"`
+	Volumes []restoreOutput `json:"volumes"`
+}
+
+func cmdRestoreProject(args restoreProjectArgs) error {
+	ctx := context.Background()
+	run, err := selectProjectRun(ctx, args.source, args.project, args.pit)
+	if err != nil {
+		return err
+	}
+	if args.preview {
+		bytes, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+	// every container is stopped once, before the first volume is restored, so that no container sees
+	// a mix of restored and current volumes.
+	if !args.opts.noStop {
+		stopped, err := stopProjectContainers(ctx, cli, run)
+		defer func() {
+			if err := dockerutil.StartContainers(ctx, cli, stopped); err != nil {
+				log.Println(err)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	// every volume is snapshotted before the first one is restored, so that the whole project can be
+	// rolled back if restoring any volume fails.
+	var snapshots []safetySnapshot
+	if !args.opts.noSafetySnapshot {
+		for _, b := range run.Backups {
+			snapshot, err := takeSafetySnapshot(ctx, cli, b.VolumeName)
+			if err != nil {
+				removeSafetySnapshots(ctx, cli, snapshots)
+				return err
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	// containers and snapshots are handled for the whole project, not for each volume.
+	volumeOpts := restoreOptions{noSafetySnapshot: true, noStop: true, volume: args.opts.volume}
+	result := restoreProjectOutput{Project: run.Project, RunID: run.RunID, Volumes: []restoreOutput{}}
+	for _, b := range run.Backups {
+		if err := restoreProjectVolume(ctx, args.source, b, volumeOpts); err != nil {
+			err = fmt.Errorf("failed restoring %s: %s", b.VolumeName, err)
+			if args.opts.noSafetySnapshot {
+				var restored []string
+				for _, r := range result.Volumes {
+					restored = append(restored, r.VolumeName)
+				}
+				return fmt.Errorf("%s, volumes restored already: [%s]", err, strings.Join(restored, ", "))
+			}
+			return rollBackProject(ctx, cli, snapshots, err)
+		}
+		result.Volumes = append(result.Volumes, restoreOutput{
+			RestoredFrom: b.RestoreFrom,
+			VolumeName:   b.VolumeName,
+			RestoreTime:  time.Now(),
+		})
+	}
+	removeSafetySnapshots(ctx, cli, snapshots)
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+// stopProjectContainers stops the running containers of the project, and the running containers from
+// outside the project which mount one of the volumes of the run. The ids are returned in the order
+// the containers should be started in.
+func stopProjectContainers(ctx context.Context, cli *client.Client, run projectRun) ([]string, error) {
+	stopped, err := dockerutil.StopProjectContainers(ctx, cli, run.Project)
+	if err != nil {
+		return stopped, err
+	}
+	for _, b := range run.Backups {
+		ids, err := dockerutil.StopContainersUsingVolume(ctx, cli, b.VolumeName)
+		stopped = append(stopped, ids...)
+		if err != nil {
+			return stopped, err
+		}
+	}
+	return stopped, nil
+}
+
+// rollBackProject rolls every volume back to its safety snapshot after restoreErr. Snapshots which
+// can not be rolled back are kept, so that the data can be recovered by hand.
+func rollBackProject(ctx context.Context, cli *client.Client, snapshots []safetySnapshot, restoreErr error) error {
+	log.Printf("restore failed, rolling back every volume of the project: %s", restoreErr)
+	var failed []string
+	for _, snapshot := range snapshots {
+		if err := snapshot.rollBack(ctx, cli); err != nil {
+			log.Printf("failed rolling back %s: %s", snapshot.volumeName, err)
+			if snapshot.name != "" {
+				failed = append(failed, fmt.Sprintf("%s (previous contents in %s)", snapshot.volumeName, snapshot.name))
+			} else {
+				failed = append(failed, snapshot.volumeName)
+			}
+			continue
+		}
+		snapshot.remove(ctx, cli)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s, and rolling back failed for: [%s]", restoreErr, strings.Join(failed, ", "))
+	}
+	return fmt.Errorf("%s, every volume was rolled back", restoreErr)
+}
+
+func removeSafetySnapshots(ctx context.Context, cli *client.Client, snapshots []safetySnapshot) {
+	for _, snapshot := range snapshots {
+		snapshot.remove(ctx, cli)
+	}
+}
+
+func restoreProjectVolume(ctx context.Context, source backupSource, b restorePreview, opts restoreOptions) error {
+	archivePath, cleanup, err := source.download(ctx, b.RestoreFrom)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return cmdRestoreVolumeFromArchive(archivePath, b.VolumeName, opts)
+}
+
+// selectProjectRun returns the newest run of backups of the project which is selected, with the
+// newest backup of each volume in the run. The run id takes the place of the backup id.
+func selectProjectRun(ctx context.Context, source backupSource, project string, p pointInTime) (projectRun, error) {
+	objects, err := source.listObjects(ctx)
+	if err != nil {
+		return projectRun{}, err
+	}
+
+	runs := map[string]*projectRun{}
+	// volumes are all volumes of the project which were ever backed up.
+	volumes := map[string]struct{}{}
+	for _, obj := range objects {
+		objProject, runID, err := projectRunOf(ctx, source, obj)
+		if err != nil {
+			log.Printf("skipping %s: %s", obj.Key, err)
+			continue
+		}
+		// archives without a manifest, or created outside of periodic-backups, are not part of a run.
+		if objProject != project || runID == "" {
+			continue
+		}
+		b := previewOf(obj)
+		volumes[b.VolumeName] = struct{}{}
+		run, ok := runs[runID]
+		if !ok {
+			runTime, err := manifest.RunTime(runID)
+			if err != nil {
+				log.Printf("skipping %s: invalid run id %s", b.RestoreFrom, runID)
+				continue
+			}
+			run = &projectRun{Project: project, RunID: runID, RunTime: runTime}
+			runs[runID] = run
+		}
+		// backups are sorted newest first, so the first backup of a volume in a run is the one to restore.
+		if !containsVolume(run.Backups, b.VolumeName) {
+			run.Backups = append(run.Backups, b)
+		}
+	}
+
+	var selected *projectRun
+	for _, run := range runs {
+		if p.selects(run.RunID, run.RunTime) && (selected == nil || run.RunTime.After(selected.RunTime)) {
+			selected = run
+		}
+	}
+	if selected == nil {
+		return projectRun{}, noBackupOfError("project "+project, p)
+	}
+
+	for volumeName := range volumes {
+		if !containsVolume(selected.Backups, volumeName) {
+			log.Printf("volume %s of project %s was not backed up in run %s, it is not restored", volumeName, project, selected.RunID)
+		}
+	}
+	sort.Slice(selected.Backups, func(i, j int) bool {
+		return selected.Backups[i].VolumeName < selected.Backups[j].VolumeName
+	})
+	return *selected, nil
+}
+
+// projectRunOf returns the compose project and run id of the archive. They are taken from the object
+// metadata for backends which store it, so that only the manifests of other archives are read.
+func projectRunOf(ctx context.Context, source backupSource, obj storage.Object) (string, string, error) {
+	if obj.Metadata != nil {
+		return obj.Metadata[manifest.ProjectMetadataKey], obj.Metadata[manifest.RunIDMetadataKey], nil
+	}
+	m, err := source.readManifest(ctx, obj.Key)
+	if err != nil || m == nil {
+		return "", "", err
+	}
+	return m.Project, m.RunID, nil
+}
+
+func containsVolume(backups []restorePreview, volumeName string) bool {
+	for _, b := range backups {
+		if b.VolumeName == volumeName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/storage"
+	"docker-volume-backup/cmd/util/archiveutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectProjectRun(t *testing.T) {
+	dir := t.TempDir()
+	data := t.TempDir()
+	day := time.Date(2022, 10, 15, 3, 0, 0, 0, time.UTC)
+	// writeBackup writes a backup of the volume created by the run started on day plus days.
+	writeBackup := func(volumeName, project string, days int, withManifest bool) {
+		runTime := day.AddDate(0, 0, days)
+		name := filepath.Join(dir, fmt.Sprintf("%s-%d-10-2022.tar.gz", volumeName, runTime.Day()))
+		var manifestBytes []byte
+		if withManifest {
+			var err error
+			manifestBytes, err = json.Marshal(manifest.Manifest{VolumeName: volumeName, Project: project, RunID: manifest.NewRunID(runTime)})
+			require.NoError(t, err)
+		}
+		f, err := os.Create(name)
+		require.NoError(t, err)
+		require.NoError(t, archiveutil.Create(data, f, manifestBytes))
+		require.NoError(t, f.Close())
+		mtime := runTime.Add(time.Minute)
+		require.NoError(t, os.Chtimes(name, mtime, mtime))
+	}
+	for days := -2; days <= 0; days++ {
+		writeBackup("app_db", "app", days, true)
+		writeBackup("other_db", "other", days, true)
+	}
+	// the newest run failed before backing up the uploads.
+	writeBackup("app_uploads", "app", -2, true)
+	writeBackup("app_uploads", "app", -1, true)
+	writeBackup("app_cache", "app", 0, false)
+
+	source := backupSource{hostPath: dir}
+	volumeNames := func(run projectRun) []string {
+		var names []string
+		for _, b := range run.Backups {
+			names = append(names, b.VolumeName)
+		}
+		return names
+	}
+
+	t.Run("newest run by default", func(t *testing.T) {
+		run, err := selectProjectRun(context.Background(), source, "app", pointInTime{})
+		require.NoError(t, err)
+		require.Equal(t, "20221015T030000Z", run.RunID)
+		require.Equal(t, []string{"app_db"}, volumeNames(run))
+	})
+
+	t.Run("every volume of the selected run", func(t *testing.T) {
+		run, err := selectProjectRun(context.Background(), source, "app", pointInTime{at: day.Add(-time.Hour)})
+		require.NoError(t, err)
+		require.Equal(t, "20221014T030000Z", run.RunID)
+		require.Equal(t, []string{"app_db", "app_uploads"}, volumeNames(run))
+		require.Equal(t, filepath.Join(dir, "app_uploads-14-10-2022.tar.gz"), run.Backups[1].RestoreFrom)
+	})
+
+	t.Run("run id", func(t *testing.T) {
+		run, err := selectProjectRun(context.Background(), source, "app", pointInTime{backupID: "20221013T030000Z"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"app_db", "app_uploads"}, volumeNames(run))
+	})
+
+	t.Run("no selected run", func(t *testing.T) {
+		_, err := selectProjectRun(context.Background(), source, "app", pointInTime{at: day.AddDate(0, 0, -2), before: true})
+		require.Error(t, err)
+		_, err = selectProjectRun(context.Background(), source, "missing", pointInTime{})
+		require.Error(t, err)
+	})
+}
+
+func TestProjectRunOf(t *testing.T) {
+	// archives with metadata are not opened, so the key does not have to exist.
+	source := backupSource{hostPath: t.TempDir()}
+	obj := storage.Object{
+		Key:      "missing/app_db-15-10-2022.tar.gz",
+		Metadata: manifest.Manifest{VolumeName: "app_db", Project: "app", RunID: "20221015T030000Z"}.Metadata(),
+	}
+	project, runID, err := projectRunOf(context.Background(), source, obj)
+	require.NoError(t, err)
+	require.Equal(t, "app", project)
+	require.Equal(t, "20221015T030000Z", runID)
+
+	t.Run("without metadata the manifest is read", func(t *testing.T) {
+		obj.Metadata = nil
+		_, _, err := projectRunOf(context.Background(), source, obj)
+		require.Error(t, err)
+	})
+}
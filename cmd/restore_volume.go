@@ -2,40 +2,96 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"time"
 
+	"docker-volume-backup/cmd/incrementalbackup"
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/ocibackup"
+	"docker-volume-backup/cmd/resticbackup"
 	"docker-volume-backup/cmd/s3backup"
+	"docker-volume-backup/cmd/util/archiveutil"
 	"docker-volume-backup/cmd/util/dockerutil"
-	"docker-volume-backup/cmd/util/randutil"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
-	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/cobra"
 )
 
 const (
-	volumeFlag  = "volume"
-	s3Mode      = "s3"
-	s3KeyFlag   = "s3key"
-	archiveFlag = "archive"
+	volumeFlag      = "volume"
+	s3Mode          = "s3"
+	s3KeyFlag       = "s3key"
+	archiveFlag     = "archive"
+	incrementalMode = "incremental"
+	hostPathFlag    = "host-path"
+	untilFlag       = "until"
+	resticMode      = "restic"
+	resticIDFlag    = "restic-snapshot"
+	fromFlag        = "from"
+	keyFlag         = "key"
+	ociRefFlag      = "oci-ref"
+	toDirFlag       = "to-dir"
+
+	noSafetySnapshotFlag = "no-safety-snapshot"
+	noStopFlag           = "no-stop"
 )
 
+// restoreOptions are the options shared by every restore. The zero value is the safest
+// behaviour, each option opts out of a safety measure, and recreates missing volumes as they
+// were backed up.
+type restoreOptions struct {
+	// noSafetySnapshot skips copying the current contents of the volume before restoring into it.
+	noSafetySnapshot bool
+	// noStop skips stopping the running containers which use the volume while restoring into it.
+	noStop bool
+	// volume overrides the configuration missing volumes are created with.
+	volume volumeOverrides
+}
+
 func init() {
 	restoreOrCreateVolume.Flags().String(archiveFlag, "", "host path to archive")
 	restoreOrCreateVolume.Flags().String(s3KeyFlag, "", "specific s3Key to restore")
 	restoreOrCreateVolume.Flags().Bool(s3Mode, false, "look in s3 for backup")
 	restoreOrCreateVolume.Flags().String(volumeFlag, "", "name of the volume to create/populate")
+	restoreOrCreateVolume.Flags().Bool(incrementalMode, false, "restore from a chain of incremental backups")
+	restoreOrCreateVolume.Flags().String(hostPathFlag, "", "backup host path containing archives, incremental backups or a local restic repository")
+	restoreOrCreateVolume.Flags().String(untilFlag, "", "restore incremental backups up to this time (RFC3339), defaults to the newest")
+	restoreOrCreateVolume.Flags().Bool(resticMode, false, "restore from the restic repository")
+	restoreOrCreateVolume.Flags().String(resticIDFlag, "", "id of the restic snapshot to restore, defaults to the newest snapshot of the volume")
+	restoreOrCreateVolume.Flags().String(fromFlag, "", "storage backend to restore from, e.g. sftp")
+	restoreOrCreateVolume.Flags().String(keyFlag, "", "specific key to restore from the storage backend, defaults to the newest")
+	restoreOrCreateVolume.Flags().Bool(noSafetySnapshotFlag, false, "do not snapshot the current contents of the volume before restoring, a failed restore can not be rolled back")
+	restoreOrCreateVolume.Flags().Bool(noStopFlag, false, "do not stop the containers using the volume while restoring into it")
+	restoreOrCreateVolume.Flags().String(ociRefFlag, "", "OCI artifact to restore, e.g. registry/repo:tag, defaults to the newest backup of the volume if there is no tag")
+	restoreOrCreateVolume.Flags().String(toDirFlag, "", "extract the backup into this host directory instead of a volume, preserving ownership, permissions, extended attributes and times")
+	addPointInTimeFlags(restoreOrCreateVolume)
+	addVolumeOverrideFlags(restoreOrCreateVolume)
 
 	if err := restoreOrCreateVolume.MarkFlagRequired(volumeFlag); err != nil {
 		panic(err)
 	}
 	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(s3KeyFlag, archiveFlag)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(incrementalMode, archiveFlag)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(incrementalMode, s3Mode)
+	restoreOrCreateVolume.MarkFlagsRequiredTogether(incrementalMode, hostPathFlag)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(resticMode, archiveFlag)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(resticMode, s3Mode)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(resticMode, incrementalMode)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(fromFlag, archiveFlag)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(fromFlag, s3Mode)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(fromFlag, incrementalMode)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(fromFlag, resticMode)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(ociRefFlag, archiveFlag)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(ociRefFlag, s3Mode)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(ociRefFlag, incrementalMode)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(ociRefFlag, resticMode)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(ociRefFlag, fromFlag)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(backupIDFlag, s3KeyFlag)
+	restoreOrCreateVolume.MarkFlagsMutuallyExclusive(backupIDFlag, keyFlag)
 	rootCmd.AddCommand(restoreOrCreateVolume)
 }
 
@@ -67,17 +123,153 @@ var restoreOrCreateVolume = &cobra.Command{
 			panic(err)
 		}
 
-		if useS3 || s3Key != "" {
-			// no s3key specified, so we must try and find the newest backup.
-			if s3Key == "" {
-				obj, err := s3backup.FindMostRecentBackupForVolume(volumeName)
+		useIncremental, err := cmd.Flags().GetBool(incrementalMode)
+		if err != nil {
+			panic(err)
+		}
+
+		useRestic, err := cmd.Flags().GetBool(resticMode)
+		if err != nil {
+			panic(err)
+		}
+
+		noSafetySnapshot, err := cmd.Flags().GetBool(noSafetySnapshotFlag)
+		if err != nil {
+			panic(err)
+		}
+		noStop, err := cmd.Flags().GetBool(noStopFlag)
+		if err != nil {
+			panic(err)
+		}
+		overrides, err := getVolumeOverrides(cmd)
+		if err != nil {
+			panic(err)
+		}
+		opts := restoreOptions{noSafetySnapshot: noSafetySnapshot, noStop: noStop, volume: overrides}
+
+		pit, err := getPointInTime(cmd)
+		if err != nil {
+			panic(err)
+		}
+		preview, err := cmd.Flags().GetBool(previewFlag)
+		if err != nil {
+			panic(err)
+		}
+		hostPath, err := cmd.Flags().GetString(hostPathFlag)
+		if err != nil {
+			panic(err)
+		}
+		toDir, err := cmd.Flags().GetString(toDirFlag)
+		if err != nil {
+			panic(err)
+		}
+
+		if useRestic || cmd.Flags().Changed(resticIDFlag) || useIncremental {
+			if pit != (pointInTime{}) || preview {
+				panic(fmt.Errorf("--%s, --%s, --%s and --%s select archives, use --%s or --%s instead", atFlag, beforeFlag, backupIDFlag, previewFlag, untilFlag, resticIDFlag))
+			}
+			if toDir != "" {
+				panic(fmt.Errorf("--%s can only extract archives", toDirFlag))
+			}
+		}
+
+		if useRestic || cmd.Flags().Changed(resticIDFlag) {
+			snapshotID, err := cmd.Flags().GetString(resticIDFlag)
+			if err != nil {
+				panic(err)
+			}
+			if err := cmdRestoreVolumeFromRestic(hostPath, volumeName, snapshotID, opts); err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		if useIncremental {
+			untilStr, err := cmd.Flags().GetString(untilFlag)
+			if err != nil {
+				panic(err)
+			}
+			until := time.Now()
+			if untilStr != "" {
+				until, err = time.Parse(time.RFC3339, untilStr)
 				if err != nil {
 					panic(err)
 				}
-				s3Key = *obj.Key
 			}
+			if err := cmdRestoreVolumeFromChain(hostPath, volumeName, until, opts); err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		from, err := cmd.Flags().GetString(fromFlag)
+		if err != nil {
+			panic(err)
+		}
+
+		ociRef, err := cmd.Flags().GetString(ociRefFlag)
+		if err != nil {
+			panic(err)
+		}
 
-			fileName := fmt.Sprintf("/tmp/%s", s3Key)
+		if pit != (pointInTime{}) && (archiveHostPath != "" || ociRef != "") {
+			panic(fmt.Errorf("--%s, --%s and --%s can not be used with --%s or --%s", atFlag, beforeFlag, backupIDFlag, archiveFlag, ociRefFlag))
+		}
+
+		// selected is the backup which is restored, an explicitly given archive or key is restored as it is.
+		selected := restorePreview{VolumeName: volumeName, RestoreFrom: archiveHostPath}
+		switch {
+		case from != "":
+			backend, err := newStorageBackend(from)
+			if err != nil {
+				panic(err)
+			}
+			key, err := cmd.Flags().GetString(keyFlag)
+			if err != nil {
+				panic(err)
+			}
+			selected.RestoreFrom = key
+			if key == "" {
+				if selected, err = selectBackendBackup(context.TODO(), backend, volumeName, pit); err != nil {
+					panic(err)
+				}
+			}
+			if preview {
+				break
+			}
+			fileName, err := downloadFromBackend(context.TODO(), backend, volumeName, selected.RestoreFrom)
+			if err != nil {
+				panic(err)
+			}
+			defer func() {
+				_ = os.Remove(fileName)
+			}()
+			archiveHostPath = fileName
+		case ociRef != "":
+			selected.RestoreFrom = ociRef
+			if preview {
+				break
+			}
+			fileName, err := pullFromRegistry(context.TODO(), ociRef, volumeName)
+			if err != nil {
+				panic(err)
+			}
+			defer func() {
+				_ = os.Remove(fileName)
+			}()
+			archiveHostPath = fileName
+		case useS3 || s3Key != "":
+			selected.RestoreFrom = s3Key
+			// no s3key specified, so we must find the newest backup not after the selected time.
+			if s3Key == "" {
+				if selected, err = selectS3Backup(volumeName, pit); err != nil {
+					panic(err)
+				}
+			}
+			if preview {
+				break
+			}
+			fileName := fmt.Sprintf("/tmp/%s", selected.RestoreFrom)
 			f, err := os.Create(fileName)
 			if err != nil {
 				panic(err)
@@ -86,79 +278,160 @@ var restoreOrCreateVolume = &cobra.Command{
 				_ = os.Remove(f.Name())
 			}()
 
-			if err := s3backup.DownloadFromS3(s3Key, f); err != nil {
+			if err := s3backup.DownloadFromS3(selected.RestoreFrom, f); err != nil {
 				panic(err)
 			}
 			archiveHostPath = f.Name()
+		case archiveHostPath == "" && hostPath != "":
+			if selected, err = selectHostPathBackup(hostPath, volumeName, pit); err != nil {
+				panic(err)
+			}
+			archiveHostPath = selected.RestoreFrom
+		}
+
+		if preview {
+			if err := printPreview([]restorePreview{selected}); err != nil {
+				panic(err)
+			}
+			return
 		}
 
-		if err := cmdRestoreVolumeFromArchive(archiveHostPath, volumeName); err != nil {
+		if toDir != "" {
+			if err := cmdRestoreVolumeToDir(archiveHostPath, selected, toDir); err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		if err := cmdRestoreVolumeFromArchive(archiveHostPath, volumeName, opts); err != nil {
 			panic(err)
 		}
 	},
 }
 
-func cmdRestoreVolumeFromArchive(archiveHostPath, volumeName string) error {
-	ctx := context.TODO()
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+// cmdRestoreVolumeToDir extracts the archive of the selected backup into a host directory.
+func cmdRestoreVolumeToDir(archivePath string, selected restorePreview, toDir string) error {
+	f, err := os.Open(archivePath)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	_, err = cli.ImagePull(ctx, "ubuntu:latest", types.ImagePullOptions{})
+	if err := os.MkdirAll(toDir, 0o755); err != nil {
+		return err
+	}
+	n, err := archiveutil.Extract(f, toDir, nil)
 	if err != nil {
 		return err
 	}
 
-	vol, err := cli.VolumeCreate(ctx, volume.VolumeCreateBody{
-		Name: volumeName,
+	bytes, err := json.Marshal(restoreFilesOutput{
+		RestoredFrom: selected.RestoreFrom,
+		VolumeName:   selected.VolumeName,
+		RestoredTo:   toDir,
+		Entries:      n,
+		RestoreTime:  time.Now(),
 	})
 	if err != nil {
 		return err
 	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+func cmdRestoreVolumeFromArchive(archiveHostPath, volumeName string, opts restoreOptions) error {
+	ctx := context.TODO()
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+	if err := dockerutil.PullImage(ctx, cli, "busybox:latest"); err != nil {
+		return err
+	}
+	// archives created by tar have no manifest, their volumes are created with the overrides only.
+	var config *manifest.VolumeConfig
+	backupManifest, err := readArchiveManifest(archiveHostPath)
+	if err != nil {
+		return err
+	}
+	if backupManifest != nil {
+		config = backupManifest.Volume
+	}
+	return safeRestore(ctx, cli, volumeName, opts, func() error {
+		if err := createVolume(ctx, cli, volumeName, config, opts.volume); err != nil {
+			return err
+		}
+		return dockerutil.ExtractArchive(ctx, cli, volumeName, archiveHostPath)
+	})
+}
+
+// pullFromRegistry pulls the archive of an OCI artifact to a temporary file and returns its path.
+// The caller must remove the file.
+func pullFromRegistry(ctx context.Context, ociRef, volumeName string) (string, error) {
+	ref, err := ocibackup.ParseReference(ociRef)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", "*.tar.gz")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := ocibackup.Pull(ctx, ocibackup.FromEnv(), ref, volumeName, f); err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("failed pulling %s: %s", ociRef, err)
+	}
+	return f.Name(), nil
+}
 
-	createConfig := &container.Config{
-		WorkingDir: "/data",
-		// --strip-components 1 to remove the directory, so that the files of the archive are at the root.
-		Cmd:   []string{"/bin/sh", "-c", "rm -rf /data/* && tar -xvzf /archive.tar.gz -C /data --strip-components 1"},
-		Image: "ubuntu",
-		Labels: map[string]string{
-			TypeLabelKey: LabelTypeTask,
-		},
-	}
-
-	hostConfig := &container.HostConfig{
-		Mounts: []mount.Mount{
-			// the directory which contains the data to be backed up
-			{
-				Type:     mount.TypeVolume,
-				Source:   vol.Name,
-				Target:   "/data",
-				ReadOnly: false,
-			},
-			{
-				Type:     mount.TypeBind,
-				Source:   archiveHostPath,
-				Target:   "/archive.tar.gz",
-				ReadOnly: false,
-			},
-		},
-	}
-
-	networkConfig := &network.NetworkingConfig{}
-	platform := &specs.Platform{}
-
-	containerName := fmt.Sprintf("backup-%s", randutil.StringRunes(5))
-	body, err := cli.ContainerCreate(ctx, createConfig, hostConfig, networkConfig, platform, containerName)
+// cmdRestoreVolumeFromChain restores a volume by extracting each incremental archive
+// of the chain, in order, up until the given time.
+func cmdRestoreVolumeFromChain(hostPath, volumeName string, until time.Time, opts restoreOptions) error {
+	chainDir := filepath.Join(hostPath, incrementalbackup.DirName, volumeName)
+	archives, err := incrementalbackup.ListArchives(chainDir, volumeName)
 	if err != nil {
 		return err
 	}
+	chain, err := incrementalbackup.ChainUntil(archives, until)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, a := range chain {
+		log.Printf("restoring %s from archive: %s", volumeName, a.Path)
+		names = append(names, filepath.Base(a.Path))
+	}
 
-	err = cli.ContainerStart(ctx, body.ID, types.ContainerStartOptions{})
+	ctx := context.TODO()
+	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
 		return err
 	}
+	return safeRestore(ctx, cli, volumeName, opts, func() error {
+		if err := createVolume(ctx, cli, volumeName, nil, opts.volume); err != nil {
+			return err
+		}
+		if err := dockerutil.PullImage(ctx, cli, "busybox:latest"); err != nil {
+			return err
+		}
+		return dockerutil.ExtractChain(ctx, cli, volumeName, chainDir, names)
+	})
+}
 
-	// once the container has completed, it should be removed.
-	return dockerutil.WaitForContainerToExit(ctx, cli, body)
+// cmdRestoreVolumeFromRestic restores a volume from a snapshot in the restic repository.
+func cmdRestoreVolumeFromRestic(hostPath, volumeName, snapshotID string, opts restoreOptions) error {
+	ctx := context.TODO()
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+	return safeRestore(ctx, cli, volumeName, opts, func() error {
+		if err := createVolume(ctx, cli, volumeName, nil, opts.volume); err != nil {
+			return err
+		}
+		return resticbackup.Restore(ctx, cli, hostPath, volumeName, snapshotID)
+	})
 }
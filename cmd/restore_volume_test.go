@@ -13,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"docker-volume-backup/cmd/util/dockerutil"
 	"docker-volume-backup/cmd/util/randutil"
 
 	"github.com/docker/docker/api/types"
@@ -69,12 +70,21 @@ func init() {
 	}
 }
 
+// TestMain runs the helper commands when the test binary is copied into a helper container.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && (os.Args[1] == dockerutil.CreateArchiveCommand || os.Args[1] == dockerutil.ExtractArchiveCommand) {
+		Execute()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
 func TestCreateVolume(t *testing.T) {
 	tarFile := createTarFile(t)
 	ctx := context.TODO()
 
 	t.Run("create volume from tar", func(t *testing.T) {
-		err := cmdRestoreVolumeFromArchive(tarFile, volumeName)
+		err := cmdRestoreVolumeFromArchive(tarFile, volumeName, restoreOptions{})
 		require.NoError(t, err)
 
 		t.Run("volume created", func(t *testing.T) {
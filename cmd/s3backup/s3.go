@@ -2,6 +2,7 @@ package s3backup
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -9,6 +10,8 @@ import (
 	"path"
 	"sort"
 
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/storage"
 	"docker-volume-backup/cmd/util/dateutil"
 	"docker-volume-backup/cmd/util/dockerutil"
 
@@ -38,8 +41,15 @@ func NewMode(hostPath string) *Mode {
 func (s *Mode) CrateBackup(ctx context.Context, cli *client.Client, mountPoint types.MountPoint) error {
 	nameOfBackedupArchive := fmt.Sprintf("%s-%s.tar.gz", mountPoint.Name, dateutil.GetDayMonthYear())
 	filePath := fmt.Sprintf("/backups/.s3tmp/%s", nameOfBackedupArchive)
-	cmd := []string{"tar", "-czvf", filePath, "/data"}
-	if err := dockerutil.RunCommandInMountedContainer(ctx, s.hostPathForBackups, cli, mountPoint, cmd); err != nil {
+	backupManifest, err := manifest.New(ctx, cli, mountPoint.Name)
+	if err != nil {
+		return err
+	}
+	manifestBytes, err := json.Marshal(backupManifest)
+	if err != nil {
+		return err
+	}
+	if err := dockerutil.ArchiveVolumeToHostPath(ctx, cli, mountPoint.Name, manifestBytes, s.hostPathForBackups, ".s3tmp/"+nameOfBackedupArchive); err != nil {
 		return fmt.Errorf("failed running command in container: %s", err)
 	}
 
@@ -87,7 +97,8 @@ func fromEnv() Config {
 	}
 }
 
-func newSession() *session.Session {
+// NewSession creates a session from the AWS_* environment variables.
+func NewSession() *session.Session {
 	config := fromEnv()
 	return session.Must(session.NewSession(&aws.Config{
 		Credentials: credentials.NewStaticCredentialsFromCreds(credentials.Value{
@@ -101,7 +112,7 @@ func newSession() *session.Session {
 
 func UploadBackupToS3(file *os.File) error {
 	config := fromEnv()
-	sess := newSession()
+	sess := NewSession()
 	uploader := s3manager.NewUploader(sess)
 	_, err := uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(config.Bucket),
@@ -129,7 +140,7 @@ func DeleteOtherBackupsForVolume(backupFileKey, volumeName string) error {
 }
 
 func ListBackups(prefix string) ([]*s3.Object, error) {
-	sess := newSession()
+	sess := NewSession()
 	config := fromEnv()
 	svc := s3.New(sess)
 	resp, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(config.Bucket), Prefix: aws.String(prefix)})
@@ -140,7 +151,7 @@ func ListBackups(prefix string) ([]*s3.Object, error) {
 }
 
 func DeleteBackupFromS3(key string) error {
-	sess := newSession()
+	sess := NewSession()
 	config := fromEnv()
 	svc := s3.New(sess)
 	_, err := svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(config.Bucket), Key: aws.String(key)})
@@ -149,7 +160,7 @@ func DeleteBackupFromS3(key string) error {
 
 func DownloadFromS3(key string, writer io.WriterAt) error {
 	config := fromEnv()
-	downloader := s3manager.NewDownloader(newSession())
+	downloader := s3manager.NewDownloader(NewSession())
 
 	_, err := downloader.Download(writer,
 		&s3.GetObjectInput{
@@ -160,16 +171,46 @@ func DownloadFromS3(key string, writer io.WriterAt) error {
 	return err
 }
 
+// StreamFromS3 returns the contents of the object without downloading it first, the caller must close it.
+func StreamFromS3(key string) (io.ReadCloser, error) {
+	config := fromEnv()
+	svc := s3.New(NewSession())
+	out, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
 func FindMostRecentBackupForVolume(volumeName string) (*s3.Object, error) {
-	backupsForVolume, err := ListBackups(volumeName)
+	backupsForVolume, err := ListVolumeBackups(volumeName)
 	if err != nil {
 		return nil, err
 	}
 	if len(backupsForVolume) == 0 {
 		return nil, fmt.Errorf("no backups found for volume %s", volumeName)
 	}
+	return backupsForVolume[0], nil
+}
+
+// ListVolumeBackups returns the backups of the volume, newest first. Backups of other volumes
+// whose names start with the volume name are left out.
+func ListVolumeBackups(volumeName string) ([]*s3.Object, error) {
+	objects, err := ListBackups(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	var backupsForVolume []*s3.Object
+	for _, obj := range objects {
+		if name, ok := storage.VolumeName(*obj.Key); ok && name == volumeName {
+			backupsForVolume = append(backupsForVolume, obj)
+		}
+	}
 	sort.SliceStable(backupsForVolume, func(i, j int) bool {
-		return backupsForVolume[i].LastModified.Before(*backupsForVolume[j].LastModified)
+		return backupsForVolume[i].LastModified.After(*backupsForVolume[j].LastModified)
 	})
-	return backupsForVolume[0], nil
+	return backupsForVolume, nil
 }
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+
+	"docker-volume-backup/cmd/label"
+	"docker-volume-backup/cmd/util/dockerutil"
+	"docker-volume-backup/cmd/util/randutil"
+
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// withSafetySnapshot runs restore, after first copying the current contents of the volume into a
+// safety snapshot volume. If restore fails, the volume is rolled back to the safety snapshot, or
+// emptied again if it was new or empty. The safety snapshot is removed once the restore has succeeded
+// or been rolled back, and is kept if the rollback fails so that the data can be recovered by hand.
+func withSafetySnapshot(ctx context.Context, cli *client.Client, volumeName string, opts restoreOptions, restore func() error) error {
+	if opts.noSafetySnapshot {
+		return restore()
+	}
+	snapshot, err := takeSafetySnapshot(ctx, cli, volumeName)
+	if err != nil {
+		return err
+	}
+
+	restoreErr := restore()
+	if restoreErr != nil {
+		log.Printf("restore failed, rolling back %s: %s", volumeName, restoreErr)
+		if err := snapshot.rollBack(ctx, cli); err != nil {
+			if snapshot.name == "" {
+				return fmt.Errorf("restore failed: %s, and emptying the volume failed: %s", restoreErr, err)
+			}
+			return fmt.Errorf("restore failed: %s, and rolling back failed: %s, the previous contents are in volume %s", restoreErr, err, snapshot.name)
+		}
+	}
+	snapshot.remove(ctx, cli)
+	if restoreErr != nil {
+		return fmt.Errorf("restore failed and %s was rolled back: %s", volumeName, restoreErr)
+	}
+	return nil
+}
+
+// safetySnapshot is a copy of the contents of a volume from before a restore. name is empty if the
+// volume did not exist or was empty, in which case there is no snapshot volume.
+type safetySnapshot struct {
+	volumeName string
+	name       string
+}
+
+// takeSafetySnapshot copies the current contents of the volume into a new safety snapshot volume.
+func takeSafetySnapshot(ctx context.Context, cli *client.Client, volumeName string) (safetySnapshot, error) {
+	snapshot := safetySnapshot{volumeName: volumeName}
+	if _, err := cli.VolumeInspect(ctx, volumeName); client.IsErrNotFound(err) {
+		return snapshot, nil
+	} else if err != nil {
+		return snapshot, err
+	}
+	if err := dockerutil.PullImage(ctx, cli, "busybox:latest"); err != nil {
+		return snapshot, err
+	}
+	empty, err := dockerutil.VolumeIsEmpty(ctx, cli, volumeName)
+	if err != nil || empty {
+		return snapshot, err
+	}
+
+	name := fmt.Sprintf("%s-safety-%s", volumeName, randutil.StringRunes(5))
+	log.Printf("creating safety snapshot of %s: %s", volumeName, name)
+	if _, err := cli.VolumeCreate(ctx, volume.VolumeCreateBody{Name: name, Labels: label.Task()}); err != nil {
+		return snapshot, err
+	}
+	if err := copyVolumeContents(ctx, cli, volumeName, name); err != nil {
+		_ = cli.VolumeRemove(ctx, name, true)
+		return snapshot, fmt.Errorf("failed creating safety snapshot: %s", err)
+	}
+	snapshot.name = name
+	return snapshot, nil
+}
+
+// rollBack replaces the contents of the volume with the safety snapshot. Volumes which were new or
+// empty are emptied again.
+func (s safetySnapshot) rollBack(ctx context.Context, cli *client.Client) error {
+	if s.name != "" {
+		return copyVolumeContents(ctx, cli, s.name, s.volumeName)
+	}
+	if _, err := cli.VolumeInspect(ctx, s.volumeName); client.IsErrNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := dockerutil.PullImage(ctx, cli, "busybox:latest"); err != nil {
+		return err
+	}
+	return dockerutil.WriteVolume(ctx, cli, s.volumeName, bytes.NewReader(emptyTar))
+}
+
+// remove removes the safety snapshot volume, if there is one.
+func (s safetySnapshot) remove(ctx context.Context, cli *client.Client) {
+	if s.name == "" {
+		return
+	}
+	if err := cli.VolumeRemove(ctx, s.name, true); err != nil {
+		log.Printf("failed removing safety snapshot %s: %s", s.name, err)
+	}
+}
+
+// emptyTar is a tar stream without any entries.
+var emptyTar = make([]byte, 1024)
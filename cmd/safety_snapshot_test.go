@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/stretchr/testify/require"
+)
+
+// volumeTar returns a tar stream in the format read and written by dockerutil.ReadVolume and WriteVolume.
+func volumeTar(t *testing.T, files map[string]string) io.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0o755}))
+	for name, contents := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "data/" + name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(contents))}))
+		_, err := tw.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return &buf
+}
+
+// volumeFiles returns the contents of the regular files in the volume.
+func volumeFiles(t *testing.T, ctx context.Context, volumeName string) map[string]string {
+	t.Helper()
+	rc, err := dockerutil.ReadVolume(ctx, cli, volumeName)
+	require.NoError(t, err)
+	defer rc.Close()
+
+	files := map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			contents, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			files[strings.TrimPrefix(hdr.Name, "data/")] = string(contents)
+		}
+	}
+}
+
+func TestWithSafetySnapshot(t *testing.T) {
+	ctx := context.TODO()
+	require.NoError(t, dockerutil.PullImage(ctx, cli, "busybox:latest"))
+	removeVolume := func(name string) {
+		t.Cleanup(func() {
+			_ = cli.VolumeRemove(ctx, name, true)
+		})
+	}
+	safetySnapshots := func(volumeName string) int {
+		volumes, err := cli.VolumeList(ctx, filters.NewArgs(filters.Arg("name", volumeName+"-safety-")))
+		require.NoError(t, err)
+		return len(volumes.Volumes)
+	}
+
+	t.Run("failed restore is rolled back", func(t *testing.T) {
+		name := "test-safety-snapshot"
+		removeVolume(name)
+		_, err := cli.VolumeCreate(ctx, volume.VolumeCreateBody{Name: name})
+		require.NoError(t, err)
+		require.NoError(t, dockerutil.WriteVolume(ctx, cli, name, volumeTar(t, map[string]string{"app.yml": "port: 80"})))
+
+		err = withSafetySnapshot(ctx, cli, name, restoreOptions{}, func() error {
+			require.NoError(t, dockerutil.WriteVolume(ctx, cli, name, volumeTar(t, map[string]string{"partial": "p"})))
+			return errors.New("archive was not extracted completely")
+		})
+		require.Error(t, err)
+		require.Equal(t, map[string]string{"app.yml": "port: 80"}, volumeFiles(t, ctx, name))
+		require.Zero(t, safetySnapshots(name), "the safety snapshot should be removed after rolling back")
+	})
+
+	t.Run("failed restore into a new volume is emptied", func(t *testing.T) {
+		name := "test-safety-snapshot-new"
+		removeVolume(name)
+
+		err := withSafetySnapshot(ctx, cli, name, restoreOptions{}, func() error {
+			_, err := cli.VolumeCreate(ctx, volume.VolumeCreateBody{Name: name})
+			require.NoError(t, err)
+			require.NoError(t, dockerutil.WriteVolume(ctx, cli, name, volumeTar(t, map[string]string{"partial": "p"})))
+			return errors.New("archive was not extracted completely")
+		})
+		require.Error(t, err)
+		require.Empty(t, volumeFiles(t, ctx, name))
+	})
+
+	t.Run("successful restore keeps the restored contents", func(t *testing.T) {
+		name := "test-safety-snapshot-success"
+		removeVolume(name)
+		_, err := cli.VolumeCreate(ctx, volume.VolumeCreateBody{Name: name})
+		require.NoError(t, err)
+		require.NoError(t, dockerutil.WriteVolume(ctx, cli, name, volumeTar(t, map[string]string{"app.yml": "port: 80"})))
+
+		require.NoError(t, withSafetySnapshot(ctx, cli, name, restoreOptions{}, func() error {
+			return dockerutil.WriteVolume(ctx, cli, name, volumeTar(t, map[string]string{"app.yml": "port: 8080"}))
+		}))
+		require.Equal(t, map[string]string{"app.yml": "port: 8080"}, volumeFiles(t, ctx, name))
+		require.Zero(t, safetySnapshots(name))
+	})
+}
@@ -0,0 +1,157 @@
+package sftpbackup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/storage"
+	"docker-volume-backup/cmd/util/sshutil"
+
+	"github.com/pkg/sftp"
+)
+
+type Config struct {
+	sshutil.Config
+	// Directory is the remote directory where archives are stored.
+	Directory string
+}
+
+func FromEnv() Config {
+	cfg := sshutil.FromEnv("SFTP_")
+	cfg.Host, _ = os.LookupEnv("SFTP_HOST")
+	cfg.User, _ = os.LookupEnv("SFTP_USER")
+	directory, _ := os.LookupEnv("SFTP_DIRECTORY")
+	return Config{
+		Config:    cfg,
+		Directory: directory,
+	}
+}
+
+// Backend stores archives in a directory on a remote host over sftp.
+type Backend struct {
+	directory string
+	// connect opens a new sftp session, a new session is used for each operation
+	// so that long running periodic backups are not affected by dropped connections.
+	connect func() (*sftp.Client, io.Closer, error)
+}
+
+func NewBackend(cfg Config) *Backend {
+	return &Backend{
+		directory: cfg.Directory,
+		connect: func() (*sftp.Client, io.Closer, error) {
+			return dial(cfg)
+		},
+	}
+}
+
+func dial(cfg Config) (*sftp.Client, io.Closer, error) {
+	conn, err := sshutil.Dial(cfg.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return client, conn, nil
+}
+
+func (b *Backend) path(key string) string {
+	return path.Join(b.directory, key)
+}
+
+func (b *Backend) Upload(ctx context.Context, key string, r io.Reader, m manifest.Manifest) error {
+	client, conn, err := b.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	if b.directory != "" {
+		if err := client.MkdirAll(b.directory); err != nil {
+			return fmt.Errorf("failed creating remote directory: %s", err)
+		}
+	}
+
+	// upload to a temporary file, so that a partial upload never replaces an existing archive.
+	tmp := b.path(key + ".tmp")
+	f, err := client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.ReadFrom(r); err != nil {
+		_ = f.Close()
+		_ = client.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return client.PosixRename(tmp, b.path(key))
+}
+
+func (b *Backend) List(ctx context.Context, prefix string) ([]storage.Object, error) {
+	client, conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	dir := b.directory
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := client.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var objects []storage.Object
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		if obj, ok := storage.NewObject(e.Name(), e.Size(), e.ModTime()); ok {
+			objects = append(objects, obj)
+		}
+	}
+	return objects, nil
+}
+
+func (b *Backend) Download(ctx context.Context, key string, w io.Writer) error {
+	client, conn, err := b.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	f, err := client.Open(b.path(key))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteTo(w)
+	return err
+}
+
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	client, conn, err := b.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+	return client.Remove(b.path(key))
+}
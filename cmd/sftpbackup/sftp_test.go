@@ -0,0 +1,69 @@
+package sftpbackup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/util/dateutil"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestBackend returns a backend where each connection is to an in memory sftp
+// server, all sharing the same files.
+func newTestBackend(t *testing.T) *Backend {
+	t.Helper()
+	handlers := sftp.InMemHandler()
+	return &Backend{
+		directory: "/backups",
+		connect: func() (*sftp.Client, io.Closer, error) {
+			serverConn, clientConn := net.Pipe()
+			server := sftp.NewRequestServer(serverConn, handlers)
+			go func() {
+				_ = server.Serve()
+			}()
+			client, err := sftp.NewClientPipe(clientConn, clientConn)
+			if err != nil {
+				return nil, nil, err
+			}
+			return client, clientConn, nil
+		},
+	}
+}
+
+func TestBackend(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t)
+
+	key := "config-" + dateutil.GetDayMonthYear() + ".tar.gz"
+	contents := []byte("archive contents")
+
+	require.NoError(t, b.Upload(ctx, key, bytes.NewReader(contents), manifest.Manifest{VolumeName: "config"}))
+
+	t.Run("list", func(t *testing.T) {
+		objects, err := b.List(ctx, "config")
+		require.NoError(t, err)
+		require.Len(t, objects, 1, "temporary upload files should not be listed")
+		require.Equal(t, key, objects[0].Key)
+		require.Equal(t, "config", objects[0].VolumeName)
+		require.Equal(t, int64(len(contents)), objects[0].Size)
+	})
+
+	t.Run("download", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, b.Download(ctx, key, &buf))
+		require.Equal(t, contents, buf.Bytes())
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, b.Delete(ctx, key))
+		objects, err := b.List(ctx, "config")
+		require.NoError(t, err)
+		require.Empty(t, objects)
+	})
+}
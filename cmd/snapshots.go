@@ -0,0 +1,230 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"docker-volume-backup/cmd/repobackup"
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/client"
+	"github.com/spf13/cobra"
+)
+
+const (
+	repositoryFlag = "repository"
+	snapshotFlag   = "snapshot"
+)
+
+func init() {
+	listSnapshotsCommand.Flags().String(repositoryFlag, "", "directory or s3://bucket/prefix of the repository")
+	listSnapshotsCommand.Flags().String("volume-name-filter", "", "string volume name must contain")
+	if err := listSnapshotsCommand.MarkFlagRequired(repositoryFlag); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(listSnapshotsCommand)
+
+	restoreSnapshotCommand.Flags().String(repositoryFlag, "", "directory or s3://bucket/prefix of the repository")
+	restoreSnapshotCommand.Flags().String(volumeFlag, "", "name of the volume to create/populate")
+	restoreSnapshotCommand.Flags().Bool(noStopFlag, false, "do not stop the containers using the volume while restoring into it")
+	restoreSnapshotCommand.Flags().Bool(noSafetySnapshotFlag, false, "do not snapshot the current contents of the volume before restoring, a failed restore can not be rolled back")
+	restoreSnapshotCommand.Flags().String(snapshotFlag, "", "id of the snapshot to restore, defaults to the newest snapshot of the volume")
+	addVolumeOverrideFlags(restoreSnapshotCommand)
+	if err := restoreSnapshotCommand.MarkFlagRequired(repositoryFlag); err != nil {
+		panic(err)
+	}
+	if err := restoreSnapshotCommand.MarkFlagRequired(volumeFlag); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(restoreSnapshotCommand)
+
+	pruneSnapshotsCommand.Flags().String(repositoryFlag, "", "directory or s3://bucket/prefix of the repository")
+	pruneSnapshotsCommand.Flags().Int("retention-days", 0, "retention days")
+	if err := pruneSnapshotsCommand.MarkFlagRequired(repositoryFlag); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(pruneSnapshotsCommand)
+}
+
+func openRepository(cmd *cobra.Command) (*repobackup.Repository, error) {
+	location, err := cmd.Flags().GetString(repositoryFlag)
+	if err != nil {
+		return nil, err
+	}
+	store, err := repobackup.NewStore(location)
+	if err != nil {
+		return nil, err
+	}
+	return repobackup.NewRepository(store), nil
+}
+
+// listSnapshotsCommand lists the snapshots in a repository.
+var listSnapshotsCommand = &cobra.Command{
+	Use:   "list-snapshots",
+	Short: "list snapshots in a repository",
+	Long:  "List the snapshots stored in a deduplicated repository, newest first",
+	Run: func(cmd *cobra.Command, args []string) {
+		repo, err := openRepository(cmd)
+		if err != nil {
+			panic(err)
+		}
+		volumeNameFilter, err := cmd.Flags().GetString("volume-name-filter")
+		if err != nil {
+			panic(err)
+		}
+		if err := cmdListSnapshots(repo, volumeNameFilter); err != nil {
+			panic(err)
+		}
+	},
+}
+
+// snapshotOutput holds information about a snapshot, without the list of chunks.
+type snapshotOutput struct {
+	ID         string    `json:"id"`
+	VolumeName string    `json:"volumeName"`
+	Time       time.Time `json:"time"`
+	Size       int64     `json:"size"`
+	ChunkCount int       `json:"chunkCount"`
+}
+
+func cmdListSnapshots(repo *repobackup.Repository, volumeNameFilter string) error {
+	snapshots, err := repo.Snapshots()
+	if err != nil {
+		return err
+	}
+	result := []snapshotOutput{}
+	for _, s := range snapshots {
+		if volumeNameFilter != "" && !strings.Contains(s.VolumeName, volumeNameFilter) {
+			continue
+		}
+		result = append(result, snapshotOutput{
+			ID:         s.ID,
+			VolumeName: s.VolumeName,
+			Time:       s.Time,
+			Size:       s.Size,
+			ChunkCount: len(s.Chunks),
+		})
+	}
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+// restoreSnapshotCommand restores a volume from a snapshot in a repository.
+var restoreSnapshotCommand = &cobra.Command{
+	Use:   "restore-snapshot",
+	Short: "restore a volume from a repository snapshot",
+	Long: `Creates a docker volume, or replaces the contents of an existing one, from a snapshot
+in a deduplicated repository. If no snapshot is specified, the newest snapshot of the volume is used.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		repo, err := openRepository(cmd)
+		if err != nil {
+			panic(err)
+		}
+		volumeName, err := cmd.Flags().GetString(volumeFlag)
+		if err != nil {
+			panic(err)
+		}
+		snapshotID, err := cmd.Flags().GetString(snapshotFlag)
+		if err != nil {
+			panic(err)
+		}
+		noSafetySnapshot, err := cmd.Flags().GetBool(noSafetySnapshotFlag)
+		if err != nil {
+			panic(err)
+		}
+		noStop, err := cmd.Flags().GetBool(noStopFlag)
+		if err != nil {
+			panic(err)
+		}
+		overrides, err := getVolumeOverrides(cmd)
+		if err != nil {
+			panic(err)
+		}
+		if err := cmdRestoreSnapshot(repo, volumeName, snapshotID, restoreOptions{noSafetySnapshot: noSafetySnapshot, noStop: noStop, volume: overrides}); err != nil {
+			panic(err)
+		}
+	},
+}
+
+func cmdRestoreSnapshot(repo *repobackup.Repository, volumeName, snapshotID string, opts restoreOptions) error {
+	snapshot, err := repo.FindSnapshot(volumeName, snapshotID)
+	if err != nil {
+		return err
+	}
+	// every chunk is checked before the volume is touched, a missing or corrupt chunk would
+	// otherwise only be found once the volume had been emptied.
+	if err := repo.Verify(snapshot); err != nil {
+		return fmt.Errorf("snapshot %s cannot be restored: %s", snapshot.ID, err)
+	}
+
+	ctx := context.TODO()
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+	if err := dockerutil.PullImage(ctx, cli, "busybox:latest"); err != nil {
+		return err
+	}
+	err = safeRestore(ctx, cli, volumeName, opts, func() error {
+		if err := createVolume(ctx, cli, volumeName, nil, opts.volume); err != nil {
+			return err
+		}
+		// chunks are streamed into the volume as they are read from the repository.
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(repo.Restore(snapshot, pw))
+		}()
+		err := dockerutil.WriteVolume(ctx, cli, volumeName, pr)
+		_ = pr.CloseWithError(err)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(restoreOutput{
+		RestoredFrom: snapshot.ID,
+		VolumeName:   volumeName,
+		RestoreTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+// pruneSnapshotsCommand removes old snapshots and unreferenced chunks from a repository.
+var pruneSnapshotsCommand = &cobra.Command{
+	Use:   "prune-snapshots",
+	Short: "remove old snapshots from a repository",
+	Long: `Removes snapshots older than retention-days from a deduplicated repository, and any
+chunks which are no longer referenced by a snapshot. The newest snapshot of each volume is always kept.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		repo, err := openRepository(cmd)
+		if err != nil {
+			panic(err)
+		}
+		retainForDays, err := cmd.Flags().GetInt("retention-days")
+		if err != nil {
+			panic(err)
+		}
+		result, err := repo.Prune(time.Now(), retainForDays)
+		if err != nil {
+			panic(err)
+		}
+		bytes, err := json.Marshal(result)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(bytes))
+	},
+}
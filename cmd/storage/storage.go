@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// archiveRxp matches archive names in the same format as the filesystem mode, optionally followed by
+// the time of day the archive was created at.
+var archiveRxp = regexp.MustCompile(`^(.*)-\d{1,2}-\d{1,2}-\d{4}(-\d{6})?\.tar\.gz$`)
+
+// Object is a single archive stored in a backend.
+type Object struct {
+	Key          string    `json:"key"`
+	VolumeName   string    `json:"volumeName"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	// Metadata is the manifest stored alongside the object, see manifest.Manifest.Metadata. It is nil
+	// for backends which do not support object metadata.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Backend is a remote location where archives are stored.
+type Backend interface {
+	// Upload stores the contents of r under key, replacing any existing object. Backends which
+	// support object metadata store the manifest alongside the object.
+	Upload(ctx context.Context, key string, r io.Reader, m manifest.Manifest) error
+	// List returns every archive whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Download writes the contents of the object to w.
+	Download(ctx context.Context, key string, w io.Writer) error
+	// Delete removes the object.
+	Delete(ctx context.Context, key string) error
+}
+
+// Mode backs up volumes to a Backend. Archives are streamed directly from the volume
+// to the backend without being written to disk.
+type Mode struct {
+	name          string
+	backend       Backend
+	retainForDays int
+}
+
+func NewMode(name string, backend Backend, retainForDays int) *Mode {
+	return &Mode{
+		name:          name,
+		backend:       backend,
+		retainForDays: retainForDays,
+	}
+}
+
+func (m *Mode) CrateBackup(ctx context.Context, cli *client.Client, mountPoint types.MountPoint) error {
+	log.Printf("performing %s backup", m.name)
+	key := ArchiveName(mountPoint.Name)
+	backupManifest, err := manifest.New(ctx, cli, mountPoint.Name)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(WriteArchive(ctx, cli, backupManifest, pw))
+	}()
+	if err := m.backend.Upload(ctx, key, pr, backupManifest); err != nil {
+		_ = pr.CloseWithError(err)
+		return fmt.Errorf("failed uploading %s: %s", key, err)
+	}
+
+	objects, err := ListVolume(ctx, m.backend, mountPoint.Name)
+	if err != nil {
+		return err
+	}
+	for _, obj := range ExpiredObjects(objects, time.Now(), m.retainForDays) {
+		log.Printf("removing expired backup: %s", obj.Key)
+		if err := m.backend.Delete(ctx, obj.Key); err != nil {
+			return fmt.Errorf("failed deleting %s: %s", obj.Key, err)
+		}
+	}
+	return nil
+}
+
+// ArchiveName returns the name of a new archive of the volume. The name includes the time of day, so
+// that backing up a volume more than once a day does not replace the earlier archives of that day.
+func ArchiveName(volumeName string) string {
+	return archiveName(volumeName, time.Now())
+}
+
+func archiveName(volumeName string, t time.Time) string {
+	return fmt.Sprintf("%s-%d-%d-%d-%s.tar.gz", volumeName, t.Day(), t.Month(), t.Year(), t.Format("150405"))
+}
+
+// VolumeName returns the name of the volume an archive was created from.
+func VolumeName(key string) (string, bool) {
+	match := archiveRxp.FindStringSubmatch(key)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// WriteArchive writes a gzipped tar archive of the volume of the manifest to w, in the same
+// format as the archives created by the filesystem mode.
+func WriteArchive(ctx context.Context, cli *client.Client, m manifest.Manifest, w io.Writer) error {
+	manifestBytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return dockerutil.ArchiveVolume(ctx, cli, m.VolumeName, manifestBytes, w)
+}
+
+// ListVolume returns the archives of the given volume, newest first. Objects which are not
+// archives, or which belong to other volumes with the same prefix, are left out.
+func ListVolume(ctx context.Context, backend Backend, volumeName string) ([]Object, error) {
+	objects, err := backend.List(ctx, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	var result []Object
+	for _, obj := range objects {
+		if obj.VolumeName == volumeName {
+			result = append(result, obj)
+		}
+	}
+	SortNewestFirst(result)
+	return result, nil
+}
+
+// FindMostRecent returns the newest archive of the volume.
+func FindMostRecent(ctx context.Context, backend Backend, volumeName string) (Object, error) {
+	objects, err := ListVolume(ctx, backend, volumeName)
+	if err != nil {
+		return Object{}, err
+	}
+	if len(objects) == 0 {
+		return Object{}, fmt.Errorf("no backups found for volume %s", volumeName)
+	}
+	return objects[0], nil
+}
+
+// SortNewestFirst sorts objects by their modification time, newest first.
+func SortNewestFirst(objects []Object) {
+	sort.SliceStable(objects, func(i, j int) bool {
+		return objects[i].LastModified.After(objects[j].LastModified)
+	})
+}
+
+// ExpiredObjects returns the archives, sorted newest first, which are older than retainForDays.
+// The newest archive is never expired.
+func ExpiredObjects(objects []Object, now time.Time, retainForDays int) []Object {
+	if retainForDays <= 0 || len(objects) == 0 {
+		return nil
+	}
+	cutoff := now.AddDate(0, 0, -retainForDays)
+	var expired []Object
+	for _, obj := range objects[1:] {
+		if obj.LastModified.Before(cutoff) {
+			expired = append(expired, obj)
+		}
+	}
+	return expired
+}
+
+// NewObject returns an Object for the given key, with the volume name parsed from the key.
+// ok is false if the key is not an archive.
+func NewObject(key string, size int64, lastModified time.Time) (Object, bool) {
+	volumeName, ok := VolumeName(key)
+	if !ok {
+		return Object{}, false
+	}
+	return Object{
+		Key:          key,
+		VolumeName:   volumeName,
+		Size:         size,
+		LastModified: lastModified,
+	}, true
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolumeName(t *testing.T) {
+	name, ok := VolumeName("docker-volume-backup_config-18-7-2022.tar.gz")
+	require.True(t, ok)
+	require.Equal(t, "docker-volume-backup_config", name)
+
+	name, ok = VolumeName("db-1-18-7-2022-031500.tar.gz")
+	require.True(t, ok)
+	require.Equal(t, "db-1", name)
+
+	_, ok = VolumeName("docker-volume-backup_config-18-7-2022.zip")
+	require.False(t, ok)
+}
+
+func TestArchiveName(t *testing.T) {
+	morning := archiveName("config", time.Date(2022, 7, 18, 3, 15, 0, 0, time.UTC))
+	evening := archiveName("config", time.Date(2022, 7, 18, 21, 0, 5, 0, time.UTC))
+	require.Equal(t, "config-18-7-2022-031500.tar.gz", morning)
+	require.NotEqual(t, morning, evening, "backups on the same day should not replace each other")
+
+	name, ok := VolumeName(evening)
+	require.True(t, ok)
+	require.Equal(t, "config", name)
+}
+
+func TestExpiredObjects(t *testing.T) {
+	now := time.Date(2022, 10, 15, 0, 0, 0, 0, time.UTC)
+	objects := []Object{
+		{Key: "newest", LastModified: now.AddDate(0, 0, -20)},
+		{Key: "middle", LastModified: now.AddDate(0, 0, -25)},
+		{Key: "oldest", LastModified: now.AddDate(0, 0, -30)},
+	}
+
+	t.Run("no retention", func(t *testing.T) {
+		require.Empty(t, ExpiredObjects(objects, now, 0))
+	})
+
+	t.Run("newest is never expired", func(t *testing.T) {
+		expired := ExpiredObjects(objects, now, 7)
+		require.Len(t, expired, 2)
+		require.Equal(t, "middle", expired[0].Key)
+		require.Equal(t, "oldest", expired[1].Key)
+	})
+
+	t.Run("within retention", func(t *testing.T) {
+		expired := ExpiredObjects(objects, now, 28)
+		require.Len(t, expired, 1)
+		require.Equal(t, "oldest", expired[0].Key)
+	})
+}
+
+func TestSortNewestFirst(t *testing.T) {
+	now := time.Now()
+	objects := []Object{
+		{Key: "old", LastModified: now.Add(-time.Hour)},
+		{Key: "new", LastModified: now},
+	}
+	SortNewestFirst(objects)
+	require.Equal(t, "new", objects[0].Key)
+}
@@ -0,0 +1,166 @@
+package archiveutil
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// Root is the directory of an archive which contains the files of the volume.
+	Root = "data"
+	// ManifestName is the entry of an archive which describes the backup, it is outside of Root.
+	ManifestName = "manifest.json"
+	// xattrPrefix is the prefix of the PAX records which store extended attributes, including ACLs.
+	xattrPrefix = "SCHILY.xattr."
+	// sparseRecord is the PAX record which stores the data regions of sparse files.
+	sparseRecord = "DOCKERVOLUMEBACKUP.sparse"
+	// entriesRecord is the PAX record which stores the names of the entries of directories in
+	// incremental archives, see CreateIncremental.
+	entriesRecord = "DOCKERVOLUMEBACKUP.entries"
+)
+
+// RelPath returns the path of an archive entry relative to the root of the volume, it returns
+// false for entries outside of Root or entries escaping it.
+func RelPath(name string) (string, bool) {
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	if name == Root {
+		return "", true
+	}
+	rel := strings.TrimPrefix(name, Root+"/")
+	if rel == name || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+// Matches returns true if rel is one of paths or below one of them. Every path matches an empty list.
+func Matches(rel string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = path.Clean(strings.TrimPrefix(p, "/"))
+		if p == "." || rel == p || strings.HasPrefix(rel, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter copies the entries of the gzipped archive read from r which match paths to w as an
+// uncompressed tar stream in the same format. It returns the number of copied entries.
+func Filter(r io.Reader, paths []string, w io.Writer) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	tw := tar.NewWriter(w)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		rel, ok := RelPath(hdr.Name)
+		if !ok || rel == "" || !Matches(rel, paths) {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return n, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, tw.Close()
+}
+
+// Verify reads the whole gzipped archive read from r, and returns an error if it is corrupt.
+func Verify(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadManifest returns the manifest stored by Create in the gzipped archive read from r, or nil if
+// the archive has none, e.g. because it was created by tar. Only the start of the archive is read.
+func ReadManifest(r io.Reader) ([]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != ManifestName {
+		return nil, nil
+	}
+	return io.ReadAll(tr)
+}
+
+// Walk calls fn with the path relative to the root of the volume and the header of each entry of
+// the gzipped archive read from r, in archive order, without extracting anything. The root itself
+// has the path "". It returns the manifest of the archive, or nil if it has none.
+func Walk(r io.Reader, fn func(rel string, hdr *tar.Header) error) ([]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	var manifest []byte
+	for first := true; ; first = false {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return manifest, nil
+		}
+		if err != nil {
+			return manifest, err
+		}
+		if first && hdr.Name == ManifestName {
+			if manifest, err = io.ReadAll(tr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rel, ok := RelPath(hdr.Name)
+		if !ok {
+			continue
+		}
+		if err := fn(rel, hdr); err != nil {
+			return manifest, err
+		}
+	}
+}
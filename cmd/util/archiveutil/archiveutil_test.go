@@ -0,0 +1,240 @@
+package archiveutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+var modTime = time.Date(2022, 10, 15, 3, 0, 0, 0, time.UTC)
+
+// testArchive returns a gzipped archive of a volume in the format created by the backups.
+func testArchive(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	entries := []struct {
+		hdr      tar.Header
+		contents string
+	}{
+		{hdr: tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{hdr: tar.Header{Name: "data/config/", Typeflag: tar.TypeDir, Mode: 0o700}},
+		{hdr: tar.Header{Name: "data/config/app.yml", Typeflag: tar.TypeReg, Mode: 0o640}, contents: "port: 80"},
+		{hdr: tar.Header{Name: "data/config/app.yml.bak", Typeflag: tar.TypeReg, Mode: 0o600}, contents: "port: 8080"},
+		{hdr: tar.Header{Name: "data/current", Typeflag: tar.TypeSymlink, Linkname: "config/app.yml"}},
+		{hdr: tar.Header{Name: "data/db.sqlite", Typeflag: tar.TypeReg, Mode: 0o644}, contents: "db"},
+	}
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.contents))
+		hdr.ModTime = modTime
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(e.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestRelPath(t *testing.T) {
+	for name, expected := range map[string]string{
+		"data":                "",
+		"data/":               "",
+		"./data/config/":      "config",
+		"data/config/app.yml": "config/app.yml",
+	} {
+		rel, ok := RelPath(name)
+		require.True(t, ok, name)
+		require.Equal(t, expected, rel, name)
+	}
+	for _, name := range []string{"etc/passwd", "data/../etc/passwd", "database/file"} {
+		_, ok := RelPath(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	require.True(t, Matches("config/app.yml", []string{"config/app.yml"}))
+	require.True(t, Matches("config/app.yml", []string{"/config/"}))
+	require.False(t, Matches("config/app.yml.bak", []string{"config/app.yml"}))
+	require.True(t, Matches("anything", nil))
+}
+
+func TestExtract(t *testing.T) {
+	t.Run("single file", func(t *testing.T) {
+		dir := t.TempDir()
+		n, err := Extract(bytes.NewReader(testArchive(t)), dir, []string{"config/app.yml"})
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+
+		contents, err := os.ReadFile(filepath.Join(dir, "config", "app.yml"))
+		require.NoError(t, err)
+		require.Equal(t, "port: 80", string(contents))
+		info, err := os.Stat(filepath.Join(dir, "config", "app.yml"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+		require.True(t, info.ModTime().Equal(modTime))
+
+		_, err = os.Stat(filepath.Join(dir, "config", "app.yml.bak"))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("everything", func(t *testing.T) {
+		dir := t.TempDir()
+		n, err := Extract(bytes.NewReader(testArchive(t)), dir, nil)
+		require.NoError(t, err)
+		require.Equal(t, 6, n)
+
+		link, err := os.Readlink(filepath.Join(dir, "current"))
+		require.NoError(t, err)
+		require.Equal(t, "config/app.yml", link)
+		info, err := os.Stat(filepath.Join(dir, "config"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+		require.True(t, info.ModTime().Equal(modTime))
+	})
+}
+
+func TestCheckDir(t *testing.T) {
+	extract := func(t *testing.T) string {
+		dir := t.TempDir()
+		_, err := Extract(bytes.NewReader(testArchive(t)), dir, nil)
+		require.NoError(t, err)
+		return dir
+	}
+
+	t.Run("complete", func(t *testing.T) {
+		require.NoError(t, CheckDir(bytes.NewReader(testArchive(t)), extract(t), nil))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		dir := extract(t)
+		require.NoError(t, os.Remove(filepath.Join(dir, "db.sqlite")))
+		require.Error(t, CheckDir(bytes.NewReader(testArchive(t)), dir, nil))
+		require.NoError(t, CheckDir(bytes.NewReader(testArchive(t)), dir, []string{"config"}), "only the given paths should be checked")
+	})
+
+	t.Run("truncated file", func(t *testing.T) {
+		dir := extract(t)
+		require.NoError(t, os.Truncate(filepath.Join(dir, "config", "app.yml"), 2))
+		require.Error(t, CheckDir(bytes.NewReader(testArchive(t)), dir, nil))
+	})
+
+	t.Run("different type", func(t *testing.T) {
+		dir := extract(t)
+		require.NoError(t, os.Remove(filepath.Join(dir, "current")))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "current"), nil, 0o644))
+		require.Error(t, CheckDir(bytes.NewReader(testArchive(t)), dir, nil))
+	})
+}
+
+func TestCheckTar(t *testing.T) {
+	var complete bytes.Buffer
+	_, err := Filter(bytes.NewReader(testArchive(t)), nil, &complete)
+	require.NoError(t, err)
+	require.NoError(t, CheckTar(bytes.NewReader(testArchive(t)), &complete, nil))
+
+	var partial bytes.Buffer
+	_, err = Filter(bytes.NewReader(testArchive(t)), []string{"config"}, &partial)
+	require.NoError(t, err)
+	require.Error(t, CheckTar(bytes.NewReader(testArchive(t)), &partial, nil))
+}
+
+func TestFilter(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := Filter(bytes.NewReader(testArchive(t)), []string{"config"}, &buf)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal(t, []string{"data/config/", "data/config/app.yml", "data/config/app.yml.bak"}, names)
+}
+
+func TestExtractMetadata(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("ownership can only be restored as root")
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name:       "data/owned",
+		Typeflag:   tar.TypeReg,
+		Mode:       0o4750,
+		Uid:        1234,
+		Gid:        5678,
+		ModTime:    modTime,
+		PAXRecords: map[string]string{"SCHILY.xattr.user.comment": "kept"},
+		Format:     tar.FormatPAX,
+	}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+
+	dir := t.TempDir()
+	_, err := Extract(&buf, dir, nil)
+	require.NoError(t, err)
+
+	target := filepath.Join(dir, "owned")
+	var stat unix.Stat_t
+	require.NoError(t, unix.Lstat(target, &stat))
+	require.Equal(t, uint32(1234), stat.Uid)
+	require.Equal(t, uint32(5678), stat.Gid)
+	require.Equal(t, uint32(0o4750), stat.Mode&0o7777)
+
+	value := make([]byte, 16)
+	n, err := unix.Lgetxattr(target, "user.comment", value)
+	if err == unix.ENOTSUP {
+		return
+	}
+	require.NoError(t, err)
+	require.Equal(t, "kept", string(value[:n]))
+}
+
+func TestReadManifestWithoutManifest(t *testing.T) {
+	manifest, err := ReadManifest(bytes.NewReader(testArchive(t)))
+	require.NoError(t, err)
+	require.Nil(t, manifest)
+}
+
+func TestWalk(t *testing.T) {
+	var paths []string
+	manifest, err := Walk(bytes.NewReader(testArchive(t)), func(rel string, hdr *tar.Header) error {
+		paths = append(paths, rel)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Nil(t, manifest)
+	require.Equal(t, []string{"", "config", "config/app.yml", "config/app.yml.bak", "current", "db.sqlite"}, paths)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0o644))
+	var buf bytes.Buffer
+	require.NoError(t, Create(dir, &buf, []byte(`{"volumeName":"data"}`)))
+	paths = nil
+	manifest, err = Walk(&buf, func(rel string, hdr *tar.Header) error {
+		paths = append(paths, rel)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, `{"volumeName":"data"}`, string(manifest))
+	require.Equal(t, []string{"", "file"}, paths)
+}
@@ -0,0 +1,300 @@
+package archiveutil
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Create writes a gzipped tar archive of the contents of dir to w, with every entry below Root.
+// Owners are stored numerically, together with permissions, times, extended attributes (which
+// include ACLs), hardlinks, special files and the data regions of sparse files, so that Extract
+// restores dir as it was. Sockets can not be archived and are skipped. If manifest is not nil,
+// it is stored as the first entry, see ReadManifest.
+func Create(dir string, w io.Writer, manifest []byte) error {
+	_, err := create(dir, w, manifest, nil, false)
+	return err
+}
+
+// CreateIncremental is Create for a chain of incremental archives. Only the files which changed since
+// previous was taken are archived, all of them if previous is nil, and the snapshot to create the next
+// archive of the chain against is returned. Directories are always archived, together with the names
+// of their entries, so that Extract removes the files which were deleted since the previous archive.
+func CreateIncremental(dir string, w io.Writer, manifest []byte, previous Snapshot) (Snapshot, error) {
+	return create(dir, w, manifest, previous, true)
+}
+
+func create(dir string, w io.Writer, manifest []byte, previous Snapshot, incremental bool) (Snapshot, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeManifest(tw, manifest); err != nil {
+		return nil, err
+	}
+	// links maps files with more than one link to the name of their first entry.
+	links := map[fileID]string{}
+	next := Snapshot{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(Root, filepath.ToSlash(rel))
+		if !incremental {
+			return addEntry(tw, p, name, links, nil)
+		}
+
+		if d.IsDir() {
+			entries, err := os.ReadDir(p)
+			if err != nil {
+				return err
+			}
+			names := make([]string, 0, len(entries))
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			return addEntry(tw, p, name, links, map[string]string{entriesRecord: formatEntries(names)})
+		}
+		state, id, err := stateOf(p)
+		if err != nil {
+			return err
+		}
+		next[filepath.ToSlash(rel)] = state
+		if previous != nil && previous[filepath.ToSlash(rel)] == state {
+			// later links to an unchanged file link to the file extracted from an earlier archive.
+			if _, ok := links[id]; !ok {
+				links[id] = name
+			}
+			return nil
+		}
+		return addEntry(tw, p, name, links, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return next, gz.Close()
+}
+
+// FromTar writes a gzipped archive in the same format as Create from the uncompressed tar stream r,
+// whose entries must already be below Root, e.g. the stream of the docker archive api. Unlike Create,
+// sparse files are stored without their data regions, so they are restored without holes.
+func FromTar(r io.Reader, w io.Writer, manifest []byte) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeManifest(tw, manifest); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := RelPath(hdr.Name); !ok {
+			return fmt.Errorf("entry %s is not below %s", hdr.Name, Root)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// writeManifest writes the manifest as the first entry of an archive, if it is not nil.
+func writeManifest(tw *tar.Writer, manifest []byte) error {
+	if manifest == nil {
+		return nil
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     ManifestName,
+		Typeflag: tar.TypeReg,
+		Mode:     0o644,
+		Size:     int64(len(manifest)),
+		ModTime:  time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(manifest)
+	return err
+}
+
+// fileID identifies a file independent of its name.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// addEntry writes the entry of the file at p, with the given additional PAX records.
+func addEntry(tw *tar.Writer, p, name string, links map[fileID]string, records map[string]string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+	var stat unix.Stat_t
+	if err := unix.Lstat(p, &stat); err != nil {
+		return err
+	}
+
+	var linkname string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if linkname, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, linkname)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Format = tar.FormatPAX
+	// user names inside containers do not match the host, so only the numeric owner is kept.
+	hdr.Uname, hdr.Gname = "", ""
+	// the change time can not be restored.
+	hdr.ChangeTime = time.Time{}
+
+	if hdr.Typeflag == tar.TypeReg && stat.Nlink > 1 {
+		id := fileID{dev: uint64(stat.Dev), ino: stat.Ino}
+		if first, ok := links[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return tw.WriteHeader(hdr)
+		}
+		links[id] = name
+	}
+
+	xattrs, err := readXattrs(p)
+	if err != nil {
+		return err
+	}
+	hdr.PAXRecords = map[string]string{}
+	for attr, value := range xattrs {
+		hdr.PAXRecords[xattrPrefix+attr] = value
+	}
+	for key, value := range records {
+		hdr.PAXRecords[key] = value
+	}
+
+	if hdr.Typeflag != tar.TypeReg {
+		return tw.WriteHeader(hdr)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// files using fewer blocks than their size have holes.
+	if stat.Blocks*512 < stat.Size {
+		regions, err := dataRegions(f, stat.Size)
+		if err != nil {
+			return err
+		}
+		hdr.PAXRecords[sparseRecord] = formatRegions(regions)
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// holes are read as zeros, which compress well.
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// dataRegions returns the regions of the file which contain data, its holes are left out.
+func dataRegions(f *os.File, size int64) ([]region, error) {
+	var regions []region
+	fd := int(f.Fd())
+	var offset int64
+	for offset < size {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// there is no data after offset.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, region{offset: start, length: end - start})
+		offset = end
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return regions, nil
+}
+
+// readXattrs returns the extended attributes of p without following symlinks.
+func readXattrs(p string) (map[string]string, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+	for _, attr := range splitNull(buf[:size]) {
+		valueSize, err := unix.Lgetxattr(p, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(p, attr, value); err != nil {
+			return nil, err
+		}
+		xattrs[attr] = string(value[:valueSize])
+	}
+	return xattrs, nil
+}
+
+// splitNull splits a list of null terminated strings.
+func splitNull(buf []byte) []string {
+	var result []string
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				result = append(result, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return result
+}
@@ -0,0 +1,221 @@
+package archiveutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// createTestVolume creates a directory with varied metadata, as found in volumes.
+func createTestVolume(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	mtime := time.Date(2022, 10, 15, 3, 0, 0, 123456789, time.UTC)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "config", "private"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config", "app.yml"), []byte("port: 80"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config", "private", "key"), []byte("secret"), 0o600))
+	require.NoError(t, os.Chmod(filepath.Join(dir, "config", "private"), 0o500))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh"), 0o755))
+	require.NoError(t, os.Chmod(filepath.Join(dir, "run.sh"), 0o4755))
+	require.NoError(t, os.Symlink("config/app.yml", filepath.Join(dir, "current")))
+	require.NoError(t, os.Link(filepath.Join(dir, "config", "app.yml"), filepath.Join(dir, "app.yml.link")))
+	require.NoError(t, unix.Mkfifo(filepath.Join(dir, "pipe"), 0o640))
+
+	// a sparse file with data between two holes.
+	sparse, err := os.Create(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	_, err = sparse.WriteAt(bytes.Repeat([]byte("x"), 4096), 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, sparse.Truncate(4<<20))
+	require.NoError(t, sparse.Close())
+
+	// extended attributes are not supported by every filesystem.
+	_ = unix.Lsetxattr(filepath.Join(dir, "run.sh"), "user.origin", []byte("backup\x00test"), 0)
+
+	if os.Geteuid() == 0 {
+		require.NoError(t, os.Lchown(filepath.Join(dir, "config"), 1234, 5678))
+		require.NoError(t, os.Lchown(filepath.Join(dir, "current"), 1234, 5678))
+		// chown clears the setuid bit.
+		require.NoError(t, os.Lchown(filepath.Join(dir, "run.sh"), 1000, 1000))
+		require.NoError(t, os.Chmod(filepath.Join(dir, "run.sh"), 0o4755))
+	}
+
+	// times are set last, since creating files changes the times of their directory.
+	require.NoError(t, filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		ts := []unix.Timespec{unix.NsecToTimespec(mtime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+		return unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW)
+	}))
+	return dir
+}
+
+// fileState is everything about a file which must survive a backup and restore.
+type fileState struct {
+	mode     uint32
+	uid, gid uint32
+	size     int64
+	mtime    unix.Timespec
+	contents string
+	link     string
+	xattrs   map[string]string
+}
+
+func readTree(t *testing.T, dir string) map[string]fileState {
+	t.Helper()
+	tree := map[string]fileState{}
+	require.NoError(t, filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		rel, err := filepath.Rel(dir, p)
+		require.NoError(t, err)
+
+		var stat unix.Stat_t
+		require.NoError(t, unix.Lstat(p, &stat))
+		state := fileState{mode: stat.Mode, uid: stat.Uid, gid: stat.Gid, size: stat.Size, mtime: stat.Mtim}
+		switch stat.Mode & unix.S_IFMT {
+		case unix.S_IFREG:
+			contents, err := os.ReadFile(p)
+			require.NoError(t, err)
+			state.contents = string(contents)
+		case unix.S_IFLNK:
+			state.link, err = os.Readlink(p)
+			require.NoError(t, err)
+		}
+		if rel == "." {
+			// the root is the temporary directory, whose metadata is not part of the volume.
+			state.mtime = unix.Timespec{}
+		}
+		state.xattrs, err = readXattrs(p)
+		require.NoError(t, err)
+		tree[rel] = state
+		return nil
+	}))
+	return tree
+}
+
+func TestCreateAndExtract(t *testing.T) {
+	source := createTestVolume(t)
+
+	var archive bytes.Buffer
+	manifest := []byte(`{"volumeName":"config"}`)
+	require.NoError(t, Create(source, &archive, manifest))
+	require.NoError(t, Verify(bytes.NewReader(archive.Bytes())))
+
+	target := t.TempDir()
+	_, err := Extract(bytes.NewReader(archive.Bytes()), target, nil)
+	require.NoError(t, err)
+
+	t.Run("restores identical files", func(t *testing.T) {
+		expected := readTree(t, source)
+		actual := readTree(t, target)
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("stores the manifest", func(t *testing.T) {
+		stored, err := ReadManifest(bytes.NewReader(archive.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, manifest, stored)
+	})
+
+	t.Run("keeps hardlinks", func(t *testing.T) {
+		var original, link unix.Stat_t
+		require.NoError(t, unix.Lstat(filepath.Join(target, "config", "app.yml"), &original))
+		require.NoError(t, unix.Lstat(filepath.Join(target, "app.yml.link"), &link))
+		require.Equal(t, original.Ino, link.Ino)
+	})
+
+	t.Run("keeps sparse files sparse", func(t *testing.T) {
+		var stat unix.Stat_t
+		require.NoError(t, unix.Lstat(filepath.Join(target, "disk.img"), &stat))
+		require.Less(t, stat.Blocks*512, stat.Size)
+	})
+}
+
+func TestCreateIncremental(t *testing.T) {
+	source := createTestVolume(t)
+
+	var full bytes.Buffer
+	snapshot, err := CreateIncremental(source, &full, nil, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(source, "config", "app.yml"), []byte("port: 8080"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(source, "new.txt"), []byte("new"), 0o644))
+	require.NoError(t, os.Remove(filepath.Join(source, "run.sh")))
+	require.NoError(t, os.Remove(filepath.Join(source, "pipe")))
+	require.NoError(t, os.Mkdir(filepath.Join(source, "pipe"), 0o755))
+
+	var incremental bytes.Buffer
+	_, err = CreateIncremental(source, &incremental, nil, snapshot)
+	require.NoError(t, err)
+
+	t.Run("only archives changes", func(t *testing.T) {
+		var names []string
+		_, err := Walk(bytes.NewReader(incremental.Bytes()), func(rel string, hdr *tar.Header) error {
+			names = append(names, rel)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Contains(t, names, "config/app.yml")
+		require.Contains(t, names, "app.yml.link")
+		require.Contains(t, names, "new.txt")
+		require.NotContains(t, names, "config/private/key")
+		require.NotContains(t, names, "disk.img")
+	})
+
+	t.Run("extracting the chain restores the latest state", func(t *testing.T) {
+		target := t.TempDir()
+		for _, archive := range [][]byte{full.Bytes(), incremental.Bytes()} {
+			_, err := Extract(bytes.NewReader(archive), target, nil)
+			require.NoError(t, err)
+		}
+		require.Equal(t, readTree(t, source), readTree(t, target))
+	})
+}
+
+func TestVerify(t *testing.T) {
+	var archive bytes.Buffer
+	require.NoError(t, Create(createTestVolume(t), &archive, nil))
+
+	corrupt := archive.Bytes()[:archive.Len()/2]
+	require.Error(t, Verify(bytes.NewReader(corrupt)))
+}
+
+func TestFromTar(t *testing.T) {
+	var archive bytes.Buffer
+	require.NoError(t, Create(createTestVolume(t), &archive, nil))
+	// the entries of an archive are in the same format as the docker archive api.
+	var stream bytes.Buffer
+	_, err := Filter(bytes.NewReader(archive.Bytes()), nil, &stream)
+	require.NoError(t, err)
+
+	var converted bytes.Buffer
+	manifest := []byte(`{"volumeName":"config"}`)
+	require.NoError(t, FromTar(bytes.NewReader(stream.Bytes()), &converted, manifest))
+
+	stored, err := ReadManifest(bytes.NewReader(converted.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, manifest, stored)
+
+	target := t.TempDir()
+	_, err = Extract(bytes.NewReader(converted.Bytes()), target, nil)
+	require.NoError(t, err)
+	contents, err := os.ReadFile(filepath.Join(target, "config", "app.yml"))
+	require.NoError(t, err)
+	require.Equal(t, "port: 80", string(contents))
+
+	t.Run("entries outside of the root", func(t *testing.T) {
+		var outside bytes.Buffer
+		tw := tar.NewWriter(&outside)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg}))
+		require.NoError(t, tw.Close())
+		require.Error(t, FromTar(&outside, io.Discard, nil))
+	})
+}
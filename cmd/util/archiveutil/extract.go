@@ -0,0 +1,396 @@
+package archiveutil
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extract unpacks the entries of the gzipped archive read from r which match paths into dir,
+// relative to the root of the volume. It returns the number of extracted entries.
+//
+// Permissions, times, extended attributes, hardlinks, special files and the holes of sparse files
+// are restored. Ownership is restored numerically, since user names inside containers do not match
+// the host, and, like special files other than fifos, only when running as root. Files which were
+// deleted before an archive created by CreateIncremental are removed from their directories, so that
+// extracting each archive of a chain in order restores the volume as it was for the last one.
+func Extract(r io.Reader, dir string, paths []string) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	n := 0
+	// the metadata of directories is set last, since extracting their contents changes their times,
+	// and their permissions may not allow extracting their contents.
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		rel, ok := RelPath(hdr.Name)
+		if !ok || !Matches(rel, paths) {
+			continue
+		}
+		if err := extractEntry(dir, rel, hdr, tr); err != nil {
+			return n, fmt.Errorf("failed extracting %s: %s", rel, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+		n++
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, _ := RelPath(dirs[i].Name)
+		if err := setMetadata(filepath.Join(dir, filepath.FromSlash(rel)), dirs[i]); err != nil {
+			return n, fmt.Errorf("failed extracting %s: %s", rel, err)
+		}
+	}
+	return n, nil
+}
+
+func extractEntry(dir, rel string, hdr *tar.Header, r io.Reader) error {
+	target := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := checkNoSymlinkParents(dir, rel); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		// a file may have been replaced by a directory since the previous archive of a chain.
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(target, 0o700); err != nil {
+			return err
+		}
+		if record, ok := hdr.PAXRecords[entriesRecord]; ok {
+			return removeDeleted(target, parseEntries(record))
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		if err := extractFile(target, hdr, r); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		// hardlinks share the metadata of the file they link to.
+		linkRel, ok := RelPath(hdr.Linkname)
+		if !ok {
+			return fmt.Errorf("hardlink to %s outside of the volume", hdr.Linkname)
+		}
+		return os.Link(filepath.Join(dir, filepath.FromSlash(linkRel)), target)
+	case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+		if hdr.Typeflag != tar.TypeFifo && os.Geteuid() != 0 {
+			log.Printf("skipping device %s, devices can only be created as root", target)
+			return nil
+		}
+		if err := unix.Mknod(target, deviceMode(hdr), int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+			return err
+		}
+	default:
+		log.Printf("skipping %s of unsupported type %c", target, hdr.Typeflag)
+		return nil
+	}
+	return setMetadata(target, hdr)
+}
+
+// extractFile writes the contents of a regular file. The holes of sparse files are skipped
+// instead of written, so that they stay sparse.
+func extractFile(target string, hdr *tar.Header, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	record, sparse := hdr.PAXRecords[sparseRecord]
+	if !sparse {
+		if _, err := io.Copy(f, r); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	regions, err := parseRegions(record, hdr.Size)
+	if err != nil {
+		return err
+	}
+	var pos int64
+	for _, region := range regions {
+		if _, err := io.CopyN(io.Discard, r, region.offset-pos); err != nil {
+			return err
+		}
+		if _, err := f.Seek(region.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(f, r, region.length); err != nil {
+			return err
+		}
+		pos = region.offset + region.length
+	}
+	// a hole at the end of the file is created by the truncate.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	if err := f.Truncate(hdr.Size); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// setMetadata applies the ownership, permissions, extended attributes and times of the entry to target.
+func setMetadata(target string, hdr *tar.Header) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, xattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, xattrPrefix)
+		if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil {
+			log.Printf("failed setting extended attribute %s of %s: %s", attr, target, err)
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		ts := []unix.Timespec{unix.NsecToTimespec(accessTime(hdr).UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+		return unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	// chown clears the setuid and setgid bits, so the mode is set afterwards.
+	if err := os.Chmod(target, hdr.FileInfo().Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, accessTime(hdr), hdr.ModTime)
+}
+
+// removeDeleted removes the entries of dir which are not in names.
+func removeDeleted(dir string, names map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !names[e.Name()] {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkNoSymlinkParents makes sure that extracting rel does not write through a symlink which was
+// extracted earlier, and so outside of dir.
+func checkNoSymlinkParents(dir, rel string) error {
+	parts := strings.Split(rel, "/")
+	current := dir
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is below the symlink %s", rel, current)
+		}
+	}
+	return nil
+}
+
+func deviceMode(hdr *tar.Header) uint32 {
+	mode := uint32(hdr.Mode) & 0o7777
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		return mode | unix.S_IFCHR
+	case tar.TypeBlock:
+		return mode | unix.S_IFBLK
+	default:
+		return mode | unix.S_IFIFO
+	}
+}
+
+func accessTime(hdr *tar.Header) time.Time {
+	if hdr.AccessTime.IsZero() {
+		return hdr.ModTime
+	}
+	return hdr.AccessTime
+}
+
+// region is a part of a sparse file which contains data.
+type region struct {
+	offset int64
+	length int64
+}
+
+// formatRegions formats the data regions of a sparse file as offset,length pairs.
+func formatRegions(regions []region) string {
+	if len(regions) == 0 {
+		// PAX records can not be empty, a file without data has a single empty region.
+		regions = []region{{}}
+	}
+	parts := make([]string, 0, 2*len(regions))
+	for _, r := range regions {
+		parts = append(parts, strconv.FormatInt(r.offset, 10), strconv.FormatInt(r.length, 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseRegions parses the data regions of a sparse file of the given size, which must be sorted and
+// must not overlap.
+func parseRegions(s string, size int64) ([]region, error) {
+	parts := strings.Split(s, ",")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("invalid sparse regions %q", s)
+	}
+	var regions []region
+	var end int64
+	for i := 0; i < len(parts); i += 2 {
+		offset, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sparse regions %q", s)
+		}
+		length, err := strconv.ParseInt(parts[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sparse regions %q", s)
+		}
+		if offset < end || length < 0 || offset+length > size {
+			return nil, fmt.Errorf("invalid sparse regions %q", s)
+		}
+		regions = append(regions, region{offset: offset, length: length})
+		end = offset + length
+	}
+	return regions, nil
+}
+
+// CheckDir returns an error if an entry of the gzipped archive read from r which matches paths is
+// missing from dir, or differs from the entry in type or, for regular files, in size. It checks that
+// the archive was extracted completely into dir, without comparing contents.
+func CheckDir(r io.Reader, dir string, paths []string) error {
+	_, err := Walk(r, func(rel string, hdr *tar.Header) error {
+		if rel == "" || !Matches(rel, paths) {
+			return nil
+		}
+		info, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return fmt.Errorf("%s was not extracted: %s", hdr.Name, err)
+		}
+		return checkEntry(hdr, info.Mode().Type(), info.Size())
+	})
+	return err
+}
+
+// CheckTar is CheckDir for a directory read as an uncompressed tar stream with every entry below
+// Root, e.g. a volume read with the docker archive api.
+func CheckTar(r io.Reader, dir io.Reader, paths []string) error {
+	type entry struct {
+		mode fs.FileMode
+		size int64
+	}
+	entries := map[string]entry{}
+	tr := tar.NewReader(dir)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rel, ok := RelPath(hdr.Name); ok {
+			entries[rel] = entry{mode: hdr.FileInfo().Mode().Type(), size: hdr.Size}
+			if hdr.Typeflag == tar.TypeLink {
+				// the size of hardlinks is only stored in the entry of the file they link to.
+				entries[rel] = entry{size: -1}
+			}
+		}
+	}
+
+	_, err := Walk(r, func(rel string, hdr *tar.Header) error {
+		if rel == "" || !Matches(rel, paths) {
+			return nil
+		}
+		e, ok := entries[rel]
+		if !ok {
+			return fmt.Errorf("%s was not extracted", hdr.Name)
+		}
+		return checkEntry(hdr, e.mode, e.size)
+	})
+	return err
+}
+
+// checkEntry compares the type and size of an extracted file with the archive entry it was extracted
+// from. A negative size is not compared. Entries which Extract skips are not compared.
+func checkEntry(hdr *tar.Header, mode fs.FileMode, size int64) error {
+	var expected fs.FileMode
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeLink:
+	case tar.TypeDir:
+		expected = fs.ModeDir
+	case tar.TypeSymlink:
+		expected = fs.ModeSymlink
+	case tar.TypeFifo:
+		expected = fs.ModeNamedPipe
+	case tar.TypeChar, tar.TypeBlock:
+		if os.Geteuid() != 0 {
+			return nil
+		}
+		expected = hdr.FileInfo().Mode().Type()
+	default:
+		return nil
+	}
+	if mode != expected {
+		return fmt.Errorf("%s was extracted as %s instead of %s", hdr.Name, typeName(mode), typeName(expected))
+	}
+	if hdr.Typeflag == tar.TypeReg && size >= 0 && size != hdr.Size {
+		return fmt.Errorf("%s was extracted with %d instead of %d bytes", hdr.Name, size, hdr.Size)
+	}
+	return nil
+}
+
+func typeName(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "a file"
+	case mode&fs.ModeDir != 0:
+		return "a directory"
+	case mode&fs.ModeSymlink != 0:
+		return "a symlink"
+	default:
+		return fmt.Sprintf("%v", mode)
+	}
+}
@@ -0,0 +1,55 @@
+package archiveutil
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileState is what is compared to find the files which changed since the previous archive of a chain.
+// The change time is included, since changing the permissions, owner or extended attributes of a
+// file does not change its modification time.
+type FileState struct {
+	ModTime    int64  `json:"mtime"`
+	ChangeTime int64  `json:"ctime"`
+	Size       int64  `json:"size"`
+	Inode      uint64 `json:"inode"`
+}
+
+// Snapshot is the state of each file, other than directories, by path relative to the root of the
+// volume, when an incremental archive was created.
+type Snapshot map[string]FileState
+
+// stateOf returns the state of the file at p without following symlinks.
+func stateOf(p string) (FileState, fileID, error) {
+	var stat unix.Stat_t
+	if err := unix.Lstat(p, &stat); err != nil {
+		return FileState{}, fileID{}, err
+	}
+	return FileState{
+		ModTime:    stat.Mtim.Nano(),
+		ChangeTime: stat.Ctim.Nano(),
+		Size:       stat.Size,
+		Inode:      stat.Ino,
+	}, fileID{dev: uint64(stat.Dev), ino: stat.Ino}, nil
+}
+
+// formatEntries formats the names of the entries of a directory, each followed by a null byte, which
+// can not be part of a name. PAX records can not be empty, so an empty directory is a single null byte.
+func formatEntries(names []string) string {
+	if len(names) == 0 {
+		return "\x00"
+	}
+	return strings.Join(names, "\x00") + "\x00"
+}
+
+// parseEntries parses the names formatted by formatEntries.
+func parseEntries(s string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(s, "\x00") {
+		if name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
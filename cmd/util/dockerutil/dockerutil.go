@@ -1,53 +1,73 @@
 package dockerutil
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"log"
+	"strings"
 
 	"docker-volume-backup/cmd/label"
 	"docker-volume-backup/cmd/util/randutil"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // RunCommandInMountedContainer creates a container which mounts the data to be backed up, and
 // executes a given command.
 func RunCommandInMountedContainer(ctx context.Context, hostPathForBackups string, cli *client.Client, mountPoint types.MountPoint, cmd []string) error {
+	return RunImageCommandInMountedContainer(ctx, "busybox:latest", hostPathForBackups, cli, mountPoint, cmd)
+}
+
+// RunImageCommandInMountedContainer is the same as RunCommandInMountedContainer, but allows for
+// an image other than busybox to be used. The image must already exist.
+func RunImageCommandInMountedContainer(ctx context.Context, image, hostPathForBackups string, cli *client.Client, mountPoint types.MountPoint, cmd []string) error {
+	mounts := []mount.Mount{
+		// the directory which contains the data to be backed up
+		{
+			Type:     mount.TypeVolume,
+			Source:   mountPoint.Name,
+			Target:   "/data",
+			ReadOnly: false,
+		},
+		// hostpath where the backups will be stored
+		{
+			Type:     mount.TypeBind,
+			Source:   hostPathForBackups,
+			Target:   "/backups",
+			ReadOnly: false,
+		},
+	}
+	containerName := fmt.Sprintf("backup-%s-%s", mountPoint.Name, randutil.StringRunes(5))
+	return RunImageCommandWithMounts(ctx, image, containerName, cli, mounts, cmd)
+}
+
+// RunImageCommandWithMounts creates a container with the given mounts, executes a given command
+// and waits for it to exit. The image must already exist.
+func RunImageCommandWithMounts(ctx context.Context, image, containerName string, cli *client.Client, mounts []mount.Mount, cmd []string) error {
 	createConfig := &container.Config{
 		Cmd:    cmd,
-		Image:  "busybox:latest",
+		Image:  image,
 		Labels: label.Task(),
 	}
 
 	hostConfig := &container.HostConfig{
-		Mounts: []mount.Mount{
-			// the directory which contains the data to be backed up
-			{
-				Type:     mount.TypeVolume,
-				Source:   mountPoint.Name,
-				Target:   "/data",
-				ReadOnly: false,
-			},
-			// hostpath where the backups will be stored
-			{
-				Type:     mount.TypeBind,
-				Source:   hostPathForBackups,
-				Target:   "/backups",
-				ReadOnly: false,
-			},
-		},
+		Mounts: mounts,
 	}
 
 	networkConfig := &network.NetworkingConfig{}
 	platform := &specs.Platform{}
 
-	containerName := fmt.Sprintf("backup-%s-%s", mountPoint.Name, randutil.StringRunes(5))
 	body, err := cli.ContainerCreate(ctx, createConfig, hostConfig, networkConfig, platform, containerName)
 
 	if err != nil {
@@ -79,3 +99,498 @@ func WaitForContainerToExit(ctx context.Context, cli *client.Client, body contai
 	}
 	return nil
 }
+
+// PullImage pulls the given image and waits for the pull to complete.
+func PullImage(ctx context.Context, cli *client.Client, image string) error {
+	resp, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	// the image is only available once the whole response has been read.
+	_, err = io.Copy(io.Discard, resp)
+	return err
+}
+
+// ReadVolume returns a tar stream of the contents of the given volume, with each entry
+// prefixed by "data/". The volume is read through a container which is never started,
+// and which is removed when the returned reader is closed.
+func ReadVolume(ctx context.Context, cli *client.Client, volumeName string) (io.ReadCloser, error) {
+	id, err := createVolumeContainer(ctx, cli, volumeName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, _, err := cli.CopyFromContainer(ctx, id, "/data")
+	if err != nil {
+		_ = removeContainer(ctx, cli, id)
+		return nil, err
+	}
+	return &containerReadCloser{ReadCloser: rc, remove: func() error {
+		return removeContainer(ctx, cli, id)
+	}}, nil
+}
+
+// StagingDir is where new contents are written inside a volume mounted at /data before they
+// replace its current contents, so that the volume is left untouched if writing them fails.
+const StagingDir = "/data/.docker-volume-backup-restore"
+
+// ReplaceWithStagedScript is a shell script which replaces the contents of the volume mounted at
+// /data with the data directory inside StagingDir, and then removes StagingDir.
+const ReplaceWithStagedScript = `set -e
+find /data -mindepth 1 -maxdepth 1 ! -path ` + StagingDir + ` -exec rm -rf {} \;
+if [ -d ` + StagingDir + `/data ]; then
+	find ` + StagingDir + `/data -mindepth 1 -maxdepth 1 -exec mv {} /data/ \;
+fi
+rm -rf ` + StagingDir + `
+`
+
+// WriteVolume replaces the contents of the given volume with the contents of a tar stream
+// in the same format as returned by ReadVolume. The stream is written to StagingDir first, and
+// only replaces the current contents once it has been written completely. The busybox image
+// must already exist.
+func WriteVolume(ctx context.Context, cli *client.Client, volumeName string, r io.Reader) error {
+	// remove anything left over from an earlier failed write.
+	id, err := runVolumeContainer(ctx, cli, volumeName, fmt.Sprintf("rm -rf %[1]s && mkdir %[1]s", StagingDir))
+	if err != nil {
+		return err
+	}
+	// files can still be copied into the container once it has exited.
+	err = cli.CopyToContainer(ctx, id, StagingDir, r, types.CopyToContainerOptions{})
+	_ = removeContainer(ctx, cli, id)
+	if err != nil {
+		if id, err := runVolumeContainer(ctx, cli, volumeName, "rm -rf "+StagingDir); err == nil {
+			_ = removeContainer(ctx, cli, id)
+		}
+		return err
+	}
+
+	id, err = runVolumeContainer(ctx, cli, volumeName, ReplaceWithStagedScript)
+	if err != nil {
+		return err
+	}
+	return removeContainer(ctx, cli, id)
+}
+
+// runVolumeContainer runs the shell script in a busybox container with the volume mounted at /data
+// and waits for it to exit. The container is returned, so that files can be copied into the
+// volume, and must be removed by the caller. It is removed if the script fails.
+func runVolumeContainer(ctx context.Context, cli *client.Client, volumeName, script string) (string, error) {
+	id, err := createVolumeContainer(ctx, cli, volumeName, []string{"/bin/sh", "-c", script})
+	if err != nil {
+		return "", err
+	}
+	if err := cli.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+		_ = removeContainer(ctx, cli, id)
+		return "", err
+	}
+	resultC, errC := cli.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	select {
+	case result := <-resultC:
+		if result.StatusCode != 0 {
+			_ = removeContainer(ctx, cli, id)
+			return "", fmt.Errorf("container %s exited with code: %d", id, result.StatusCode)
+		}
+	case err := <-errC:
+		_ = removeContainer(ctx, cli, id)
+		return "", err
+	}
+	return id, nil
+}
+
+// MergeIntoVolume copies the contents of a tar stream in the same format as returned by ReadVolume
+// into the given volume. Files which are not in the stream are kept. The busybox image must already exist.
+func MergeIntoVolume(ctx context.Context, cli *client.Client, volumeName string, r io.Reader) error {
+	id, err := createVolumeContainer(ctx, cli, volumeName, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = removeContainer(ctx, cli, id)
+	}()
+	return cli.CopyToContainer(ctx, id, "/", r, types.CopyToContainerOptions{})
+}
+
+// createVolumeContainer creates a busybox container with the given volume mounted at /data.
+func createVolumeContainer(ctx context.Context, cli *client.Client, volumeName string, cmd []string) (string, error) {
+	createConfig := &container.Config{
+		Cmd:    cmd,
+		Image:  "busybox:latest",
+		Labels: label.Task(),
+	}
+
+	hostConfig := &container.HostConfig{
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeVolume,
+				Source: volumeName,
+				Target: "/data",
+			},
+		},
+	}
+
+	containerName := fmt.Sprintf("backup-%s-%s", volumeName, randutil.StringRunes(5))
+	body, err := cli.ContainerCreate(ctx, createConfig, hostConfig, &network.NetworkingConfig{}, &specs.Platform{}, containerName)
+	if err != nil {
+		return "", err
+	}
+	return body.ID, nil
+}
+
+func removeContainer(ctx context.Context, cli *client.Client, id string) error {
+	return cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+}
+
+// containerReadCloser removes the container it is reading from once closed.
+type containerReadCloser struct {
+	io.ReadCloser
+	remove func() error
+}
+
+func (c *containerReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	if removeErr := c.remove(); removeErr != nil && err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// RunContainer runs a container with the given config and mounts until it exits and returns
+// everything written to stdout. The container is always removed once it has exited.
+func RunContainer(ctx context.Context, cli *client.Client, createConfig *container.Config, mounts []mount.Mount) ([]byte, error) {
+	createConfig.Labels = label.Task()
+	hostConfig := &container.HostConfig{Mounts: mounts}
+
+	containerName := fmt.Sprintf("backup-%s", randutil.StringRunes(5))
+	body, err := cli.ContainerCreate(ctx, createConfig, hostConfig, &network.NetworkingConfig{}, &specs.Platform{}, containerName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = removeContainer(ctx, cli, body.ID)
+	}()
+
+	if err := cli.ContainerStart(ctx, body.ID, types.ContainerStartOptions{}); err != nil {
+		return nil, err
+	}
+
+	var statusCode int64
+	resultC, errC := cli.ContainerWait(ctx, body.ID, container.WaitConditionNotRunning)
+	select {
+	case result := <-resultC:
+		statusCode = result.StatusCode
+	case err := <-errC:
+		return nil, err
+	}
+
+	logs, err := cli.ContainerLogs(ctx, body.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return nil, err
+	}
+	defer logs.Close()
+
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, logs); err != nil {
+		return nil, err
+	}
+	if statusCode != 0 {
+		return nil, fmt.Errorf("container %s exited with code: %d: %s", body.ID, statusCode, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// ContainersUsingVolume returns the names of all containers which mount the volume.
+func ContainersUsingVolume(ctx context.Context, cli *client.Client, volumeName string) ([]string, error) {
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("volume", volumeName)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, c := range containers {
+		for _, n := range c.Names {
+			names = append(names, strings.TrimPrefix(n, "/"))
+		}
+	}
+	return names, nil
+}
+
+// ComposeProjectOfVolume returns the compose project of the containers which mount the volume,
+// or an empty string if none of them belong to a project.
+func ComposeProjectOfVolume(ctx context.Context, cli *client.Client, volumeName string) (string, error) {
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("volume", volumeName)),
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, c := range containers {
+		if project := c.Labels[ComposeProjectLabel]; project != "" {
+			return project, nil
+		}
+	}
+	return "", nil
+}
+
+// VolumeSizes returns the disk space used by each volume in bytes. The size is -1 for volumes whose
+// driver does not report it.
+func VolumeSizes(ctx context.Context, cli *client.Client) (map[string]int64, error) {
+	du, err := cli.DiskUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	for _, v := range du.Volumes {
+		sizes[v.Name] = -1
+		if v.UsageData != nil {
+			sizes[v.Name] = v.UsageData.Size
+		}
+	}
+	return sizes, nil
+}
+
+// RunContainerAttached runs a container with the given config and mounts until it exits, streaming
+// stdin to the container and the container's stdout to stdout. stdin may be nil. The container is
+// always removed once it has exited.
+func RunContainerAttached(ctx context.Context, cli *client.Client, createConfig *container.Config, mounts []mount.Mount, stdin io.Reader, stdout io.Writer) error {
+	return runContainerAttached(ctx, cli, createConfig, mounts, nil, stdin, stdout)
+}
+
+// runContainerAttached is RunContainerAttached, running prepare with the id of the container before
+// it is started, if prepare is not nil.
+func runContainerAttached(ctx context.Context, cli *client.Client, createConfig *container.Config, mounts []mount.Mount, prepare func(id string) error, stdin io.Reader, stdout io.Writer) error {
+	createConfig.Labels = label.Task()
+	createConfig.AttachStdout = true
+	createConfig.AttachStderr = true
+	if stdin != nil {
+		createConfig.AttachStdin = true
+		createConfig.OpenStdin = true
+		// stdin is closed once the attached client closes it, so the command sees EOF.
+		createConfig.StdinOnce = true
+	}
+	hostConfig := &container.HostConfig{Mounts: mounts}
+
+	containerName := fmt.Sprintf("backup-%s", randutil.StringRunes(5))
+	body, err := cli.ContainerCreate(ctx, createConfig, hostConfig, &network.NetworkingConfig{}, &specs.Platform{}, containerName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = removeContainer(ctx, cli, body.ID)
+	}()
+
+	if prepare != nil {
+		if err := prepare(body.ID); err != nil {
+			return err
+		}
+	}
+
+	attached, err := cli.ContainerAttach(ctx, body.ID, types.ContainerAttachOptions{
+		Stream: true,
+		Stdin:  stdin != nil,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer attached.Close()
+
+	if err := cli.ContainerStart(ctx, body.ID, types.ContainerStartOptions{}); err != nil {
+		return err
+	}
+
+	stdinErrC := make(chan error, 1)
+	if stdin != nil {
+		go func() {
+			_, err := io.Copy(attached.Conn, stdin)
+			if err != nil {
+				// the command must not complete with partial input.
+				_ = cli.ContainerKill(ctx, body.ID, "KILL")
+			}
+			_ = attached.CloseWrite()
+			stdinErrC <- err
+		}()
+	} else {
+		stdinErrC <- nil
+	}
+
+	var stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(stdout, &stderr, attached.Reader); err != nil {
+		_ = cli.ContainerKill(ctx, body.ID, "KILL")
+		return err
+	}
+
+	var statusCode int64
+	resultC, errC := cli.ContainerWait(ctx, body.ID, container.WaitConditionNotRunning)
+	select {
+	case result := <-resultC:
+		statusCode = result.StatusCode
+	case err := <-errC:
+		return err
+	}
+	// a failing command stops reading stdin, so its exit code is the more useful error.
+	if statusCode != 0 {
+		return fmt.Errorf("container %s exited with code: %d: %s", body.ID, statusCode, strings.TrimSpace(stderr.String()))
+	}
+	return <-stdinErrC
+}
+
+// CopyVolume replaces the contents of the destination volume, which is created if it does not exist,
+// with the contents of the source volume. The clients may be for different docker daemons, in which
+// case the volume is streamed between them.
+func CopyVolume(ctx context.Context, src *client.Client, srcVolume string, dst *client.Client, dstVolume string) error {
+	for _, cli := range []*client.Client{src, dst} {
+		if err := PullImage(ctx, cli, "busybox:latest"); err != nil {
+			return err
+		}
+	}
+	if _, err := dst.VolumeCreate(ctx, volume.VolumeCreateBody{Name: dstVolume}); err != nil {
+		return err
+	}
+
+	rc, err := ReadVolume(ctx, src, srcVolume)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return WriteVolume(ctx, dst, dstVolume, rc)
+}
+
+// StopContainersUsingVolume stops the running containers which mount the volume, and returns
+// the ids of the stopped containers so that they can be started again with StartContainers.
+// Containers are stopped before the containers they depend on, and the ids are returned in
+// the order they should be started in.
+func StopContainersUsingVolume(ctx context.Context, cli *client.Client, volumeName string) ([]string, error) {
+	return stopContainers(ctx, cli, filters.NewArgs(filters.Arg("volume", volumeName)))
+}
+
+// StopProjectContainers is the same as StopContainersUsingVolume, but stops the running containers
+// of the compose project.
+func StopProjectContainers(ctx context.Context, cli *client.Client, project string) ([]string, error) {
+	return stopContainers(ctx, cli, filters.NewArgs(filters.Arg("label", ComposeProjectLabel+"="+project)))
+}
+
+func stopContainers(ctx context.Context, cli *client.Client, f filters.Args) ([]string, error) {
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{Filters: f})
+	if err != nil {
+		return nil, err
+	}
+	containers = SortByDependencies(containers)
+
+	var stopped []string
+	for i := len(containers) - 1; i >= 0; i-- {
+		c := containers[i]
+		log.Printf("Stopping container: %s (%s)\n", c.Image, c.ID)
+		if err := cli.ContainerStop(ctx, c.ID, nil); err != nil {
+			// containers which were already stopped are started again by the caller.
+			return stopped, fmt.Errorf("failed to stop container: %s", err)
+		}
+		stopped = append([]string{c.ID}, stopped...)
+	}
+	return stopped, nil
+}
+
+const (
+	// ComposeProjectLabel is the label compose sets on the containers and volumes of a project.
+	ComposeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	// composeDependsOnLabel lists the services a compose service depends on, e.g.
+	// "db:service_healthy:false,cache:service_started:false".
+	composeDependsOnLabel = "com.docker.compose.depends_on"
+)
+
+// SortByDependencies sorts containers so that each container comes after the containers it
+// depends on through compose depends_on. Otherwise, the original order is kept, and containers
+// with circular dependencies are left in their original order at the end.
+func SortByDependencies(containers []types.Container) []types.Container {
+	serviceKey := func(project, service string) string {
+		return project + "/" + service
+	}
+	byService := map[string]int{}
+	for i, c := range containers {
+		if service, ok := c.Labels[composeServiceLabel]; ok {
+			byService[serviceKey(c.Labels[ComposeProjectLabel], service)] = i
+		}
+	}
+
+	dependencies := make([][]int, len(containers))
+	for i, c := range containers {
+		dependsOn, ok := c.Labels[composeDependsOnLabel]
+		if !ok || dependsOn == "" {
+			continue
+		}
+		for _, dep := range strings.Split(dependsOn, ",") {
+			service := strings.Split(dep, ":")[0]
+			if j, ok := byService[serviceKey(c.Labels[ComposeProjectLabel], service)]; ok && j != i {
+				dependencies[i] = append(dependencies[i], j)
+			}
+		}
+	}
+
+	var sorted []types.Container
+	added := make([]bool, len(containers))
+	for len(sorted) < len(containers) {
+		progress := false
+		for i, c := range containers {
+			if added[i] {
+				continue
+			}
+			ready := true
+			for _, j := range dependencies[i] {
+				ready = ready && added[j]
+			}
+			if ready {
+				sorted = append(sorted, c)
+				added[i] = true
+				progress = true
+			}
+		}
+		if !progress {
+			for i, c := range containers {
+				if !added[i] {
+					sorted = append(sorted, c)
+					added[i] = true
+				}
+			}
+		}
+	}
+	return sorted
+}
+
+// StartContainers starts the given containers in order, attempting every container even if some fail.
+func StartContainers(ctx context.Context, cli *client.Client, ids []string) error {
+	var errs []string
+	for _, id := range ids {
+		log.Printf("Starting container: %s\n", id)
+		if err := cli.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to start containers: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// VolumeIsEmpty returns true if the volume contains no files. The busybox image must already exist.
+func VolumeIsEmpty(ctx context.Context, cli *client.Client, volumeName string) (bool, error) {
+	out, err := RunContainer(ctx, cli, &container.Config{
+		Image: "busybox:latest",
+		Cmd:   []string{"ls", "-A", "/data"},
+	}, []mount.Mount{
+		{
+			Type:     mount.TypeVolume,
+			Source:   volumeName,
+			Target:   "/data",
+			ReadOnly: true,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(bytes.TrimSpace(out)) == 0, nil
+}
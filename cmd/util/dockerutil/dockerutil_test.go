@@ -0,0 +1,53 @@
+package dockerutil
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/require"
+)
+
+func composeContainer(id, service, dependsOn string) types.Container {
+	return types.Container{
+		ID: id,
+		Labels: map[string]string{
+			ComposeProjectLabel:   "app",
+			composeServiceLabel:   service,
+			composeDependsOnLabel: dependsOn,
+		},
+	}
+}
+
+func ids(containers []types.Container) []string {
+	var result []string
+	for _, c := range containers {
+		result = append(result, c.ID)
+	}
+	return result
+}
+
+func TestSortByDependencies(t *testing.T) {
+	t.Run("dependencies first", func(t *testing.T) {
+		containers := []types.Container{
+			composeContainer("web", "web", "api:service_started:false"),
+			composeContainer("api", "api", "db:service_healthy:false,cache:service_started:false"),
+			composeContainer("db", "db", ""),
+			composeContainer("cache", "cache", ""),
+		}
+		require.Equal(t, []string{"db", "cache", "api", "web"}, ids(SortByDependencies(containers)))
+	})
+
+	t.Run("original order without dependencies", func(t *testing.T) {
+		containers := []types.Container{{ID: "b"}, {ID: "a"}, composeContainer("c", "c", "missing:service_started:false")}
+		require.Equal(t, []string{"b", "a", "c"}, ids(SortByDependencies(containers)))
+	})
+
+	t.Run("circular dependencies", func(t *testing.T) {
+		containers := []types.Container{
+			composeContainer("a", "a", "b:service_started:false"),
+			composeContainer("b", "b", "a:service_started:false"),
+			composeContainer("c", "c", ""),
+		}
+		require.Equal(t, []string{"c", "a", "b"}, ids(SortByDependencies(containers)))
+	})
+}
@@ -0,0 +1,354 @@
+package dockerutil
+
+import (
+	"archive/tar"
+	"context"
+	"debug/elf"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"docker-volume-backup/cmd/util/archiveutil"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// CreateArchiveCommand is the hidden command which archives a directory in a helper container.
+	CreateArchiveCommand = "create-archive"
+	// ExtractArchiveCommand is the hidden command which extracts an archive in a helper container.
+	ExtractArchiveCommand = "extract-archive"
+
+	// helperPath is where the executable is copied to in helper containers.
+	helperPath = "/docker-volume-backup"
+)
+
+// RunHelper runs this executable with args in a busybox container with the given mounts, and streams
+// its stdout to stdout, which may be nil. The executable is copied into the container before it is
+// started, so it must be a statically linked linux executable for the architecture of the daemon, as
+// it is when built by the Dockerfile, see CheckHelper. The busybox image must already exist.
+func RunHelper(ctx context.Context, cli *client.Client, mounts []mount.Mount, args []string, stdout io.Writer) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	createConfig := &container.Config{
+		Image: "busybox:latest",
+		Cmd:   append([]string{helperPath}, args...),
+	}
+	return runContainerAttached(ctx, cli, createConfig, mounts, func(id string) error {
+		return copyExecutable(ctx, cli, id, self)
+	}, nil, stdout)
+}
+
+// DockerArchiveFallbackEnv is the environment variable which allows archiving and extracting volumes
+// with the docker archive api when this executable can not run in a helper container.
+const DockerArchiveFallbackEnv = "DOCKER_ARCHIVE_FALLBACK"
+
+// CheckHelper returns an error if RunHelper can not run this executable in a container of the daemon.
+func CheckHelper(ctx context.Context, cli *client.Client) error {
+	reason, err := helperUnsupported(ctx, cli)
+	if err != nil || reason == "" {
+		return err
+	}
+	return fmt.Errorf("the executable can not run in a helper container, %s", reason)
+}
+
+// useDockerArchive returns true if volumes must be archived or extracted with the docker archive api,
+// because this executable can not run in a helper container. The docker archive api does not keep
+// extended attributes or the holes of sparse files, so it is only used if DockerArchiveFallbackEnv is
+// set to true, otherwise an error is returned.
+func useDockerArchive(ctx context.Context, cli *client.Client) (bool, error) {
+	reason, err := helperUnsupported(ctx, cli)
+	if err != nil || reason == "" {
+		return false, err
+	}
+	if os.Getenv(DockerArchiveFallbackEnv) != "true" {
+		return false, fmt.Errorf("the executable can not run in a helper container, %s, set %s=true to use the docker archive api instead, which does not keep extended attributes or the holes of sparse files", reason, DockerArchiveFallbackEnv)
+	}
+	log.Printf("the executable can not run in a helper container, %s, using the docker archive api, which does not keep extended attributes or the holes of sparse files", reason)
+	return true, nil
+}
+
+// helperUnsupported returns why this executable can not run in a container of the daemon, or an
+// empty string if it can.
+func helperUnsupported(ctx context.Context, cli *client.Client) (string, error) {
+	if runtime.GOOS != "linux" {
+		return fmt.Sprintf("it is built for %s", runtime.GOOS), nil
+	}
+	version, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	if version.Arch != runtime.GOARCH {
+		return fmt.Sprintf("it is built for %s and the docker daemon runs on %s", runtime.GOARCH, version.Arch), nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := elf.Open(self)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// dynamically linked executables need an interpreter, which busybox does not have.
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return "it is dynamically linked", nil
+		}
+	}
+	return "", nil
+}
+
+// copyExecutable copies the executable at p to helperPath in the container.
+func copyExecutable(ctx context.Context, cli *client.Client, id, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	// unblock the writer if the copy fails before reading everything.
+	defer pr.Close()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{
+			Name:     strings.TrimPrefix(helperPath, "/"),
+			Typeflag: tar.TypeReg,
+			Mode:     0o755,
+			Size:     info.Size(),
+		})
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return cli.CopyToContainer(ctx, id, path.Dir(helperPath), pr, types.CopyToContainerOptions{})
+}
+
+// ArchiveVolume writes a gzipped tar archive of the volume to w, with every entry prefixed by
+// "data/" and the manifest, if not nil, as the first entry. The busybox image must already exist.
+func ArchiveVolume(ctx context.Context, cli *client.Client, volumeName string, manifest []byte, w io.Writer) error {
+	mounts := []mount.Mount{
+		{
+			Type:     mount.TypeVolume,
+			Source:   volumeName,
+			Target:   "/data",
+			ReadOnly: true,
+		},
+	}
+	fallback, err := useDockerArchive(ctx, cli)
+	if err != nil {
+		return err
+	}
+	if fallback {
+		return archiveFromDocker(ctx, cli, volumeName, manifest, w)
+	}
+	return RunHelper(ctx, cli, mounts, archiveArgs("-", manifest), w)
+}
+
+// ArchiveVolumeToHostPath is the same as ArchiveVolume, but writes the archive to fileName in the
+// directory hostPath on the host.
+func ArchiveVolumeToHostPath(ctx context.Context, cli *client.Client, volumeName string, manifest []byte, hostPath, fileName string) error {
+	backupsMount := mount.Mount{
+		Type:   mount.TypeBind,
+		Source: hostPath,
+		Target: "/backups",
+	}
+	output := path.Join("/backups", fileName)
+	fallback, err := useDockerArchive(ctx, cli)
+	if err != nil {
+		return err
+	}
+	if fallback {
+		// the archive is streamed into a busybox container, which writes it to the host path.
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(archiveFromDocker(ctx, cli, volumeName, manifest, pw))
+		}()
+		script := fmt.Sprintf("mkdir -p %[1]s && cat > %[2]s.tmp && mv %[2]s.tmp %[2]s", path.Dir(output), output)
+		err := RunContainerAttached(ctx, cli, &container.Config{
+			Image: "busybox:latest",
+			Cmd:   []string{"/bin/sh", "-c", script},
+		}, []mount.Mount{backupsMount}, pr, io.Discard)
+		_ = pr.CloseWithError(err)
+		return err
+	}
+
+	mounts := []mount.Mount{
+		{
+			Type:     mount.TypeVolume,
+			Source:   volumeName,
+			Target:   "/data",
+			ReadOnly: true,
+		},
+		backupsMount,
+	}
+	return RunHelper(ctx, cli, mounts, archiveArgs(output, manifest), nil)
+}
+
+// ArchiveVolumeIncremental is ArchiveVolumeToHostPath for a chain of incremental archives. The archive
+// only contains the changes since the snapshot file snapshotName in hostPath was written, or every file
+// if full is set or there is no snapshot file, which is then updated for the next archive of the chain.
+func ArchiveVolumeIncremental(ctx context.Context, cli *client.Client, volumeName string, manifest []byte, hostPath, fileName, snapshotName string, full bool) error {
+	// the docker archive api can not tell which files changed.
+	if err := CheckHelper(ctx, cli); err != nil {
+		return err
+	}
+	mounts := []mount.Mount{
+		{
+			Type:     mount.TypeVolume,
+			Source:   volumeName,
+			Target:   "/data",
+			ReadOnly: true,
+		},
+		{
+			Type:   mount.TypeBind,
+			Source: hostPath,
+			Target: "/backups",
+		},
+	}
+	args := append(archiveArgs(path.Join("/backups", fileName), manifest), "--snapshot", path.Join("/backups", snapshotName))
+	if full {
+		args = append(args, "--full")
+	}
+	return RunHelper(ctx, cli, mounts, args, nil)
+}
+
+// archiveFromDocker is ArchiveVolume for when the helper can not run. The archive is created from the
+// tar stream of the docker archive api, which does not keep extended attributes or the holes of
+// sparse files.
+func archiveFromDocker(ctx context.Context, cli *client.Client, volumeName string, manifest []byte, w io.Writer) error {
+	rc, err := ReadVolume(ctx, cli, volumeName)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return archiveutil.FromTar(rc, w, manifest)
+}
+
+func archiveArgs(output string, manifest []byte) []string {
+	args := []string{CreateArchiveCommand, "--dir", "/data", "--output", output}
+	if manifest != nil {
+		args = append(args, "--manifest", string(manifest))
+	}
+	return args
+}
+
+// ExtractArchive replaces the contents of the volume with the contents of the archive at
+// archiveHostPath on the host. The archive is verified before the volume is changed, and the volume
+// is checked against the archive afterwards. The busybox image must already exist.
+func ExtractArchive(ctx context.Context, cli *client.Client, volumeName, archiveHostPath string) error {
+	fallback, err := useDockerArchive(ctx, cli)
+	if err != nil {
+		return err
+	}
+	if fallback {
+		return extractWithDocker(ctx, cli, volumeName, archiveHostPath)
+	}
+	archiveMount := mount.Mount{
+		Type:     mount.TypeBind,
+		Source:   archiveHostPath,
+		Target:   "/archive.tar.gz",
+		ReadOnly: true,
+	}
+	return extractArchives(ctx, cli, volumeName, archiveMount, []string{"/archive.tar.gz"})
+}
+
+// ExtractChain is ExtractArchive for a chain of archives created by ArchiveVolumeIncremental, which
+// are extracted in order from the directory hostPath on the host. Every archive is verified before
+// the volume is changed. The busybox image must already exist.
+func ExtractChain(ctx context.Context, cli *client.Client, volumeName, hostPath string, fileNames []string) error {
+	// the docker archive api can not remove the files which were deleted between archives.
+	if err := CheckHelper(ctx, cli); err != nil {
+		return err
+	}
+	chainMount := mount.Mount{
+		Type:     mount.TypeBind,
+		Source:   hostPath,
+		Target:   "/backups",
+		ReadOnly: true,
+	}
+	var archives []string
+	for _, name := range fileNames {
+		archives = append(archives, path.Join("/backups", name))
+	}
+	return extractArchives(ctx, cli, volumeName, chainMount, archives)
+}
+
+// extractArchives extracts the archives, which are in the given mount, into the volume with the helper.
+func extractArchives(ctx context.Context, cli *client.Client, volumeName string, archiveMount mount.Mount, archives []string) error {
+	mounts := []mount.Mount{
+		{
+			Type:   mount.TypeVolume,
+			Source: volumeName,
+			Target: "/data",
+		},
+		archiveMount,
+	}
+	args := []string{ExtractArchiveCommand, "--dir", "/data", "--replace"}
+	for _, a := range archives {
+		args = append(args, "--archive", a)
+	}
+	return RunHelper(ctx, cli, mounts, args, nil)
+}
+
+// extractWithDocker is ExtractArchive for when the helper can not run. The archive is read by this
+// process, so archiveHostPath must be readable by it, and copied into the volume with WriteVolume.
+func extractWithDocker(ctx context.Context, cli *client.Client, volumeName, archiveHostPath string) error {
+	f, err := os.Open(archiveHostPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := archiveutil.Verify(f); err != nil {
+		return fmt.Errorf("archive %s is corrupt: %s", archiveHostPath, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := archiveutil.Filter(f, nil, pw)
+		pw.CloseWithError(err)
+	}()
+	err = WriteVolume(ctx, cli, volumeName, pr)
+	_ = pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	rc, err := ReadVolume(ctx, cli, volumeName)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := archiveutil.CheckTar(f, rc, nil); err != nil {
+		return fmt.Errorf("archive %s was not extracted completely: %s", archiveHostPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package dockerutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+
+	"docker-volume-backup/cmd/util/sshutil"
+
+	"github.com/docker/docker/client"
+	"golang.org/x/crypto/ssh"
+)
+
+// remoteSocket is the docker socket on hosts reached over ssh.
+const remoteSocket = "/var/run/docker.sock"
+
+// RemoteClient is a client for a remote docker daemon. Close also closes the ssh connection
+// the daemon is reached over, if any.
+type RemoteClient struct {
+	*client.Client
+	conn *ssh.Client
+}
+
+func (r *RemoteClient) Close() error {
+	err := r.Client.Close()
+	if r.conn != nil {
+		if cerr := r.conn.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NewRemoteClient returns a client for the docker daemon at host, which is either tcp://host:port
+// or ssh://user@host[:port]. If certPath is not empty, it must contain ca.pem, cert.pem and key.pem,
+// which are used for tls with tcp hosts. ssh hosts are reached by forwarding the docker socket over
+// ssh, authenticated with the SSH_* environment variables.
+func NewRemoteClient(host, certPath string) (*RemoteClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %s", host, err)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		opts := []client.Opt{client.WithHost(host), client.WithAPIVersionNegotiation()}
+		if certPath != "" {
+			opts = append(opts, client.WithTLSClientConfig(
+				filepath.Join(certPath, "ca.pem"),
+				filepath.Join(certPath, "cert.pem"),
+				filepath.Join(certPath, "key.pem"),
+			))
+		}
+		cli, err := client.NewClientWithOpts(opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &RemoteClient{Client: cli}, nil
+	case "ssh":
+		cfg := sshutil.FromEnv("SSH_")
+		cfg.Host = u.Host
+		cfg.User = u.User.Username()
+		conn, err := sshutil.Dial(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cli, err := client.NewClientWithOpts(
+			// the host only configures the transport, every connection is dialed over ssh.
+			client.WithHost("unix://"+remoteSocket),
+			client.WithDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return conn.Dial("unix", remoteSocket)
+			}),
+			client.WithAPIVersionNegotiation(),
+		)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return &RemoteClient{Client: cli, conn: conn}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q, expected tcp:// or ssh://", host)
+	}
+}
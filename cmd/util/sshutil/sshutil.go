@@ -0,0 +1,101 @@
+package sshutil
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type Config struct {
+	// Host is the address of the ssh server, with an optional port.
+	Host string
+	User string
+	// KeyFile is the path to a private key. If empty, the ssh agent at SSH_AUTH_SOCK is used.
+	KeyFile       string
+	KeyPassphrase string
+	// KnownHostsFile is used to verify the host key of the server.
+	KnownHostsFile string
+}
+
+// FromEnv returns the key and known hosts configuration from the environment variables with
+// the given prefix, e.g. SSH_KEY_FILE for the prefix SSH_. Host and User are not set.
+func FromEnv(prefix string) Config {
+	keyFile, _ := os.LookupEnv(prefix + "KEY_FILE")
+	keyPassphrase, _ := os.LookupEnv(prefix + "KEY_PASSPHRASE")
+	knownHostsFile, ok := os.LookupEnv(prefix + "KNOWN_HOSTS")
+	if !ok {
+		home, _ := os.UserHomeDir()
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return Config{
+		KeyFile:        keyFile,
+		KeyPassphrase:  keyPassphrase,
+		KnownHostsFile: knownHostsFile,
+	}
+}
+
+// Dial connects to the ssh server, verifying its host key against the known hosts file.
+func Dial(cfg Config) (*ssh.Client, error) {
+	hostKeyCallback, err := knownhosts.New(cfg.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading known hosts: %s", err)
+	}
+	auth, agentConn, err := authMethod(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// the agent is only needed for authentication, which is done during the handshake.
+	if agentConn != nil {
+		defer agentConn.Close()
+	}
+
+	host := cfg.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	conn, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to %s: %s", host, err)
+	}
+	return conn, nil
+}
+
+// authMethod returns the auth method for the config, and the connection to the ssh agent if
+// one is used, which the caller must close.
+func authMethod(cfg Config) (ssh.AuthMethod, net.Conn, error) {
+	if cfg.KeyFile == "" {
+		sock, ok := os.LookupEnv("SSH_AUTH_SOCK")
+		if !ok {
+			return nil, nil, fmt.Errorf("no key file specified and SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed connecting to ssh agent: %s", err)
+		}
+		return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), conn, nil
+	}
+
+	key, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var signer ssh.Signer
+	if cfg.KeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(cfg.KeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed parsing key file: %s", err)
+	}
+	return ssh.PublicKeys(signer), nil, nil
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/util/archiveutil"
+
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/spf13/cobra"
+)
+
+const (
+	volumeDriverFlag = "volume-driver"
+	volumeOptFlag    = "volume-opt"
+	volumeLabelFlag  = "volume-label"
+)
+
+// volumeOverrides replace parts of the configuration of a backed up volume when it is recreated.
+// The zero value recreates the volume as it was backed up.
+type volumeOverrides struct {
+	driver     string
+	driverOpts map[string]string
+	labels     map[string]string
+}
+
+func addVolumeOverrideFlags(cmd *cobra.Command) {
+	cmd.Flags().String(volumeDriverFlag, "", "driver to create missing volumes with, defaults to the driver of the backed up volume")
+	cmd.Flags().StringArray(volumeOptFlag, nil, "driver option key=value to create missing volumes with, replacing the backed up option, can be repeated")
+	cmd.Flags().StringArray(volumeLabelFlag, nil, "label key=value to create missing volumes with, replacing the backed up label, can be repeated")
+}
+
+func getVolumeOverrides(cmd *cobra.Command) (volumeOverrides, error) {
+	driver, err := cmd.Flags().GetString(volumeDriverFlag)
+	if err != nil {
+		return volumeOverrides{}, err
+	}
+	opts, err := cmd.Flags().GetStringArray(volumeOptFlag)
+	if err != nil {
+		return volumeOverrides{}, err
+	}
+	labels, err := cmd.Flags().GetStringArray(volumeLabelFlag)
+	if err != nil {
+		return volumeOverrides{}, err
+	}
+
+	o := volumeOverrides{driver: driver}
+	if o.driverOpts, err = parseKeyValues(opts); err != nil {
+		return volumeOverrides{}, err
+	}
+	if o.labels, err = parseKeyValues(labels); err != nil {
+		return volumeOverrides{}, err
+	}
+	return o, nil
+}
+
+// parseKeyValues parses key=value pairs, it returns nil if there are none.
+func parseKeyValues(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	result := map[string]string{}
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid key=value pair %q", v)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// volumeCreateBody returns how to create the volume, using the configuration of the backed up volume,
+// which may be nil, with the overrides applied.
+func volumeCreateBody(volumeName string, config *manifest.VolumeConfig, o volumeOverrides) volume.VolumeCreateBody {
+	body := volume.VolumeCreateBody{Name: volumeName}
+	if config != nil {
+		body.Driver = config.Driver
+		body.DriverOpts = merge(nil, config.DriverOpts)
+		body.Labels = merge(nil, config.Labels)
+	}
+	if o.driver != "" && o.driver != body.Driver {
+		body.Driver = o.driver
+		// the options of one driver are meaningless to another.
+		body.DriverOpts = nil
+	}
+	body.DriverOpts = merge(body.DriverOpts, o.driverOpts)
+	body.Labels = merge(body.Labels, o.labels)
+	return body
+}
+
+// merge returns the union of both maps, the values of overrides take precedence.
+func merge(m, overrides map[string]string) map[string]string {
+	if len(overrides) == 0 {
+		return m
+	}
+	result := map[string]string{}
+	for k, v := range m {
+		result[k] = v
+	}
+	for k, v := range overrides {
+		result[k] = v
+	}
+	return result
+}
+
+// createVolume creates the volume with the configuration of the backed up volume, which may be nil,
+// and the overrides. An existing volume is kept as it is, since its driver can not be changed.
+func createVolume(ctx context.Context, cli *client.Client, volumeName string, config *manifest.VolumeConfig, o volumeOverrides) error {
+	body := volumeCreateBody(volumeName, config, o)
+	existing, err := cli.VolumeInspect(ctx, volumeName)
+	if err == nil {
+		if body.Driver != "" && body.Driver != existing.Driver {
+			log.Printf("volume %s already exists with driver %s, restoring into it instead of recreating it with driver %s", volumeName, existing.Driver, body.Driver)
+		}
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return err
+	}
+	_, err = cli.VolumeCreate(ctx, body)
+	return err
+}
+
+// readArchiveManifest returns the manifest stored in the archive, or nil for archives without one.
+func readArchiveManifest(archivePath string) (*manifest.Manifest, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseArchiveManifest(f, archivePath)
+}
+
+// parseArchiveManifest returns the manifest stored in the archive read from r, or nil for archives
+// without one. name is the name of the archive in errors.
+func parseArchiveManifest(r io.Reader, name string) (*manifest.Manifest, error) {
+	data, err := archiveutil.ReadManifest(r)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var m manifest.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed parsing manifest of %s: %s", name, err)
+	}
+	return &m, nil
+}
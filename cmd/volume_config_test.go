@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"testing"
+
+	"docker-volume-backup/cmd/manifest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	values, err := parseKeyValues([]string{"type=nfs", "o=addr=10.0.0.1,rw", "empty="})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"type": "nfs", "o": "addr=10.0.0.1,rw", "empty": ""}, values)
+
+	values, err = parseKeyValues(nil)
+	require.NoError(t, err)
+	require.Nil(t, values)
+
+	_, err = parseKeyValues([]string{"novalue"})
+	require.Error(t, err)
+	_, err = parseKeyValues([]string{"=value"})
+	require.Error(t, err)
+}
+
+func TestVolumeCreateBody(t *testing.T) {
+	config := &manifest.VolumeConfig{
+		Driver:     "local",
+		DriverOpts: map[string]string{"type": "nfs", "device": ":/export"},
+		Labels:     map[string]string{"app": "db", "tier": "backend"},
+	}
+
+	t.Run("as backed up", func(t *testing.T) {
+		body := volumeCreateBody("data", config, volumeOverrides{})
+		require.Equal(t, "data", body.Name)
+		require.Equal(t, "local", body.Driver)
+		require.Equal(t, config.DriverOpts, body.DriverOpts)
+		require.Equal(t, config.Labels, body.Labels)
+	})
+
+	t.Run("without manifest", func(t *testing.T) {
+		body := volumeCreateBody("data", nil, volumeOverrides{labels: map[string]string{"app": "db"}})
+		require.Empty(t, body.Driver)
+		require.Nil(t, body.DriverOpts)
+		require.Equal(t, map[string]string{"app": "db"}, body.Labels)
+	})
+
+	t.Run("overrides replace single values", func(t *testing.T) {
+		body := volumeCreateBody("data", config, volumeOverrides{
+			driverOpts: map[string]string{"device": ":/other"},
+			labels:     map[string]string{"tier": "restored"},
+		})
+		require.Equal(t, map[string]string{"type": "nfs", "device": ":/other"}, body.DriverOpts)
+		require.Equal(t, map[string]string{"app": "db", "tier": "restored"}, body.Labels)
+		// the manifest is left unchanged.
+		require.Equal(t, ":/export", config.DriverOpts["device"])
+	})
+
+	t.Run("another driver drops the backed up options", func(t *testing.T) {
+		body := volumeCreateBody("data", config, volumeOverrides{driver: "rexray", driverOpts: map[string]string{"size": "10"}})
+		require.Equal(t, "rexray", body.Driver)
+		require.Equal(t, map[string]string{"size": "10"}, body.DriverOpts)
+		require.Equal(t, config.Labels, body.Labels)
+	})
+}
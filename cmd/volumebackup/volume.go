@@ -0,0 +1,123 @@
+package volumebackup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/storage"
+	"docker-volume-backup/cmd/util/dockerutil"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+const image = "busybox:latest"
+
+type Config struct {
+	// VolumeName is the volume where archives are stored. It is created with the default driver
+	// if it does not exist, volumes using other drivers, e.g. NFS, must be created up front.
+	VolumeName string
+}
+
+func FromEnv() Config {
+	volumeName, _ := os.LookupEnv("BACKUP_VOLUME")
+	return Config{
+		VolumeName: volumeName,
+	}
+}
+
+// Backend stores archives as files in a docker volume, which are accessed through busybox
+// helper containers with the volume mounted at /backups.
+type Backend struct {
+	config Config
+	cli    *client.Client
+}
+
+func NewBackend(cfg Config, cli *client.Client) *Backend {
+	return &Backend{
+		config: cfg,
+		cli:    cli,
+	}
+}
+
+// run runs the shell script in a busybox container, with the key of the archive in $KEY.
+func (b *Backend) run(ctx context.Context, script, key string, stdin io.Reader, stdout io.Writer) error {
+	if b.config.VolumeName == "" {
+		return fmt.Errorf("BACKUP_VOLUME is not set")
+	}
+	if err := dockerutil.PullImage(ctx, b.cli, image); err != nil {
+		return err
+	}
+	mounts := []mount.Mount{
+		{
+			Type:   mount.TypeVolume,
+			Source: b.config.VolumeName,
+			Target: "/backups",
+		},
+	}
+	return dockerutil.RunContainerAttached(ctx, b.cli, &container.Config{
+		Image: image,
+		Cmd:   []string{"/bin/sh", "-c", script},
+		Env:   []string{"KEY=" + key},
+	}, mounts, stdin, stdout)
+}
+
+func (b *Backend) Upload(ctx context.Context, key string, r io.Reader, m manifest.Manifest) error {
+	if _, err := b.cli.VolumeCreate(ctx, volume.VolumeCreateBody{Name: b.config.VolumeName}); err != nil {
+		return err
+	}
+	// write to a temporary file, so that a partial upload never replaces an existing archive.
+	return b.run(ctx, `cat > "/backups/$KEY.tmp" && mv "/backups/$KEY.tmp" "/backups/$KEY"`, key, r, io.Discard)
+}
+
+func (b *Backend) List(ctx context.Context, prefix string) ([]storage.Object, error) {
+	var out strings.Builder
+	script := `for f in /backups/*; do [ -f "$f" ] && stat -c '%s %Y %n' "$f"; done; true`
+	if err := b.run(ctx, script, "", nil, &out); err != nil {
+		return nil, err
+	}
+	return parseStat(out.String(), prefix), nil
+}
+
+// parseStat parses lines of "<size> <modification time> <path>" as written by stat.
+func parseStat(out, prefix string) []storage.Object {
+	var objects []storage.Object
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		modified, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		name := strings.TrimPrefix(fields[2], "/backups/")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if obj, ok := storage.NewObject(name, size, time.Unix(modified, 0)); ok {
+			objects = append(objects, obj)
+		}
+	}
+	return objects
+}
+
+func (b *Backend) Download(ctx context.Context, key string, w io.Writer) error {
+	return b.run(ctx, `cat "/backups/$KEY"`, key, nil, w)
+}
+
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	return b.run(ctx, `rm "/backups/$KEY"`, key, nil, io.Discard)
+}
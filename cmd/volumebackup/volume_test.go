@@ -0,0 +1,25 @@
+package volumebackup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStat(t *testing.T) {
+	out := `1024 1666062000 /backups/config-18-10-2022.tar.gz
+10 1666062000 /backups/config-other-18-10-2022.tar.gz
+512 1666062000 /backups/config-19-10-2022.tar.gz.tmp
+5 1666062000 /backups/notes.txt
+`
+	objects := parseStat(out, "config")
+	require.Len(t, objects, 2, "temporary files should not be listed")
+	require.Equal(t, "config-18-10-2022.tar.gz", objects[0].Key)
+	require.Equal(t, "config", objects[0].VolumeName)
+	require.Equal(t, int64(1024), objects[0].Size)
+	require.True(t, time.Unix(1666062000, 0).Equal(objects[0].LastModified))
+	require.Equal(t, "config-other", objects[1].VolumeName)
+
+	require.Empty(t, parseStat("", ""))
+}
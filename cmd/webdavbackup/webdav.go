@@ -0,0 +1,287 @@
+package webdavbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/storage"
+	"docker-volume-backup/cmd/util/randutil"
+)
+
+const defaultChunkSizeMB = 10
+
+type Config struct {
+	// URL is the collection where archives are stored, e.g.
+	// https://cloud.example.com/remote.php/dav/files/user/backups
+	URL      string
+	Username string
+	Password string
+	// UploadsURL is the Nextcloud chunked upload collection, e.g.
+	// https://cloud.example.com/remote.php/dav/uploads/user
+	// If empty, archives are uploaded with a single streaming PUT.
+	UploadsURL string
+	// ChunkSize is the size of each chunk in bytes when using chunked uploads.
+	ChunkSize int
+}
+
+func FromEnv() Config {
+	webdavURL, _ := os.LookupEnv("WEBDAV_URL")
+	username, _ := os.LookupEnv("WEBDAV_USERNAME")
+	password, _ := os.LookupEnv("WEBDAV_PASSWORD")
+	uploadsURL, _ := os.LookupEnv("WEBDAV_UPLOADS_URL")
+	chunkSizeMB := defaultChunkSizeMB
+	if v, ok := os.LookupEnv("WEBDAV_CHUNK_SIZE_MB"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			chunkSizeMB = n
+		}
+	}
+	return Config{
+		URL:        webdavURL,
+		Username:   username,
+		Password:   password,
+		UploadsURL: uploadsURL,
+		ChunkSize:  chunkSizeMB * 1024 * 1024,
+	}
+}
+
+// Backend stores archives in a WebDAV collection, e.g. on Nextcloud or ownCloud.
+type Backend struct {
+	config Config
+	client *http.Client
+}
+
+func NewBackend(cfg Config) *Backend {
+	return &Backend{
+		config: cfg,
+		client: http.DefaultClient,
+	}
+}
+
+func (b *Backend) url(base, key string) string {
+	return strings.TrimSuffix(base, "/") + "/" + url.PathEscape(key)
+}
+
+func (b *Backend) do(ctx context.Context, method, target string, body io.Reader, header http.Header, expected ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if b.config.Username != "" {
+		req.SetBasicAuth(b.config.Username, b.config.Password)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("%s %s returned %s: %s", method, target, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// mkcol creates a collection, it is not an error if it already exists.
+func (b *Backend) mkcol(ctx context.Context, target string, header http.Header) error {
+	resp, err := b.do(ctx, "MKCOL", target, nil, header, http.StatusCreated, http.StatusMethodNotAllowed)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *Backend) Upload(ctx context.Context, key string, r io.Reader, m manifest.Manifest) error {
+	if err := b.mkcol(ctx, b.config.URL, nil); err != nil {
+		return fmt.Errorf("failed creating collection: %s", err)
+	}
+
+	if b.config.UploadsURL == "" || b.config.ChunkSize <= 0 {
+		return b.putAndMove(ctx, key, r)
+	}
+
+	// small archives do not need to be chunked.
+	first := make([]byte, b.config.ChunkSize)
+	n, err := io.ReadFull(r, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return b.putAndMove(ctx, key, bytes.NewReader(first[:n]))
+	}
+	if err != nil {
+		return err
+	}
+	return b.uploadChunked(ctx, key, io.MultiReader(bytes.NewReader(first), r))
+}
+
+// putAndMove uploads the archive to a temporary file and moves it into place once it was uploaded
+// completely, so that a failed upload does not replace an existing archive with a partial one.
+func (b *Backend) putAndMove(ctx context.Context, key string, r io.Reader) error {
+	tmp := b.url(b.config.URL, key+".tmp")
+	if err := b.put(ctx, tmp, r, nil); err != nil {
+		b.abortUpload(tmp)
+		return err
+	}
+	header := http.Header{
+		"Destination": []string{b.url(b.config.URL, key)},
+		"Overwrite":   []string{"T"},
+	}
+	resp, err := b.do(ctx, "MOVE", tmp, nil, header, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		b.abortUpload(tmp)
+		return fmt.Errorf("failed moving %s into place: %s", key, err)
+	}
+	return resp.Body.Close()
+}
+
+func (b *Backend) put(ctx context.Context, target string, r io.Reader, header http.Header) error {
+	resp, err := b.do(ctx, http.MethodPut, target, r, header, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// uploadChunked uploads the archive with Nextcloud chunked uploads. Each chunk is uploaded to a
+// temporary upload collection, which is then moved to the destination and assembled by the server.
+func (b *Backend) uploadChunked(ctx context.Context, key string, r io.Reader) error {
+	destination := http.Header{"Destination": []string{b.url(b.config.URL, key)}}
+	uploadDir := b.url(b.config.UploadsURL, fmt.Sprintf("docker-volume-backup-%s", randutil.StringRunes(16)))
+	if err := b.mkcol(ctx, uploadDir, destination); err != nil {
+		return fmt.Errorf("failed creating upload collection: %s", err)
+	}
+
+	buf := make([]byte, b.config.ChunkSize)
+	for i := 1; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			// chunks are assembled in order of their names.
+			chunk := b.url(uploadDir, fmt.Sprintf("%05d", i))
+			if err := b.put(ctx, chunk, bytes.NewReader(buf[:n]), destination); err != nil {
+				b.abortUpload(uploadDir)
+				return fmt.Errorf("failed uploading chunk %d: %s", i, err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			b.abortUpload(uploadDir)
+			return err
+		}
+	}
+
+	resp, err := b.do(ctx, "MOVE", b.url(uploadDir, ".file"), nil, destination, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		b.abortUpload(uploadDir)
+		return fmt.Errorf("failed assembling chunks: %s", err)
+	}
+	return resp.Body.Close()
+}
+
+func (b *Backend) abortUpload(uploadDir string) {
+	resp, err := b.do(context.Background(), http.MethodDelete, uploadDir, nil, nil, http.StatusNoContent, http.StatusOK)
+	if err == nil {
+		_ = resp.Body.Close()
+	}
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+  </d:prop>
+</d:propfind>`
+
+type multiStatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength int64  `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func (b *Backend) List(ctx context.Context, prefix string) ([]storage.Object, error) {
+	header := http.Header{
+		"Depth":        []string{"1"},
+		"Content-Type": []string{"application/xml"},
+	}
+	resp, err := b.do(ctx, "PROPFIND", b.config.URL, strings.NewReader(propfindBody), header, http.StatusMultiStatus, http.StatusNotFound)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return parseMultiStatus(resp.Body, prefix)
+}
+
+func parseMultiStatus(r io.Reader, prefix string) ([]storage.Object, error) {
+	var ms multiStatus
+	if err := xml.NewDecoder(r).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("failed parsing PROPFIND response: %s", err)
+	}
+
+	var objects []storage.Object
+	for _, resp := range ms.Responses {
+		name, err := url.PathUnescape(path.Base(strings.TrimSuffix(resp.Href, "/")))
+		if err != nil || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		for _, ps := range resp.Propstat {
+			if !strings.Contains(ps.Status, "200") || ps.Prop.ResourceType.Collection != nil {
+				continue
+			}
+			modified, err := http.ParseTime(ps.Prop.LastModified)
+			if err != nil {
+				modified = time.Time{}
+			}
+			if obj, ok := storage.NewObject(name, ps.Prop.ContentLength, modified); ok {
+				objects = append(objects, obj)
+			}
+		}
+	}
+	return objects, nil
+}
+
+func (b *Backend) Download(ctx context.Context, key string, w io.Writer) error {
+	resp, err := b.do(ctx, http.MethodGet, b.url(b.config.URL, key), nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.url(b.config.URL, key), nil, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
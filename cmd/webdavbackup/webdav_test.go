@@ -0,0 +1,145 @@
+package webdavbackup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"docker-volume-backup/cmd/manifest"
+	"docker-volume-backup/cmd/util/dateutil"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// newTestServer returns a WebDAV server, with a minimal implementation of Nextcloud
+// chunked uploads under /uploads.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	fs := webdav.NewMemFS()
+	dav := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	var mu sync.Mutex
+	chunks := map[string][]byte{}
+	mux := http.NewServeMux()
+	mux.Handle("/dav/", dav)
+	mux.HandleFunc("/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "MKCOL":
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodPut:
+			b, _ := io.ReadAll(r.Body)
+			chunks[r.URL.Path] = b
+			w.WriteHeader(http.StatusCreated)
+		case "MOVE":
+			dir := strings.TrimSuffix(r.URL.Path, ".file")
+			var names []string
+			for name := range chunks {
+				if strings.HasPrefix(name, dir) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			dest, _ := url.Parse(r.Header.Get("Destination"))
+			f, err := fs.OpenFile(r.Context(), strings.TrimPrefix(dest.Path, "/dav"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+			require.NoError(t, err)
+			for _, name := range names {
+				_, err := f.Write(chunks[name])
+				require.NoError(t, err)
+			}
+			require.NoError(t, f.Close())
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBackend(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t)
+	b := NewBackend(Config{
+		URL:        server.URL + "/dav/backups",
+		UploadsURL: server.URL + "/uploads/user",
+		ChunkSize:  4,
+	})
+
+	small := "config-" + dateutil.GetDayMonthYear() + ".tar.gz"
+	large := "metadata-" + dateutil.GetDayMonthYear() + ".tar.gz"
+	require.NoError(t, b.Upload(ctx, small, strings.NewReader("abc"), manifest.Manifest{VolumeName: "config"}))
+	require.NoError(t, b.Upload(ctx, large, strings.NewReader("chunked contents"), manifest.Manifest{VolumeName: "config"}))
+
+	t.Run("list", func(t *testing.T) {
+		objects, err := b.List(ctx, "")
+		require.NoError(t, err)
+		require.Len(t, objects, 2)
+
+		objects, err = b.List(ctx, "config")
+		require.NoError(t, err)
+		require.Len(t, objects, 1)
+		require.Equal(t, small, objects[0].Key)
+		require.Equal(t, "config", objects[0].VolumeName)
+		require.Equal(t, int64(3), objects[0].Size)
+		require.False(t, objects[0].LastModified.IsZero())
+	})
+
+	t.Run("download chunked upload", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, b.Download(ctx, large, &buf))
+		require.Equal(t, "chunked contents", buf.String())
+	})
+
+	t.Run("failed upload keeps the existing archive", func(t *testing.T) {
+		b := NewBackend(Config{URL: server.URL + "/dav/backups"})
+		r := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("interrupted")))
+		require.Error(t, b.Upload(ctx, small, r, manifest.Manifest{VolumeName: "config"}))
+
+		var buf bytes.Buffer
+		require.NoError(t, b.Download(ctx, small, &buf))
+		require.Equal(t, "abc", buf.String())
+		require.Error(t, b.Download(ctx, small+".tmp", io.Discard), "the temporary file should be removed")
+	})
+
+	t.Run("upload replaces the existing archive", func(t *testing.T) {
+		b := NewBackend(Config{URL: server.URL + "/dav/backups"})
+		require.NoError(t, b.Upload(ctx, small, strings.NewReader("abcd"), manifest.Manifest{VolumeName: "config"}))
+
+		var buf bytes.Buffer
+		require.NoError(t, b.Download(ctx, small, &buf))
+		require.Equal(t, "abcd", buf.String())
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, b.Delete(ctx, small))
+		objects, err := b.List(ctx, "config")
+		require.NoError(t, err)
+		require.Empty(t, objects)
+	})
+
+	t.Run("missing collection", func(t *testing.T) {
+		b := NewBackend(Config{URL: server.URL + "/dav/missing"})
+		objects, err := b.List(ctx, "")
+		require.NoError(t, err)
+		require.Empty(t, objects)
+	})
+}